@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Anonymization strategies. Constants are written "constant:<value>".
+const (
+	anonFakeEmail = "fake_email"
+	anonHash      = "hash"
+	anonNull      = "null"
+	anonConstant  = "constant"
+	anonShuffle   = "shuffle"
+)
+
+// AnonymizeProfile is a named set of rules from the anonymization config
+type AnonymizeProfile struct {
+	Name  string
+	Rules []AnonymizeRule
+}
+
+// AnonymizeRule replaces the values of one column
+type AnonymizeRule struct {
+	Schema   string
+	Table    string
+	Column   string
+	Strategy string
+	Value    string // for constant
+}
+
+// SnapshotAnonymization records the profile applied to an anonymized
+// snapshot, with its rules as "schema.table.column": "strategy"
+type SnapshotAnonymization struct {
+	Profile string            `json:"profile"`
+	Rules   map[string]string `json:"rules"`
+}
+
+// anonymizeConfigPath is the profile config: ANONYMIZE_CONFIG, or
+// .devbox/anonymize.json in the workspace repository
+func anonymizeConfigPath() string {
+	if path := getEnv("ANONYMIZE_CONFIG", ""); path != "" {
+		return path
+	}
+	repo := workspaceRepo()
+	if repo == "" {
+		repo = "/workspace"
+	}
+	return filepath.Join(repo, ".devbox", "anonymize.json")
+}
+
+// loadAnonymizeProfiles reads every profile in the config file, which maps
+// profile names to rules:
+//
+//	{"share": {"users.email": "fake_email", "users.name": "constant:Jane Doe"}}
+//
+// A missing config file means there are no profiles.
+func loadAnonymizeProfiles() (map[string]*AnonymizeProfile, error) {
+	data, err := os.ReadFile(anonymizeConfigPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var config map[string]map[string]string
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", anonymizeConfigPath(), err)
+	}
+
+	profiles := make(map[string]*AnonymizeProfile)
+	for name, rules := range config {
+		profile := &AnonymizeProfile{Name: name}
+		for column, strategy := range rules {
+			rule, err := parseAnonymizeRule(column, strategy)
+			if err != nil {
+				return nil, fmt.Errorf("profile %s: %v", name, err)
+			}
+			profile.Rules = append(profile.Rules, rule)
+		}
+		sort.Slice(profile.Rules, func(i, j int) bool { return profile.Rules[i].key() < profile.Rules[j].key() })
+		profiles[name] = profile
+	}
+	return profiles, nil
+}
+
+// anonymizeProfileNames lists the configured profiles for the dashboard
+func anonymizeProfileNames() []string {
+	profiles, _ := loadAnonymizeProfiles()
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// findAnonymizeProfile loads the named profile
+func findAnonymizeProfile(name string) (*AnonymizeProfile, error) {
+	profiles, err := loadAnonymizeProfiles()
+	if err != nil {
+		return nil, err
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("no anonymization profile %q in %s", name, anonymizeConfigPath())
+	}
+	return profile, nil
+}
+
+// parseAnonymizeRule parses a "[schema.]table.column" key and its strategy
+func parseAnonymizeRule(column, strategy string) (AnonymizeRule, error) {
+	i := strings.LastIndex(column, ".")
+	if i <= 0 || i == len(column)-1 {
+		return AnonymizeRule{}, fmt.Errorf("%q is not table.column", column)
+	}
+	rule := AnonymizeRule{Column: column[i+1:], Strategy: strategy}
+	rule.Schema, rule.Table = splitQualifiedName(column[:i])
+
+	if value, ok := strings.CutPrefix(strategy, anonConstant+":"); ok {
+		rule.Strategy, rule.Value = anonConstant, value
+	}
+	switch rule.Strategy {
+	case anonFakeEmail, anonHash, anonNull, anonConstant, anonShuffle:
+	default:
+		return AnonymizeRule{}, fmt.Errorf("%s: unknown strategy %q (use fake_email, hash, null, constant:<value> or shuffle)", column, strategy)
+	}
+	return rule, nil
+}
+
+func (r AnonymizeRule) key() string {
+	return r.Schema + "." + r.Table + "." + r.Column
+}
+
+// statement returns the UPDATE that applies the rule. salt keeps hashes and
+// fake emails consistent within one snapshot without being reversible by
+// hashing known values.
+func (r AnonymizeRule) statement(salt string) string {
+	table := pq.QuoteIdentifier(r.Schema) + "." + pq.QuoteIdentifier(r.Table)
+	col := pq.QuoteIdentifier(r.Column)
+	hash := fmt.Sprintf("md5(%s || %s::text)", pq.QuoteLiteral(salt), col)
+
+	switch r.Strategy {
+	case anonFakeEmail:
+		return fmt.Sprintf("UPDATE %s SET %s = 'user_' || left(%s, 12) || '@example.com' WHERE %s IS NOT NULL", table, col, hash, col)
+	case anonHash:
+		return fmt.Sprintf("UPDATE %s SET %s = %s WHERE %s IS NOT NULL", table, col, hash, col)
+	case anonNull:
+		return fmt.Sprintf("UPDATE %s SET %s = NULL", table, col)
+	case anonConstant:
+		return fmt.Sprintf("UPDATE %s SET %s = %s WHERE %s IS NOT NULL", table, col, pq.QuoteLiteral(r.Value), col)
+	default: // shuffle
+		// Pair every row, in random order, with a value from the column
+		return fmt.Sprintf(`
+			WITH targets AS (SELECT ctid AS id, row_number() OVER (ORDER BY random()) AS n FROM %[1]s),
+			     vals AS (SELECT %[2]s AS v, row_number() OVER () AS n FROM %[1]s)
+			UPDATE %[1]s SET %[2]s = vals.v
+			FROM targets JOIN vals USING (n)
+			WHERE %[1]s.ctid = targets.id`, table, col)
+	}
+}
+
+// record describes the profile for the snapshot metadata
+func (p *AnonymizeProfile) record() *SnapshotAnonymization {
+	rec := &SnapshotAnonymization{Profile: p.Name, Rules: make(map[string]string)}
+	for _, r := range p.Rules {
+		rec.Rules[r.key()] = r.Strategy
+		if r.Strategy == anonConstant {
+			rec.Rules[r.key()] += ":" + r.Value
+		}
+	}
+	return rec
+}
+
+// copyDatabase loads a plain dump of source, made with the extra pg_dump
+// arguments given, into target. Unlike cloneDatabase it does not need source
+// to be idle.
+func copyDatabase(ctx context.Context, job *Job, source, target string, dumpArgs ...string) error {
+	dump := pgCommand(ctx, "pg_dump", append([]string{"-d", source}, dumpArgs...)...)
+	load := pgCommand(ctx, "psql", "-X", "-q", "-d", target, "-v", "ON_ERROR_STOP=1")
+	pipe, err := dump.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	load.Stdin = pipe
+	var dumpErr strings.Builder
+	dump.Stderr = &dumpErr
+
+	if err := dump.Start(); err != nil {
+		return err
+	}
+	loadErr := runJobCommand(job, load, nil)
+	// pg_dump fails with a broken pipe if psql gave up first, so psql's
+	// error is the interesting one
+	if err := dump.Wait(); err != nil && loadErr == nil {
+		return fmt.Errorf("pg_dump failed: %v: %s", err, strings.TrimSpace(dumpErr.String()))
+	}
+	return loadErr
+}
+
+// anonymizedCopy copies POSTGRES_DB into a throwaway database and applies
+// profile to it, returning the database's name. The caller dumps and drops
+// it; the live database is never modified.
+func anonymizedCopy(ctx context.Context, job *Job, profile *AnonymizeProfile) (string, error) {
+	if adminDB == nil {
+		return "", fmt.Errorf("no connection to the maintenance database")
+	}
+	live := getEnv("POSTGRES_DB", "devdb")
+	scratch := scratchDBName(live, "anon_"+time.Now().Format("20060102150405"))
+
+	job.logf("Copying %s into %s", live, scratch)
+	if err := createEmptyDatabase(ctx, scratch); err != nil {
+		return "", fmt.Errorf("could not create scratch database: %v", err)
+	}
+	if err := copyDatabase(ctx, job, live, scratch); err != nil {
+		dropDatabase(scratch)
+		return "", err
+	}
+	if err := applyAnonymizeProfile(ctx, job, scratch, profile); err != nil {
+		dropDatabase(scratch)
+		return "", err
+	}
+	return scratch, nil
+}
+
+// applyAnonymizeProfile runs the profile's rules in dbName in a single
+// transaction. Triggers and foreign key checks are disabled so that
+// rewriting a column does not fire application logic.
+func applyAnonymizeProfile(ctx context.Context, job *Job, dbName string, profile *AnonymizeProfile) error {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+
+	conn, err := sql.Open("postgres", connString(dbName))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SET LOCAL session_replication_role = replica"); err != nil {
+		return err
+	}
+	for _, rule := range profile.Rules {
+		res, err := tx.ExecContext(ctx, rule.statement(hex.EncodeToString(salt)))
+		if err != nil {
+			return fmt.Errorf("%s (%s): %v", rule.key(), rule.Strategy, err)
+		}
+		n, _ := res.RowsAffected()
+		job.logf("Anonymized %s with %s (%d rows)", rule.key(), rule.Strategy, n)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAnonymizeRule(t *testing.T) {
+	tests := []struct {
+		column, strategy string
+		want             AnonymizeRule
+		wantErr          bool
+	}{
+		{"users.email", "fake_email", AnonymizeRule{Schema: "public", Table: "users", Column: "email", Strategy: anonFakeEmail}, false},
+		{"app.users.ssn", "hash", AnonymizeRule{Schema: "app", Table: "users", Column: "ssn", Strategy: anonHash}, false},
+		{`"My App"."Users".phone`, "null", AnonymizeRule{Schema: "My App", Table: "Users", Column: "phone", Strategy: anonNull}, false},
+		{"users.name", "constant:Jane Doe", AnonymizeRule{Schema: "public", Table: "users", Column: "name", Strategy: anonConstant, Value: "Jane Doe"}, false},
+		{"users.note", "constant:", AnonymizeRule{Schema: "public", Table: "users", Column: "note", Strategy: anonConstant}, false},
+		{"users.note", "constant:a:b", AnonymizeRule{Schema: "public", Table: "users", Column: "note", Strategy: anonConstant, Value: "a:b"}, false},
+		{"users.city", "shuffle", AnonymizeRule{Schema: "public", Table: "users", Column: "city", Strategy: anonShuffle}, false},
+		{"email", "hash", AnonymizeRule{}, true},
+		{".email", "hash", AnonymizeRule{}, true},
+		{"users.", "hash", AnonymizeRule{}, true},
+		{"users.email", "redact", AnonymizeRule{}, true},
+		{"users.email", "constant", AnonymizeRule{Schema: "public", Table: "users", Column: "email", Strategy: anonConstant}, false},
+		{"users.email", "", AnonymizeRule{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseAnonymizeRule(tt.column, tt.strategy)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseAnonymizeRule(%q, %q) error = %v, wantErr %v", tt.column, tt.strategy, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("parseAnonymizeRule(%q, %q) = %+v, want %+v", tt.column, tt.strategy, got, tt.want)
+		}
+	}
+}
+
+func TestLoadAnonymizeProfiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string // "" for no config file
+		want    map[string]*SnapshotAnonymization
+		wantErr string
+	}{
+		{name: "no config"},
+		{
+			name:   "profiles",
+			config: `{"share": {"users.name": "constant:Jane Doe", "users.email": "fake_email"}, "demo": {"app.orders.address": "null"}}`,
+			want: map[string]*SnapshotAnonymization{
+				"share": {Profile: "share", Rules: map[string]string{"public.users.email": "fake_email", "public.users.name": "constant:Jane Doe"}},
+				"demo":  {Profile: "demo", Rules: map[string]string{"app.orders.address": "null"}},
+			},
+		},
+		{name: "bad rule", config: `{"share": {"users.email": "scramble"}}`, wantErr: "profile share"},
+		{name: "not a profile map", config: `["share"]`, wantErr: "anonymize.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "anonymize.json")
+			t.Setenv("ANONYMIZE_CONFIG", path)
+			if tt.config != "" {
+				if err := os.WriteFile(path, []byte(tt.config), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			profiles, err := loadAnonymizeProfiles()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]*SnapshotAnonymization)
+			for name, p := range profiles {
+				got[name] = p.record()
+				for i := 1; i < len(p.Rules); i++ {
+					if p.Rules[i-1].key() > p.Rules[i].key() {
+						t.Errorf("profile %s: rules not sorted", name)
+					}
+				}
+			}
+			if tt.want == nil {
+				tt.want = map[string]*SnapshotAnonymization{}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("profiles = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnonymizeStatementQuoting(t *testing.T) {
+	rule := AnonymizeRule{Schema: "public", Table: `we"ird`, Column: "name", Strategy: anonConstant, Value: "O'Brien"}
+	got := rule.statement("salt")
+	for _, want := range []string{`"public"."we""ird"`, `'O''Brien'`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("statement() = %q, missing %s", got, want)
+		}
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Database branches are full copies of POSTGRES_DB made with
+// CREATE DATABASE ... TEMPLATE. The active branch is always the database
+// named POSTGRES_DB, so the dev service, pgweb and snapshots never need to
+// be reconfigured; switching renames the active database out of the way and
+// the chosen branch into its place. Each branch database carries its name
+// in a database comment, which survives the renames.
+const branchCommentPrefix = "devbox branch: "
+
+// defaultBranch names the active database until it is given a branch name
+const defaultBranch = "main"
+
+// DBBranch is a branch database as shown on the dashboard
+type DBBranch struct {
+	Name      string
+	Database  string
+	SizeBytes int64
+	Size      string
+	Active    bool
+}
+
+// branchNameRe accepts git-style branch names
+var branchNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]{0,99}$`)
+
+// branchDBName is the database a branch is parked in while inactive:
+// <POSTGRES_DB>__<name>, lowercased with anything but [a-z0-9_] replaced
+func branchDBName(live, name string) string {
+	slug := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '_'
+	}, name)
+	const maxIdentifier = 63
+	if len(live)+2+len(slug) > maxIdentifier {
+		slug = slug[:max(0, maxIdentifier-2-len(live))]
+	}
+	return live + "__" + slug
+}
+
+// databaseBranch returns the branch name recorded on dbName, or ""
+func databaseBranch(dbName string) string {
+	var comment string
+	adminDB.QueryRow(`
+		SELECT coalesce(shobj_description(oid, 'pg_database'), '')
+		FROM pg_database WHERE datname = $1
+	`, dbName).Scan(&comment)
+	if !strings.HasPrefix(comment, branchCommentPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(comment, branchCommentPrefix)
+}
+
+func setDatabaseBranch(dbName, branch string) error {
+	_, err := adminDB.Exec(fmt.Sprintf("COMMENT ON DATABASE %s IS %s",
+		pq.QuoteIdentifier(dbName), pq.QuoteLiteral(branchCommentPrefix+branch)))
+	return err
+}
+
+// listBranches returns the active branch first, then the parked ones by name
+func listBranches(ctx context.Context) ([]DBBranch, error) {
+	if adminDB == nil {
+		return nil, fmt.Errorf("no connection to the maintenance database")
+	}
+	live := getEnv("POSTGRES_DB", "devdb")
+
+	rows, err := adminDB.QueryContext(ctx, `
+		SELECT datname, pg_database_size(oid), coalesce(shobj_description(oid, 'pg_database'), '')
+		FROM pg_database
+		WHERE datname = $1 OR shobj_description(oid, 'pg_database') LIKE $2
+		ORDER BY datname = $1 DESC, datname
+	`, live, branchCommentPrefix+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var branches []DBBranch
+	for rows.Next() {
+		var b DBBranch
+		var comment string
+		if err := rows.Scan(&b.Database, &b.SizeBytes, &comment); err != nil {
+			return nil, err
+		}
+		b.Active = b.Database == live
+		b.Name = strings.TrimPrefix(comment, branchCommentPrefix)
+		if b.Active && !strings.HasPrefix(comment, branchCommentPrefix) {
+			b.Name = defaultBranch
+		}
+		b.Size = formatSize(b.SizeBytes)
+		branches = append(branches, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(branches) == 0 || !branches[0].Active {
+		return nil, fmt.Errorf("database %s does not exist", live)
+	}
+	return branches, nil
+}
+
+func findBranch(branches []DBBranch, name string) *DBBranch {
+	for i := range branches {
+		if branches[i].Name == name {
+			return &branches[i]
+		}
+	}
+	return nil
+}
+
+// startBranchJob runs a branch operation in the background. Branch
+// operations and restores exclude each other.
+func startBranchJob(kind, name string, fn func(ctx context.Context, job *Job) error) (*Job, error) {
+	if adminDB == nil {
+		return nil, fmt.Errorf("no connection to the maintenance database")
+	}
+	if !databaseMu.TryLock() {
+		return nil, errDatabaseBusy
+	}
+	job := jobs.start(kind, name, func(ctx context.Context, job *Job) error {
+		defer databaseMu.Unlock()
+		return fn(ctx, job)
+	})
+	return job, nil
+}
+
+// createBranch clones the branch from (the active one if empty) into a new
+// branch called name
+func createBranch(ctx context.Context, job *Job, name, from string) error {
+	if !branchNameRe.MatchString(name) {
+		return fmt.Errorf("invalid branch name %q", name)
+	}
+	branches, err := listBranches(ctx)
+	if err != nil {
+		return err
+	}
+	if findBranch(branches, name) != nil {
+		return fmt.Errorf("branch %q already exists", name)
+	}
+
+	source := branches[0]
+	if from != "" {
+		b := findBranch(branches, from)
+		if b == nil {
+			return fmt.Errorf("branch %q does not exist", from)
+		}
+		source = *b
+	}
+
+	target := branchDBName(getEnv("POSTGRES_DB", "devdb"), name)
+	var exists bool
+	adminDB.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)", target).Scan(&exists)
+	if exists {
+		return fmt.Errorf("database %s already exists", target)
+	}
+
+	job.logf("Cloning branch %s (%s, %s) into %s", source.Name, source.Database, source.Size, target)
+	if err := cloneDatabase(ctx, job, source.Database, target); err != nil {
+		return err
+	}
+	if err := setDatabaseBranch(target, name); err != nil {
+		dropDatabase(target)
+		return fmt.Errorf("could not name branch database: %v", err)
+	}
+	// Name the source too, so it is still listed once it is parked
+	if source.Active && databaseBranch(source.Database) == "" {
+		setDatabaseBranch(source.Database, source.Name)
+	}
+
+	job.logf("Created branch %s", name)
+	return nil
+}
+
+// cloneDatabase copies source into a new database target. PostgreSQL only
+// copies a template nobody is connected to, so sessions on source are
+// drained and terminated as for a restore.
+func cloneDatabase(ctx context.Context, job *Job, source, target string) error {
+	if err := setAllowConnections(ctx, source, false); err != nil {
+		return fmt.Errorf("could not block new connections to %s: %v", source, err)
+	}
+	defer func() {
+		if err := setAllowConnections(context.Background(), source, true); err != nil {
+			job.logf("Warning: could not re-enable connections to %s: %v", source, err)
+		}
+	}()
+
+	if err := drainConnections(ctx, job, source); err != nil {
+		return err
+	}
+	if source == getEnv("POSTGRES_DB", "devdb") {
+		resetDBPool()
+	}
+
+	_, err := adminDB.ExecContext(ctx, fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s OWNER %s",
+		pq.QuoteIdentifier(target), pq.QuoteIdentifier(source), pq.QuoteIdentifier(getEnv("POSTGRES_USER", "postgres"))))
+	if err != nil {
+		return fmt.Errorf("could not clone %s: %v", source, err)
+	}
+	return nil
+}
+
+// switchBranch makes name the active branch. The active database is renamed
+// to its branch database and the chosen branch is renamed to POSTGRES_DB.
+func switchBranch(ctx context.Context, job *Job, name string) error {
+	branches, err := listBranches(ctx)
+	if err != nil {
+		return err
+	}
+	target := findBranch(branches, name)
+	if target == nil {
+		return fmt.Errorf("branch %q does not exist", name)
+	}
+	if target.Active {
+		job.logf("Branch %s is already active", name)
+		return nil
+	}
+
+	live := getEnv("POSTGRES_DB", "devdb")
+	current := branches[0]
+	park := branchDBName(live, current.Name)
+	var exists bool
+	adminDB.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)", park).Scan(&exists)
+	if exists {
+		return fmt.Errorf("cannot park branch %s: database %s already exists", current.Name, park)
+	}
+	if err := setDatabaseBranch(live, current.Name); err != nil {
+		return fmt.Errorf("could not name branch database: %v", err)
+	}
+
+	job.logf("Switching from %s to %s", current.Name, name)
+	if err := swapDatabase(ctx, job, target.Database, live, park); err != nil {
+		return err
+	}
+	if err := setAllowConnections(context.Background(), park, true); err != nil {
+		job.logf("Warning: could not re-enable connections to %s: %v", park, err)
+	}
+
+	job.logf("Branch %s is now active (%s parked as %s)", name, current.Name, park)
+	return nil
+}
+
+// deleteBranch drops a parked branch. The active branch cannot be deleted.
+func deleteBranch(ctx context.Context, name string) error {
+	if !databaseMu.TryLock() {
+		return errDatabaseBusy
+	}
+	defer databaseMu.Unlock()
+
+	branches, err := listBranches(ctx)
+	if err != nil {
+		return err
+	}
+	b := findBranch(branches, name)
+	if b == nil {
+		return fmt.Errorf("branch %q does not exist", name)
+	}
+	if b.Active {
+		return fmt.Errorf("cannot delete the active branch")
+	}
+	return dropDatabase(b.Database)
+}
+
+// branchAutoSwitchEnabled reports whether the active branch follows the git
+// branch checked out in the workspace (BRANCH_AUTO_SWITCH)
+func branchAutoSwitchEnabled() bool {
+	return getEnv("BRANCH_AUTO_SWITCH", "false") == "true"
+}
+
+// runBranchWatcher polls the workspace's git branch every
+// BRANCH_POLL_INTERVAL (default 10s). When it changes, the database branch
+// of the same name is activated, cloning the active one first if needed.
+// Only changes are acted on, so enabling it never switches by itself.
+func runBranchWatcher() {
+	interval, err := time.ParseDuration(getEnv("BRANCH_POLL_INTERVAL", "10s"))
+	if err != nil || interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	last := ""
+	for {
+		repo := workspaceRepo()
+		current := ""
+		if repo != "" {
+			current = gitOutput(repo, "rev-parse", "--abbrev-ref", "HEAD")
+		}
+		// Detached HEADs (rebases, bisects) are not branches
+		if current != "" && current != "HEAD" {
+			if last != "" && current != last {
+				autoSwitchBranch(current)
+			}
+			last = current
+		}
+		time.Sleep(interval)
+	}
+}
+
+func autoSwitchBranch(name string) {
+	if !branchNameRe.MatchString(name) {
+		log.Printf("Branches: not following git branch %q: invalid name", name)
+		return
+	}
+	_, err := startBranchJob("branch-switch", name, func(ctx context.Context, job *Job) error {
+		branches, err := listBranches(ctx)
+		if err != nil {
+			return err
+		}
+		if findBranch(branches, name) == nil {
+			if err := createBranch(ctx, job, name, ""); err != nil {
+				return err
+			}
+		}
+		return switchBranch(ctx, job, name)
+	})
+	if err != nil {
+		log.Printf("Branches: could not follow git branch %s: %v", name, err)
+	}
+}
+
+func handleBranches(w http.ResponseWriter, r *http.Request) {
+	branches, err := listBranches(r.Context())
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"branches":    branches,
+		"auto_switch": branchAutoSwitchEnabled(),
+	})
+}
+
+func handleCreateBranch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if !branchNameRe.MatchString(name) {
+		http.Error(w, "Invalid branch name", http.StatusBadRequest)
+		return
+	}
+	from := r.URL.Query().Get("from")
+	// Pass switch=1 to activate the branch once it has been created
+	activate := r.URL.Query().Get("switch") != ""
+
+	job, err := startBranchJob("branch-create", name, func(ctx context.Context, job *Job) error {
+		if err := createBranch(ctx, job, name, from); err != nil {
+			return err
+		}
+		if activate {
+			return switchBranch(ctx, job, name)
+		}
+		return nil
+	})
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"job_id":  job.Info().ID,
+	})
+}
+
+func handleSwitchBranch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "Missing name", http.StatusBadRequest)
+		return
+	}
+
+	job, err := startBranchJob("branch-switch", name, func(ctx context.Context, job *Job) error {
+		return switchBranch(ctx, job, name)
+	})
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"job_id":  job.Info().ID,
+	})
+}
+
+func handleDeleteBranch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "Missing name", http.StatusBadRequest)
+		return
+	}
+
+	if err := deleteBranch(r.Context(), name); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	invalidateCache()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBranchDBName(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	tests := []struct {
+		live, name, want string
+	}{
+		{"devdb", "main", "devdb__main"},
+		{"devdb", "Feature/Login-Page", "devdb__feature_login_page"},
+		{"devdb", "release-1.2", "devdb__release_1_2"},
+		{"devdb", long, "devdb__" + strings.Repeat("x", 56)},
+		{strings.Repeat("d", 60), "topic", strings.Repeat("d", 60) + "__t"},
+		{strings.Repeat("d", 61), "topic", strings.Repeat("d", 61) + "__"},
+	}
+	for _, tt := range tests {
+		got := branchDBName(tt.live, tt.name)
+		if got != tt.want {
+			t.Errorf("branchDBName(%q, %q) = %q, want %q", tt.live, tt.name, got, tt.want)
+		}
+		if len(got) > 63 {
+			t.Errorf("branchDBName(%q, %q) is %d bytes, longer than an identifier", tt.live, tt.name, len(got))
+		}
+	}
+}
+
+func TestBranchDBNameCollisions(t *testing.T) {
+	// Names that differ only in case, punctuation or past the identifier
+	// limit share a database; createBranch refuses the second one
+	tests := []struct {
+		a, b string
+	}{
+		{"feature/x", "feature-x"},
+		{"Fix.Bug", "fix_bug"},
+		{strings.Repeat("a", 60) + "1", strings.Repeat("a", 60) + "2"},
+	}
+	for _, tt := range tests {
+		if branchDBName("devdb", tt.a) != branchDBName("devdb", tt.b) {
+			t.Errorf("branchDBName(%q) != branchDBName(%q), want the same database", tt.a, tt.b)
+		}
+	}
+	if branchDBName("devdb", "feature/a") == branchDBName("devdb", "feature/b") {
+		t.Error("different branches share a database")
+	}
+}
+
+func TestBranchNameRe(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"main", true},
+		{"feature/login", true},
+		{"release-1.2", true},
+		{"-leading-dash", false},
+		{"/leading-slash", false},
+		{"has space", false},
+		{"semi;colon", false},
+		{"", false},
+		{strings.Repeat("a", 100), true},
+		{strings.Repeat("a", 101), false},
+	}
+	for _, tt := range tests {
+		if got := branchNameRe.MatchString(tt.name); got != tt.ok {
+			t.Errorf("branchNameRe.MatchString(%q) = %v, want %v", tt.name, got, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Session is a client backend from pg_stat_activity
+type Session struct {
+	PID         int
+	Database    string
+	User        string
+	Application string
+	Client      string
+	State       string
+	WaitEvent   string // e.g. "Lock:relation" while waiting for a lock
+	Query       string // the running query, or the last one when idle
+	// Duration is how long the session has been in its current state: the
+	// running time of an active query, or the idle time otherwise
+	Duration        string
+	DurationSeconds float64
+	XactSeconds     float64 // age of the open transaction, 0 if none
+	BlockedBy       []int   `json:",omitempty"`
+	Blocking        []int   `json:",omitempty"`
+	WaitingFor      string  `json:",omitempty"` // the lock being waited for, from pg_locks
+}
+
+// Describe summarizes a session for job logs
+func (s Session) Describe() string {
+	app := s.Application
+	if app == "" {
+		app = "unnamed"
+	}
+	desc := fmt.Sprintf("pid %d (%s, %s %s)", s.PID, app, s.State, s.Duration)
+	if s.Query != "" {
+		desc += ": " + truncate(strings.Join(strings.Fields(s.Query), " "), 80)
+	}
+	return desc
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "…"
+}
+
+// listSessions returns the client backends connected to dbName, or to every
+// database if dbName is empty, apart from the one running the query.
+// Blocking relationships come from pg_blocking_pids.
+func listSessions(ctx context.Context, dbName string) ([]Session, error) {
+	if adminDB == nil {
+		return nil, fmt.Errorf("no connection to the maintenance database")
+	}
+	rows, err := adminDB.QueryContext(ctx, `
+		SELECT pid, coalesce(datname, ''), coalesce(usename, ''), application_name,
+			coalesce(host(client_addr), 'local'), coalesce(state, ''),
+			coalesce(wait_event_type || ':' || wait_event, ''), coalesce(query, ''),
+			coalesce(extract(epoch FROM now() - CASE WHEN state = 'active' THEN query_start ELSE state_change END), 0),
+			coalesce(extract(epoch FROM now() - xact_start), 0),
+			pg_blocking_pids(pid)
+		FROM pg_stat_activity
+		WHERE backend_type = 'client backend' AND pid <> pg_backend_pid()
+			AND ($1::text = '' OR datname::text = $1::text)
+		ORDER BY datname, backend_start
+	`, dbName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	index := make(map[int]int)
+	for rows.Next() {
+		var s Session
+		var blockedBy pq.Int64Array
+		if err := rows.Scan(&s.PID, &s.Database, &s.User, &s.Application, &s.Client, &s.State,
+			&s.WaitEvent, &s.Query, &s.DurationSeconds, &s.XactSeconds, &blockedBy); err != nil {
+			return nil, err
+		}
+		s.Duration = formatDuration(time.Duration(s.DurationSeconds * float64(time.Second)))
+		for _, pid := range blockedBy {
+			s.BlockedBy = append(s.BlockedBy, int(pid))
+		}
+		index[s.PID] = len(sessions)
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, s := range sessions {
+		for _, pid := range s.BlockedBy {
+			if i, ok := index[pid]; ok {
+				sessions[i].Blocking = append(sessions[i].Blocking, s.PID)
+			}
+		}
+	}
+	if waits, err := lockWaits(ctx); err == nil {
+		for pid, lock := range waits {
+			if i, ok := index[pid]; ok {
+				sessions[i].WaitingFor = lock
+			}
+		}
+	}
+	return sessions, nil
+}
+
+// lockWaits describes the ungranted locks in pg_locks by pid. Relation names
+// can only be resolved in the database the query runs in, so the live
+// database is used when possible; other relations show up as OIDs.
+func lockWaits(ctx context.Context) (map[int]string, error) {
+	conn := db
+	if conn == nil {
+		conn = adminDB
+	}
+	rows, err := conn.QueryContext(ctx, `
+		SELECT l.pid, l.mode, l.locktype,
+			CASE
+				WHEN l.relation IS NULL THEN ''
+				WHEN l.database = (SELECT oid FROM pg_database WHERE datname = current_database()) THEN l.relation::regclass::text
+				ELSE 'relation ' || l.relation
+			END
+		FROM pg_locks l
+		WHERE NOT l.granted AND l.pid IS NOT NULL
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	waits := make(map[int]string)
+	for rows.Next() {
+		var pid int
+		var mode, locktype, relation string
+		if err := rows.Scan(&pid, &mode, &locktype, &relation); err != nil {
+			return nil, err
+		}
+		if relation != "" {
+			waits[pid] = mode + " on " + relation
+		} else {
+			waits[pid] = mode + " (" + locktype + ")"
+		}
+	}
+	return waits, rows.Err()
+}
+
+// signalBackend cancels the current query of a session, or terminates the
+// session altogether
+func signalBackend(ctx context.Context, pid int, terminate bool) error {
+	if adminDB == nil {
+		return fmt.Errorf("no connection to the maintenance database")
+	}
+	fn := "pg_cancel_backend"
+	if terminate {
+		fn = "pg_terminate_backend"
+	}
+	var ok sql.NullBool
+	if err := adminDB.QueryRowContext(ctx, "SELECT "+fn+"($1)", pid).Scan(&ok); err != nil {
+		return err
+	}
+	if !ok.Bool {
+		return fmt.Errorf("no session with pid %d", pid)
+	}
+	return nil
+}
+
+// restoreBlockers returns the sessions holding locks that pg_dump or
+// pg_restore are waiting for on dbName, such as a migration left idle in a
+// transaction that keeps the pre-restore snapshot from reading a table
+func restoreBlockers(ctx context.Context, dbName string) ([]Session, error) {
+	sessions, err := listSessions(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	blockers := make(map[int]bool)
+	for _, s := range sessions {
+		if s.Database == dbName && (s.Application == "pg_dump" || s.Application == "pg_restore") {
+			for _, pid := range s.BlockedBy {
+				blockers[pid] = true
+			}
+		}
+	}
+	var result []Session
+	for _, s := range sessions {
+		if blockers[s.PID] {
+			result = append(result, s)
+		}
+	}
+	return result, nil
+}
+
+// watchRestoreBlockers polls for sessions blocking the restore's own
+// backends on dbName until the returned function is called. They are logged
+// once each and published as the job's BlockedBy so the dashboard can offer
+// to terminate them.
+func watchRestoreBlockers(ctx context.Context, job *Job, dbName string) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	published := false // read by stop only once the goroutine has exited
+	go func() {
+		defer close(done)
+		logged := make(map[int]bool)
+		ticker := time.NewTicker(2 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			blockers, err := restoreBlockers(ctx, dbName)
+			if err != nil {
+				continue
+			}
+			for _, s := range blockers {
+				if !logged[s.PID] {
+					logged[s.PID] = true
+					job.logf("Waiting for a lock held by %s", s.Describe())
+				}
+			}
+			// Leave BlockedBy alone while drainConnections is using it
+			if len(blockers) > 0 || published {
+				setBlockedBy(job, blockers)
+				published = len(blockers) > 0
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+		if published {
+			setBlockedBy(job, nil)
+		}
+	}
+}
+
+// setBlockedBy publishes the pids of sessions a job is waiting for
+func setBlockedBy(job *Job, sessions []Session) {
+	if job == nil {
+		return
+	}
+	var pids []int
+	for _, s := range sessions {
+		pids = append(pids, s.PID)
+	}
+	sort.Ints(pids)
+	if fmt.Sprint(pids) == fmt.Sprint(job.Info().BlockedBy) {
+		return
+	}
+	job.update(func(info *JobInfo) { info.BlockedBy = pids })
+}
+
+// formatDuration renders d as e.g. "45s", "12m" or "3h05m"
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	default:
+		return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+	}
+}
+
+// handleConnections lists sessions, optionally only those on database
+func handleConnections(w http.ResponseWriter, r *http.Request) {
+	sessions, err := listSessions(r.Context(), r.URL.Query().Get("database"))
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	if sessions == nil {
+		sessions = []Session{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"sessions": sessions,
+	})
+}
+
+// handleSignalBackend serves /api/connections/cancel and
+// /api/connections/terminate. pid takes a comma-separated list.
+func handleSignalBackend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var pids []int
+	for _, field := range strings.Split(r.URL.Query().Get("pid"), ",") {
+		pid, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || pid <= 0 {
+			http.Error(w, fmt.Sprintf("invalid pid %q", field), http.StatusBadRequest)
+			return
+		}
+		pids = append(pids, pid)
+	}
+	terminate := strings.HasSuffix(r.URL.Path, "/terminate")
+
+	var failed []string
+	for _, pid := range pids {
+		if err := signalBackend(r.Context(), pid, terminate); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(failed) > 0 {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   strings.Join(failed, "; "),
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+	})
+}
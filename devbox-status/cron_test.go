@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{"0 2 * * *", false},
+		{"*/15 * * * *", false},
+		{"0 9-17 * * 1-5", false},
+		{"0,30 8 1,15 * *", false},
+		{"5/10 * * * *", false},
+		{"0 0 * * 7", false},
+		{"@daily", false},
+		{" @hourly ", false},
+		{"", true},
+		{"* * * *", true},
+		{"* * * * * *", true},
+		{"60 * * * *", true},
+		{"* 24 * * *", true},
+		{"* * 0 * *", true},
+		{"* * * 13 *", true},
+		{"* * * * 8", true},
+		{"5-1 * * * *", true},
+		{"*/0 * * * *", true},
+		{"a * * * *", true},
+		{"1-a * * * *", true},
+		{"@often", true},
+	}
+	for _, tt := range tests {
+		_, err := parseCron(tt.expr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCron(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	tests := []struct {
+		expr string
+		from string
+		want string // "" for none
+	}{
+		{"0 2 * * *", "2024-03-15 01:59", "2024-03-15 02:00"},
+		{"0 2 * * *", "2024-03-15 02:00", "2024-03-16 02:00"},
+		{"*/15 * * * *", "2024-03-15 10:07", "2024-03-15 10:15"},
+		{"*/15 * * * *", "2024-03-15 10:45", "2024-03-15 11:00"},
+		{"5/10 * * * *", "2024-03-15 10:06", "2024-03-15 10:15"},
+		{"0 9-17 * * 1-5", "2024-03-15 17:30", "2024-03-18 09:00"}, // Friday evening to Monday
+		{"0 0 * * 7", "2024-03-15 12:00", "2024-03-17 00:00"},      // 7 is Sunday
+		{"0 0 * * 0", "2024-03-15 12:00", "2024-03-17 00:00"},
+		{"0 0 31 * *", "2024-04-01 00:00", "2024-05-31 00:00"},
+		{"0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		{"0 0 30 2 *", "2024-01-01 00:00", ""},
+		{"@monthly", "2024-12-31 23:59", "2025-01-01 00:00"},
+		// A restricted day of month and day of week match either
+		{"0 0 13 * 5", "2024-03-01 00:00", "2024-03-08 00:00"},
+		{"0 0 13 * 5", "2024-03-08 00:00", "2024-03-13 00:00"},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.expr, err)
+		}
+		got := s.Next(at(tt.from))
+		if tt.want == "" {
+			if !got.IsZero() {
+				t.Errorf("%q.Next(%s) = %v, want none", tt.expr, tt.from, got)
+			}
+			continue
+		}
+		if want := at(tt.want); !got.Equal(want) {
+			t.Errorf("%q.Next(%s) = %v, want %v", tt.expr, tt.from, got, want)
+		}
+	}
+}
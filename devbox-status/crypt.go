@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Encrypted snapshots are written as a stream of AES-256-GCM sealed chunks
+// so they can be produced and consumed through pipes without the plaintext
+// ever being written to disk. The file layout is:
+//
+//	magic (8 bytes) | key id (8 bytes) | salt (16 bytes) | chunks...
+//
+// Each file gets its own key, derived from the configured key and the salt,
+// so the chunk counter can serve as the nonce. The final chunk is sealed
+// with different additional data, which makes a truncated file fail to
+// decrypt instead of ending early.
+const (
+	extEncrypted   = ".enc"
+	encMagic       = "DBXENC01"
+	encChunkSize   = 64 << 10
+	encSaltSize    = 16
+	encKeyIDSize   = 8
+	encHeaderSize  = len(encMagic) + encKeyIDSize + encSaltSize
+	defaultKeyFile = "/etc/secrets/snapshot_key"
+)
+
+// snapshotKeyPath is the key file: SNAPSHOT_KEY_FILE, or the file the
+// entrypoint writes from SNAPSHOT_ENCRYPTION_KEY
+func snapshotKeyPath() string {
+	return getEnv("SNAPSHOT_KEY_FILE", defaultKeyFile)
+}
+
+// encryptionConfigured reports whether a snapshot key is available
+func encryptionConfigured() bool {
+	_, err := os.Stat(snapshotKeyPath())
+	return err == nil
+}
+
+// loadSnapshotKey reads the key file. Any passphrase works; it is hashed
+// into a 256-bit key.
+func loadSnapshotKey() ([]byte, error) {
+	data, err := os.ReadFile(snapshotKeyPath())
+	if err != nil {
+		return nil, fmt.Errorf("snapshot key: %v", err)
+	}
+	secret := bytes.TrimSpace(data)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("snapshot key %s is empty", snapshotKeyPath())
+	}
+	key := sha256.Sum256(secret)
+	return key[:], nil
+}
+
+// keyID identifies a key without revealing it, so that decrypting with the
+// wrong key gives a clear error
+func keyID(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("devbox snapshot key id"))
+	return mac.Sum(nil)[:encKeyIDSize]
+}
+
+// fileCipher derives the cipher for one file from the key and its salt
+func fileCipher(key, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(aead cipher.AEAD, n uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], n)
+	return nonce
+}
+
+func chunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// isEncryptedSnapshot reports whether a snapshot name has the .enc extension
+func isEncryptedSnapshot(path string) bool {
+	return strings.HasSuffix(path, extEncrypted)
+}
+
+// encryptWriter encrypts everything written to it into w. Close must be
+// called to write the final chunk; it does not close w.
+type encryptWriter struct {
+	w    io.Writer
+	aead cipher.AEAD
+	buf  []byte
+	out  []byte
+	n    uint64
+}
+
+// newEncryptWriter writes the header for a new encrypted file to w
+func newEncryptWriter(w io.Writer) (*encryptWriter, error) {
+	key, err := loadSnapshotKey()
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, encSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := fileCipher(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append(append([]byte(encMagic), keyID(key)...), salt...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, buf: make([]byte, 0, encChunkSize)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data arrives, so that the
+		// final chunk is always sealed by Close
+		if len(e.buf) == encChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		k := min(encChunkSize-len(e.buf), len(p))
+		e.buf = append(e.buf, p[:k]...)
+		p = p[k:]
+		written += k
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	e.out = e.aead.Seal(e.out[:0], chunkNonce(e.aead, e.n), e.buf, chunkAD(last))
+	e.n++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(e.out)
+	return err
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+// decryptReader decrypts a file written by encryptWriter
+type decryptReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	chunk []byte
+	plain []byte
+	n     uint64
+	done  bool
+}
+
+// newDecryptReader reads the header of an encrypted file from r
+func newDecryptReader(r io.Reader) (*decryptReader, error) {
+	header := make([]byte, encHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(encMagic)]) != encMagic {
+		return nil, fmt.Errorf("not an encrypted snapshot")
+	}
+	key, err := loadSnapshotKey()
+	if err != nil {
+		return nil, err
+	}
+	id := header[len(encMagic) : len(encMagic)+encKeyIDSize]
+	if !hmac.Equal(id, keyID(key)) {
+		return nil, fmt.Errorf("snapshot was encrypted with a different key (key id %x)", id)
+	}
+	aead, err := fileCipher(key, header[len(encMagic)+encKeyIDSize:])
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		r:     bufio.NewReaderSize(r, encChunkSize+aead.Overhead()),
+		aead:  aead,
+		chunk: make([]byte, encChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) next() error {
+	k, err := io.ReadFull(d.r, d.chunk)
+	last := false
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		last = true
+	case err == io.EOF:
+		return fmt.Errorf("encrypted snapshot is truncated")
+	case err != nil:
+		return err
+	default:
+		_, perr := d.r.Peek(1)
+		last = perr == io.EOF
+	}
+
+	plain, err := d.aead.Open(d.chunk[:0], chunkNonce(d.aead, d.n), d.chunk[:k], chunkAD(last))
+	if err != nil {
+		return fmt.Errorf("encrypted snapshot is corrupt or truncated (chunk %d)", d.n)
+	}
+	d.n++
+	d.plain = plain
+	d.done = last
+	return nil
+}
+
+// openSnapshotFile opens a snapshot file for reading, decrypting it if
+// needed. Compressed dumps are returned as they are stored.
+func openSnapshotFile(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !isEncryptedSnapshot(path) {
+		return f, nil
+	}
+	d, err := newDecryptReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", filepath.Base(path), err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{d, f}, nil
+}
+
+// pgRestoreCommand builds a pg_restore command reading the archive at path.
+// Encrypted archives are decrypted into its standard input. The returned
+// closer must be called once the command has finished.
+func pgRestoreCommand(ctx context.Context, path string, args ...string) (*exec.Cmd, io.Closer, error) {
+	if !isEncryptedSnapshot(path) {
+		return pgCommand(ctx, "pg_restore", append(args, path)...), io.NopCloser(nil), nil
+	}
+	r, err := openSnapshotFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd := pgCommand(ctx, "pg_restore", args...)
+	cmd.Stdin = r
+	return cmd, r, nil
+}
+
+// runEncryptedJobCommand runs cmd like runJobCommand, encrypting its
+// standard output into a new file at path
+func runEncryptedJobCommand(job *Job, cmd *exec.Cmd, path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	enc, err := newEncryptWriter(f)
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	cmd.Stdout = enc
+	err = runJobCommand(job, cmd, nil)
+	if cerr := enc.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// errNoEncryption is returned when encryption is requested without a key
+var errNoEncryption = errors.New("snapshot encryption is not configured (set SNAPSHOT_ENCRYPTION_KEY)")
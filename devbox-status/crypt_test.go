@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useSnapshotKey configures a snapshot key for the duration of the test
+func useSnapshotKey(t *testing.T, secret string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "snapshot_key")
+	if err := os.WriteFile(path, []byte(secret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SNAPSHOT_KEY_FILE", path)
+}
+
+func encryptForTest(t *testing.T, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := newEncryptWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Uneven writes, so chunks don't line up with them
+	for p := plain; len(p) > 0; {
+		k := min(len(p), 1000)
+		if _, err := w.Write(p[:k]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[k:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decryptForTest(data []byte) ([]byte, error) {
+	r, err := newDecryptReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	useSnapshotKey(t, "correct horse battery staple")
+
+	for _, size := range []int{0, 1, encChunkSize - 1, encChunkSize, encChunkSize + 1, 3*encChunkSize + 5} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		data := encryptForTest(t, plain)
+		if !bytes.HasPrefix(data, []byte(encMagic)) {
+			t.Fatalf("size %d: missing magic", size)
+		}
+		got, err := decryptForTest(data)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("size %d: round trip changed the data", size)
+		}
+	}
+}
+
+func TestDecryptDetectsDamage(t *testing.T) {
+	useSnapshotKey(t, "correct horse battery staple")
+	plain := make([]byte, 2*encChunkSize+100)
+	rand.Read(plain)
+	data := encryptForTest(t, plain)
+	chunk := encChunkSize + 16 // sealed chunk size with the GCM tag
+
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"header only", data[:encHeaderSize], "truncated"},
+		{"last chunk dropped", data[:encHeaderSize+2*chunk], "corrupt or truncated"},
+		{"last two chunks dropped", data[:encHeaderSize+chunk], "corrupt or truncated"},
+		{"cut inside the last chunk", data[:len(data)-10], "corrupt or truncated"},
+		{"cut inside a chunk", data[:encHeaderSize+chunk+100], "corrupt or truncated"},
+		{"flipped bit", func() []byte {
+			d := append([]byte(nil), data...)
+			d[encHeaderSize+chunk+5] ^= 1
+			return d
+		}(), "corrupt or truncated"},
+		{"not encrypted", []byte("-- PostgreSQL database dump\n"), "not an encrypted snapshot"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decryptForTest(tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestDecryptWithDifferentKey(t *testing.T) {
+	useSnapshotKey(t, "one key")
+	data := encryptForTest(t, []byte("secret rows"))
+
+	useSnapshotKey(t, "another key")
+	if _, err := decryptForTest(data); err == nil || !strings.Contains(err.Error(), "different key") {
+		t.Errorf("error = %v, want a different key error", err)
+	}
+}
+
+func TestSnapshotOptionsEncryption(t *testing.T) {
+	tests := []struct {
+		name            string
+		key             bool
+		envFormat       string
+		format, encrypt string
+		wantFormat      string
+		wantEncrypt     bool
+		wantErr         bool
+	}{
+		{name: "no key", envFormat: formatCustom, wantFormat: formatCustom},
+		{name: "key", key: true, envFormat: formatCustom, wantFormat: formatCustom, wantEncrypt: true},
+		{name: "key, opted out", key: true, encrypt: "0", wantFormat: formatPlain},
+		{name: "encrypt without key", encrypt: "1", wantErr: true},
+		{name: "directory default falls back", key: true, envFormat: formatDirectory, wantFormat: formatCustom, wantEncrypt: true},
+		{name: "directory default, opted out", key: true, envFormat: formatDirectory, encrypt: "0", wantFormat: formatDirectory},
+		{name: "directory requested", key: true, format: formatDirectory, wantErr: true},
+		{name: "directory requested, opted out", key: true, format: formatDirectory, encrypt: "false", wantFormat: formatDirectory},
+		{name: "directory without key", envFormat: formatDirectory, wantFormat: formatDirectory},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.key {
+				useSnapshotKey(t, "secret")
+			} else {
+				t.Setenv("SNAPSHOT_KEY_FILE", filepath.Join(t.TempDir(), "missing"))
+			}
+			t.Setenv("SNAPSHOT_FORMAT", tt.envFormat)
+			opts, err := parseSnapshotOptions(tt.format, "", tt.encrypt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if opts.Format != tt.wantFormat || opts.Encrypt != tt.wantEncrypt {
+				t.Errorf("got format %q, encrypt %v, want %q, %v", opts.Format, opts.Encrypt, tt.wantFormat, tt.wantEncrypt)
+			}
+		})
+	}
+}
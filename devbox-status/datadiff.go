@@ -0,0 +1,577 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	rowInserted = "inserted"
+	rowDeleted  = "deleted"
+	rowUpdated  = "updated"
+)
+
+const (
+	// maxStoredRowChanges bounds the changes kept per table; counts stay exact
+	maxStoredRowChanges = 50000
+	// maxDataDiffs is how many finished diffs are kept for paging
+	maxDataDiffs    = 5
+	defaultDiffPage = 100
+	maxDiffPage     = 1000
+)
+
+// DataDiff is the row-level difference between two sources for a set of
+// tables, computed by a "datadiff" job
+type DataDiff struct {
+	ID        string          `json:"id"`
+	From      string          `json:"from"`
+	To        string          `json:"to"`
+	CreatedAt time.Time       `json:"created_at"`
+	Tables    []TableDataDiff `json:"tables"`
+}
+
+// TableDataDiff summarises the changes to one table. Changes holds them
+// sorted by key and is served a page at a time.
+type TableDataDiff struct {
+	Table      string      `json:"table"`
+	PrimaryKey []string    `json:"primary_key,omitempty"`
+	Inserted   int         `json:"inserted"`
+	Deleted    int         `json:"deleted"`
+	Updated    int         `json:"updated"`
+	Truncated  bool        `json:"truncated,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Changes    []RowChange `json:"-"`
+}
+
+// RowChange is a row that was inserted, deleted or updated. Inserted and
+// deleted rows carry the whole row; updated rows only the changed columns.
+type RowChange struct {
+	Change  string                     `json:"change"`
+	Key     json.RawMessage            `json:"key"`
+	Row     map[string]json.RawMessage `json:"row,omitempty"`
+	Columns []ColumnChange             `json:"columns,omitempty"`
+}
+
+// ColumnChange is one column of an updated row
+type ColumnChange struct {
+	Column string          `json:"column"`
+	From   json.RawMessage `json:"from"`
+	To     json.RawMessage `json:"to"`
+}
+
+// dataDiffs keeps the most recent diffs, keyed by job ID
+var dataDiffs = struct {
+	sync.Mutex
+	entries map[string]*DataDiff
+}{entries: make(map[string]*DataDiff)}
+
+func storeDataDiff(d *DataDiff) {
+	dataDiffs.Lock()
+	defer dataDiffs.Unlock()
+	dataDiffs.entries[d.ID] = d
+	for len(dataDiffs.entries) > maxDataDiffs {
+		var oldest *DataDiff
+		for _, e := range dataDiffs.entries {
+			if oldest == nil || e.CreatedAt.Before(oldest.CreatedAt) {
+				oldest = e
+			}
+		}
+		delete(dataDiffs.entries, oldest.ID)
+	}
+}
+
+func getDataDiff(id string) *DataDiff {
+	dataDiffs.Lock()
+	defer dataDiffs.Unlock()
+	return dataDiffs.entries[id]
+}
+
+// parseTableList splits a comma-separated list of tables into schema and
+// name pairs
+func parseTableList(list string) []SnapshotTable {
+	var tables []SnapshotTable
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			schema, name := splitQualifiedName(t)
+			tables = append(tables, SnapshotTable{Schema: schema, Name: name})
+		}
+	}
+	return tables
+}
+
+func startDataDiffJob(from, to string, tables []SnapshotTable) (*Job, error) {
+	if adminDB == nil {
+		return nil, fmt.Errorf("no connection to the maintenance database")
+	}
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("no tables selected")
+	}
+	paths := make(map[string]string)
+	for _, source := range []string{from, to} {
+		if source == liveSource {
+			continue
+		}
+		path, err := resolveSnapshotPath(source)
+		if err != nil {
+			return nil, err
+		}
+		paths[source] = path
+	}
+
+	job := jobs.start("datadiff", from, func(ctx context.Context, job *Job) error {
+		return runDataDiff(ctx, job, from, to, paths, tables)
+	})
+	return job, nil
+}
+
+// runDataDiff loads both sources into throwaway databases and compares the
+// selected tables row by row
+func runDataDiff(ctx context.Context, job *Job, from, to string, paths map[string]string, tables []SnapshotTable) error {
+	stamp := time.Now().Format("20060102150405")
+	fromDB, err := openDiffSource(ctx, job, from, paths[from], scratchDBName(getEnv("POSTGRES_DB", "devdb"), "diff_a_"+stamp))
+	if err != nil {
+		return err
+	}
+	defer fromDB.Close()
+	toDB, err := openDiffSource(ctx, job, to, paths[to], scratchDBName(getEnv("POSTGRES_DB", "devdb"), "diff_b_"+stamp))
+	if err != nil {
+		return err
+	}
+	defer toDB.Close()
+
+	diff := &DataDiff{ID: job.Info().ID, From: from, To: to, CreatedAt: time.Now()}
+	for _, t := range tables {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		job.update(func(info *JobInfo) { info.CurrentTable = t.qualified() })
+		td := diffTableData(ctx, fromDB.DB, toDB.DB, t)
+		if td.Error != "" {
+			job.logf("%s: %s", td.Table, td.Error)
+		} else {
+			job.logf("%s: %d inserted, %d deleted, %d updated", td.Table, td.Inserted, td.Deleted, td.Updated)
+		}
+		diff.Tables = append(diff.Tables, td)
+	}
+	storeDataDiff(diff)
+	return nil
+}
+
+// diffSource is a connection to one side of a data diff. Closing it drops
+// the scratch database the snapshot was loaded into, if any.
+type diffSource struct {
+	*sql.DB
+	scratch string
+	job     *Job
+}
+
+func (s *diffSource) Close() error {
+	err := s.DB.Close()
+	if s.scratch != "" {
+		s.job.logf("Dropping %s", s.scratch)
+		dropDatabase(s.scratch)
+	}
+	return err
+}
+
+// openDiffSource connects to the live database, or loads the snapshot at
+// path into scratch and connects to that
+func openDiffSource(ctx context.Context, job *Job, source, path, scratch string) (*diffSource, error) {
+	if source == liveSource {
+		conn, err := sql.Open("postgres", connString(getEnv("POSTGRES_DB", "devdb")))
+		if err != nil {
+			return nil, err
+		}
+		return &diffSource{DB: conn, job: job}, nil
+	}
+
+	job.logf("Loading %s into %s", source, scratch)
+	job.update(func(info *JobInfo) { info.Bytes, info.TotalBytes = 0, snapshotSize(path) })
+	if err := createEmptyDatabase(ctx, scratch); err != nil {
+		return nil, fmt.Errorf("could not create scratch database: %v", err)
+	}
+	if err := loadSnapshot(ctx, job, path, scratch); err != nil {
+		dropDatabase(scratch)
+		return nil, fmt.Errorf("%s: %v", source, err)
+	}
+	conn, err := sql.Open("postgres", connString(scratch))
+	if err != nil {
+		dropDatabase(scratch)
+		return nil, err
+	}
+	return &diffSource{DB: conn, scratch: scratch, job: job}, nil
+}
+
+// primaryKey returns the primary key columns of table in key order
+func primaryKey(ctx context.Context, conn *sql.DB, table string) ([]string, error) {
+	rows, err := conn.QueryContext(ctx, `
+		SELECT a.attname
+		FROM pg_index i
+		JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+		WHERE i.indrelid = to_regclass($1) AND i.indisprimary
+		ORDER BY array_position(i.indkey::int2[], a.attnum)
+	`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+// scanTableRows calls fn with the primary key and contents of every row of
+// table, both as JSON text
+func scanTableRows(ctx context.Context, conn *sql.DB, table string, pk []string, fn func(key, row string)) error {
+	keyCols := make([]string, len(pk))
+	for i, col := range pk {
+		keyCols[i] = "t." + pq.QuoteIdentifier(col)
+	}
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf(
+		"SELECT jsonb_build_array(%s)::text, to_jsonb(t)::text FROM %s t",
+		strings.Join(keyCols, ", "), table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, row string
+		if err := rows.Scan(&key, &row); err != nil {
+			return err
+		}
+		fn(key, row)
+	}
+	return rows.Err()
+}
+
+// diffTableData matches the rows of t in both databases by primary key. The
+// from side is read twice: once to hash every row, and once more to fetch
+// the rows that turned out to be deleted or updated.
+func diffTableData(ctx context.Context, from, to *sql.DB, t SnapshotTable) TableDataDiff {
+	td := TableDataDiff{Table: t.qualified()}
+	table := pq.QuoteIdentifier(t.Schema) + "." + pq.QuoteIdentifier(t.Name)
+
+	pk, err := primaryKey(ctx, from, table)
+	if err != nil {
+		td.Error = err.Error()
+		return td
+	}
+	if len(pk) == 0 {
+		td.Error = "table not found or has no primary key in the first source"
+		return td
+	}
+	toPK, err := primaryKey(ctx, to, table)
+	switch {
+	case err != nil:
+		td.Error = err.Error()
+		return td
+	case len(toPK) == 0:
+		td.Error = "table not found or has no primary key in the second source"
+		return td
+	case strings.Join(toPK, ",") != strings.Join(pk, ","):
+		td.Error = "primary key differs between the two sources"
+		return td
+	}
+	td.PrimaryKey = pk
+
+	hashes := make(map[string][sha256.Size]byte)
+	err = scanTableRows(ctx, from, table, pk, func(key, row string) {
+		hashes[key] = sha256.Sum256([]byte(row))
+	})
+	if err != nil {
+		td.Error = err.Error()
+		return td
+	}
+
+	// Only the first maxStoredRowChanges changes are decoded and kept (an
+	// updated row counts once its new version is held); after that only the
+	// counts go up
+	var changes []RowChange
+	budget := &rowChangeBudget{limit: maxStoredRowChanges}
+	keep := budget.take
+	updated := make(map[string]map[string]json.RawMessage)
+	err = scanTableRows(ctx, to, table, pk, func(key, row string) {
+		hash, ok := hashes[key]
+		switch {
+		case !ok:
+			td.Inserted++
+			if keep() {
+				changes = append(changes, RowChange{Change: rowInserted, Key: json.RawMessage(key), Row: decodeRow(row)})
+			}
+		case hash != sha256.Sum256([]byte(row)):
+			td.Updated++
+			if keep() {
+				updated[key] = decodeRow(row)
+			}
+		}
+		delete(hashes, key)
+	})
+	if err != nil {
+		td.Error = err.Error()
+		return td
+	}
+
+	// Whatever is left in hashes was deleted
+	td.Deleted = len(hashes)
+	if td.Deleted > 0 && budget.full() {
+		budget.truncated = true
+	}
+	if len(updated) > 0 || (td.Deleted > 0 && !budget.full()) {
+		err = scanTableRows(ctx, from, table, pk, func(key, row string) {
+			if _, ok := hashes[key]; ok {
+				if !keep() {
+					return
+				}
+				changes = append(changes, RowChange{Change: rowDeleted, Key: json.RawMessage(key), Row: decodeRow(row)})
+			} else if newRow, ok := updated[key]; ok {
+				changes = append(changes, RowChange{Change: rowUpdated, Key: json.RawMessage(key), Columns: diffColumns(decodeRow(row), newRow)})
+			}
+		})
+		if err != nil {
+			td.Error = err.Error()
+			return td
+		}
+	}
+
+	sortRowChanges(changes)
+	td.Changes = changes
+	td.Truncated = budget.truncated
+	return td
+}
+
+// rowChangeBudget bounds the row changes kept for a table. Once limit are
+// held take refuses, and the diff is marked truncated.
+type rowChangeBudget struct {
+	limit, stored int
+	truncated     bool
+}
+
+func (b *rowChangeBudget) take() bool {
+	if b.full() {
+		b.truncated = true
+		return false
+	}
+	b.stored++
+	return true
+}
+
+func (b *rowChangeBudget) full() bool {
+	return b.stored >= b.limit
+}
+
+// sortRowChanges orders changes by primary key, comparing the key values
+// rather than their JSON text so that 9 sorts before 10
+func sortRowChanges(changes []RowChange) {
+	keys := make([][]interface{}, len(changes))
+	for i, c := range changes {
+		d := json.NewDecoder(bytes.NewReader(c.Key))
+		d.UseNumber()
+		d.Decode(&keys[i])
+	}
+	sort.Sort(rowChangesByKey{changes, keys})
+}
+
+type rowChangesByKey struct {
+	changes []RowChange
+	keys    [][]interface{}
+}
+
+func (s rowChangesByKey) Len() int { return len(s.changes) }
+func (s rowChangesByKey) Less(i, j int) bool {
+	return compareKeys(s.keys[i], s.keys[j]) < 0
+}
+func (s rowChangesByKey) Swap(i, j int) {
+	s.changes[i], s.changes[j] = s.changes[j], s.changes[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+// compareKeys compares two decoded primary keys column by column. Numbers
+// compare numerically and strings lexically; nulls sort first, and values
+// of different types sort by type.
+func compareKeys(a, b []interface{}) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareKeyValues(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+func compareKeyValues(a, b interface{}) int {
+	if ta, tb := keyTypeOrder(a), keyTypeOrder(b); ta != tb {
+		return ta - tb
+	}
+	switch x := a.(type) {
+	case json.Number:
+		fa, _ := new(big.Float).SetString(string(x))
+		fb, _ := new(big.Float).SetString(string(b.(json.Number)))
+		if fa != nil && fb != nil {
+			return fa.Cmp(fb)
+		}
+		return strings.Compare(string(x), string(b.(json.Number)))
+	case string:
+		return strings.Compare(x, b.(string))
+	case bool:
+		switch {
+		case x == b.(bool):
+			return 0
+		case !x:
+			return -1
+		}
+		return 1
+	case nil:
+		return 0
+	}
+	// Arrays and objects (composite keys of json columns) fall back to text
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return bytes.Compare(ja, jb)
+}
+
+func keyTypeOrder(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case json.Number:
+		return 2
+	case string:
+		return 3
+	}
+	return 4
+}
+
+func decodeRow(row string) map[string]json.RawMessage {
+	var m map[string]json.RawMessage
+	json.Unmarshal([]byte(row), &m)
+	return m
+}
+
+// diffColumns lists the columns whose values differ between two versions of
+// a row, in column name order
+func diffColumns(from, to map[string]json.RawMessage) []ColumnChange {
+	var changes []ColumnChange
+	for col, value := range to {
+		if old, ok := from[col]; !ok || !bytes.Equal(old, value) {
+			changes = append(changes, ColumnChange{Column: col, From: from[col], To: value})
+		}
+	}
+	for col, old := range from {
+		if _, ok := to[col]; !ok {
+			changes = append(changes, ColumnChange{Column: col, From: old})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Column < changes[j].Column })
+	return changes
+}
+
+// handleStartDataDiff starts a job comparing the rows of the given tables
+// (tables=public.users,app.orders) between from and to, each a snapshot
+// filename or "live"
+func handleStartDataDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+	if from == "" || to == "" {
+		http.Error(w, "Missing from or to", http.StatusBadRequest)
+		return
+	}
+
+	job, err := startDataDiffJob(from, to, parseTableList(r.URL.Query().Get("tables")))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"job_id":  job.Info().ID,
+	})
+}
+
+// handleDataDiff returns the summary of a finished diff. With table set it
+// also returns a page of that table's changes (offset, limit), optionally
+// only those of one kind (change=inserted|deleted|updated).
+func handleDataDiff(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	diff := getDataDiff(q.Get("id"))
+	if diff == nil {
+		http.Error(w, "Diff not found (still running, failed or expired)", http.StatusNotFound)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"success": true,
+		"diff":    diff,
+	}
+
+	if name := q.Get("table"); name != "" {
+		var td *TableDataDiff
+		for i := range diff.Tables {
+			if diff.Tables[i].Table == name {
+				td = &diff.Tables[i]
+			}
+		}
+		if td == nil {
+			http.Error(w, "Table not part of this diff", http.StatusBadRequest)
+			return
+		}
+
+		changes := td.Changes
+		if kind := q.Get("change"); kind != "" {
+			filtered := []RowChange{}
+			for _, c := range changes {
+				if c.Change == kind {
+					filtered = append(filtered, c)
+				}
+			}
+			changes = filtered
+		}
+
+		offset := max(parseInt(q.Get("offset")), 0)
+		limit := parseInt(q.Get("limit"))
+		if limit <= 0 {
+			limit = defaultDiffPage
+		}
+		limit = min(limit, maxDiffPage)
+		start := min(offset, len(changes))
+		end := min(start+limit, len(changes))
+
+		resp["table"] = td
+		resp["total"] = len(changes)
+		resp["offset"] = start
+		resp["changes"] = append([]RowChange{}, changes[start:end]...)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestCompareKeys(t *testing.T) {
+	n := func(s string) json.Number { return json.Number(s) }
+	tests := []struct {
+		name string
+		a, b []interface{}
+		want int // sign only
+	}{
+		{"equal", []interface{}{n("1")}, []interface{}{n("1")}, 0},
+		{"numeric, not text", []interface{}{n("9")}, []interface{}{n("10")}, -1},
+		{"negative", []interface{}{n("-5")}, []interface{}{n("3")}, -1},
+		{"decimals", []interface{}{n("1.5")}, []interface{}{n("1.25")}, 1},
+		{"beyond float64", []interface{}{n("9007199254740993")}, []interface{}{n("9007199254740992")}, 1},
+		{"strings", []interface{}{"apple"}, []interface{}{"banana"}, -1},
+		{"booleans", []interface{}{false}, []interface{}{true}, -1},
+		{"null first", []interface{}{nil}, []interface{}{n("0")}, -1},
+		{"numbers before strings", []interface{}{n("100")}, []interface{}{"1"}, -1},
+		{"composite, second column", []interface{}{n("1"), "b"}, []interface{}{n("1"), "a"}, 1},
+		{"composite, first column wins", []interface{}{n("1"), "z"}, []interface{}{n("2"), "a"}, -1},
+		{"shorter first", []interface{}{n("1")}, []interface{}{n("1"), n("0")}, -1},
+		{"json values", []interface{}{map[string]interface{}{"a": n("1")}}, []interface{}{map[string]interface{}{"a": n("2")}}, -1},
+	}
+	sign := func(n int) int {
+		switch {
+		case n < 0:
+			return -1
+		case n > 0:
+			return 1
+		}
+		return 0
+	}
+	for _, tt := range tests {
+		if got := sign(compareKeys(tt.a, tt.b)); got != tt.want {
+			t.Errorf("%s: compareKeys() = %d, want %d", tt.name, got, tt.want)
+		}
+		if got := sign(compareKeys(tt.b, tt.a)); got != -tt.want {
+			t.Errorf("%s: compareKeys() reversed = %d, want %d", tt.name, got, -tt.want)
+		}
+	}
+}
+
+func TestSortRowChanges(t *testing.T) {
+	changes := []RowChange{
+		{Change: rowUpdated, Key: json.RawMessage(`[10]`)},
+		{Change: rowInserted, Key: json.RawMessage(`[9]`)},
+		{Change: rowDeleted, Key: json.RawMessage(`[null]`)},
+		{Change: rowInserted, Key: json.RawMessage(`[100]`)},
+	}
+	sortRowChanges(changes)
+	var got []string
+	for _, c := range changes {
+		got = append(got, string(c.Key))
+	}
+	if want := []string{"[null]", "[9]", "[10]", "[100]"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+}
+
+func TestRowChangeBudget(t *testing.T) {
+	tests := []struct {
+		limit, takes  int
+		wantKept      int
+		wantTruncated bool
+	}{
+		{3, 0, 0, false},
+		{3, 2, 2, false},
+		{3, 3, 3, false},
+		{3, 4, 3, true},
+		{3, 10, 3, true},
+		{0, 1, 0, true},
+	}
+	for _, tt := range tests {
+		b := &rowChangeBudget{limit: tt.limit}
+		kept := 0
+		for i := 0; i < tt.takes; i++ {
+			if b.take() {
+				kept++
+			}
+		}
+		if kept != tt.wantKept || b.truncated != tt.wantTruncated {
+			t.Errorf("limit %d, %d takes: kept %d, truncated %v, want %d, %v",
+				tt.limit, tt.takes, kept, b.truncated, tt.wantKept, tt.wantTruncated)
+		}
+		if b.full() != (tt.wantKept == tt.limit) {
+			t.Errorf("limit %d, %d takes: full() = %v", tt.limit, tt.takes, b.full())
+		}
+	}
+}
+
+func TestDiffColumns(t *testing.T) {
+	from := map[string]json.RawMessage{"id": json.RawMessage(`1`), "email": json.RawMessage(`"a@example.com"`), "old": json.RawMessage(`true`)}
+	to := map[string]json.RawMessage{"id": json.RawMessage(`1`), "email": json.RawMessage(`"b@example.com"`), "new": json.RawMessage(`null`)}
+	want := []ColumnChange{
+		{Column: "email", From: json.RawMessage(`"a@example.com"`), To: json.RawMessage(`"b@example.com"`)},
+		{Column: "new", To: json.RawMessage(`null`)},
+		{Column: "old", From: json.RawMessage(`true`)},
+	}
+	if got := diffColumns(from, to); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffColumns() = %s, want %s", got, want)
+	}
+}
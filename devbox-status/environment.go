@@ -0,0 +1,879 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Environment snapshots bundle the database, Valkey and the state of the
+// workspace repository into one tar archive:
+//
+//	manifest.json      what the archive holds (also kept as a sidecar)
+//	postgres.dump      custom-format pg_dump of POSTGRES_DB
+//	valkey.keys        every Valkey key, see dumpValkey
+//	workspace.diff     git diff HEAD --binary of the workspace repository
+//
+// With a snapshot key configured the components are encrypted (and named
+// .enc) while the manifest is not, like a snapshot and its sidecar.
+const (
+	extEnvironment = ".environment.tar"
+
+	envManifest  = "manifest.json"
+	envPostgres  = "postgres.dump"
+	envValkey    = "valkey.keys"
+	envWorkspace = "workspace.diff"
+)
+
+// Components of an environment snapshot
+const (
+	componentPostgres  = "postgres"
+	componentValkey    = "valkey"
+	componentWorkspace = "workspace"
+)
+
+// EnvironmentManifest describes an environment snapshot. Components that
+// could not be captured are left out.
+type EnvironmentManifest struct {
+	Version   int                   `json:"version"`
+	Kind      string                `json:"kind,omitempty"`
+	Label     string                `json:"label,omitempty"`
+	Notes     string                `json:"notes,omitempty"`
+	CreatedBy string                `json:"created_by,omitempty"`
+	CreatedAt time.Time             `json:"created_at"`
+	Postgres  *EnvironmentPostgres  `json:"postgres,omitempty"`
+	Valkey    *EnvironmentValkey    `json:"valkey,omitempty"`
+	Workspace *EnvironmentWorkspace `json:"workspace,omitempty"`
+	Skipped   map[string]string     `json:"skipped,omitempty"` // component: reason
+}
+
+// EnvironmentPostgres is the database part of an environment snapshot
+type EnvironmentPostgres struct {
+	File     string        `json:"file"`
+	Database string        `json:"database"`
+	Meta     *SnapshotMeta `json:"meta,omitempty"`
+}
+
+// EnvironmentValkey is the Valkey part of an environment snapshot
+type EnvironmentValkey struct {
+	File      string `json:"file"`
+	Keys      int    `json:"keys"`
+	Databases []int  `json:"databases"`
+}
+
+// EnvironmentWorkspace is the git state of the workspace repository
+type EnvironmentWorkspace struct {
+	Repo      string   `json:"repo"`
+	Branch    string   `json:"branch,omitempty"`
+	Commit    string   `json:"commit"`
+	DiffFile  string   `json:"diff_file,omitempty"` // absent when the tree was clean
+	Untracked []string `json:"untracked,omitempty"` // listed but not captured
+}
+
+// EnvironmentSnapshot is an environment snapshot as shown on the dashboard
+type EnvironmentSnapshot struct {
+	Filename string
+	Size     string
+	Date     string
+	Manifest *EnvironmentManifest
+}
+
+func isEnvironmentFile(filename string) bool {
+	return strings.HasSuffix(filename, extEnvironment)
+}
+
+// resolveEnvironmentPath resolves an environment snapshot filename inside
+// snapshotsDir, rejecting anything that would escape it
+func resolveEnvironmentPath(filename string) (string, error) {
+	if filename == "" || filename != filepath.Base(filename) || strings.HasPrefix(filename, ".") || !isEnvironmentFile(filename) {
+		return "", fmt.Errorf("invalid environment snapshot filename %q", filename)
+	}
+	return filepath.Join(snapshotsDir, filename), nil
+}
+
+// listEnvironments returns the environment snapshots, newest first
+func listEnvironments() []EnvironmentSnapshot {
+	entries, err := os.ReadDir(snapshotsDir)
+	if err != nil {
+		return nil
+	}
+	type entry struct {
+		env  EnvironmentSnapshot
+		time time.Time
+	}
+	var found []entry
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") || !isEnvironmentFile(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(snapshotsDir, e.Name())
+		manifest, _ := readEnvironmentManifest(path)
+		found = append(found, entry{EnvironmentSnapshot{
+			Filename: e.Name(),
+			Size:     formatSize(info.Size()),
+			Date:     info.ModTime().Format("2006-01-02 15:04"),
+			Manifest: manifest,
+		}, info.ModTime()})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].time.After(found[j].time) })
+
+	envs := make([]EnvironmentSnapshot, len(found))
+	for i, f := range found {
+		envs[i] = f.env
+	}
+	return envs
+}
+
+// readEnvironmentManifest reads the manifest sidecar of an archive
+func readEnvironmentManifest(path string) (*EnvironmentManifest, error) {
+	data, err := os.ReadFile(metaPath(path))
+	if err != nil {
+		return nil, err
+	}
+	var manifest EnvironmentManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// componentPath names a hidden work file for one component, encrypted when
+// a snapshot key is configured
+func componentPath(stamp, name string) string {
+	if encryptionConfigured() {
+		name += extEncrypted
+	}
+	return filepath.Join(snapshotsDir, ".environment-"+stamp+"-"+name)
+}
+
+// writeComponent runs write into a new work file at path, encrypting it if
+// the path says so
+func writeComponent(path string, write func(w io.Writer) error) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = f
+	var enc *encryptWriter
+	if isEncryptedSnapshot(path) {
+		if enc, err = newEncryptWriter(f); err != nil {
+			f.Close()
+			return err
+		}
+		w = enc
+	}
+	err = write(w)
+	if enc != nil {
+		if cerr := enc.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// gitCommand runs git in repo as the user owning it, so that files it
+// checks out or writes in .git don't end up owned by root
+func gitCommand(ctx context.Context, repo string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-c", "safe.directory=*", "-C", repo}, args...)...)
+	if info, err := os.Stat(repo); err == nil && os.Getuid() == 0 {
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Uid != 0 {
+			cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: st.Uid, Gid: st.Gid}}
+		}
+	}
+	return cmd
+}
+
+// startEnvironmentJob captures an environment snapshot in the background
+func startEnvironmentJob(label, notes, createdBy string) (*Job, string) {
+	base := time.Now().Format("2006-01-02T1504")
+	if label != "" {
+		base += "_" + label
+	}
+	filename := uniqueSnapshotFilename(base, extEnvironment)
+	path := filepath.Join(snapshotsDir, filename)
+
+	job := jobs.start("environment", filename, func(ctx context.Context, job *Job) error {
+		return runEnvironmentSnapshot(ctx, job, path, label, notes, createdBy)
+	})
+	return job, filename
+}
+
+func runEnvironmentSnapshot(ctx context.Context, job *Job, path, label, notes, createdBy string) error {
+	stamp := time.Now().Format("20060102150405")
+	manifest := &EnvironmentManifest{
+		Version:   1,
+		Label:     label,
+		Notes:     notes,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now(),
+		Skipped:   make(map[string]string),
+	}
+	// archive name -> work file
+	files := make(map[string]string)
+	defer func() {
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}()
+
+	// Postgres, through the regular snapshot code so the dump gets the same
+	// metadata as any other snapshot
+	live := getEnv("POSTGRES_DB", "devdb")
+	opts := SnapshotOptions{Format: formatCustom, Compression: -1, Encrypt: encryptionConfigured()}
+	dumpPath := filepath.Join(snapshotsDir, ".environment-"+stamp+"-postgres"+snapshotExtension(opts))
+	job.logf("Dumping %s", live)
+	if err := runSnapshot(ctx, job, dumpPath, CreateSnapshotRequest{Label: label, Notes: notes, CreatedBy: createdBy, Options: opts}); err != nil {
+		return fmt.Errorf("postgres: %v", err)
+	}
+	name := envPostgres + strings.TrimPrefix(snapshotExtension(opts), extCustom)
+	files[name] = dumpPath
+	pgMeta, _ := readSnapshotMeta(dumpPath)
+	os.Remove(metaPath(dumpPath))
+	manifest.Postgres = &EnvironmentPostgres{File: name, Database: live, Meta: pgMeta}
+
+	// Valkey
+	valkeyPath := componentPath(stamp, envValkey)
+	job.logf("Dumping Valkey keys")
+	var keys int
+	var dbs []int
+	err := writeComponent(valkeyPath, func(w io.Writer) error {
+		var err error
+		keys, dbs, err = dumpValkey(w, job)
+		return err
+	})
+	if err != nil {
+		os.Remove(valkeyPath)
+		job.logf("Skipping Valkey: %v", err)
+		manifest.Skipped[componentValkey] = err.Error()
+	} else {
+		name := filepath.Base(valkeyPath)[len(".environment-"+stamp+"-"):]
+		files[name] = valkeyPath
+		manifest.Valkey = &EnvironmentValkey{File: name, Keys: keys, Databases: dbs}
+	}
+
+	// Workspace repository
+	if repo := workspaceRepo(); repo == "" {
+		manifest.Skipped[componentWorkspace] = "no git repository in /workspace"
+	} else if err := captureWorkspace(ctx, job, repo, stamp, manifest, files); err != nil {
+		job.logf("Skipping workspace: %v", err)
+		manifest.Skipped[componentWorkspace] = err.Error()
+	}
+
+	job.logf("Writing %s", filepath.Base(path))
+	if err := writeEnvironmentArchive(path, manifest, files); err != nil {
+		os.Remove(path)
+		return err
+	}
+	job.setBytes(snapshotSize(path))
+
+	data, _ := json.MarshalIndent(manifest, "", "  ")
+	if err := os.WriteFile(metaPath(path), data, 0644); err != nil {
+		log.Printf("Warning: Could not write environment manifest: %v", err)
+	}
+	invalidateCache()
+	return nil
+}
+
+// captureWorkspace records the checked out commit and the uncommitted
+// changes to tracked files
+func captureWorkspace(ctx context.Context, job *Job, repo, stamp string, manifest *EnvironmentManifest, files map[string]string) error {
+	commit := gitOutput(repo, "rev-parse", "HEAD")
+	if commit == "" {
+		return fmt.Errorf("%s has no commits", repo)
+	}
+	ws := &EnvironmentWorkspace{Repo: repo, Commit: commit}
+	if branch := gitOutput(repo, "rev-parse", "--abbrev-ref", "HEAD"); branch != "HEAD" {
+		ws.Branch = branch
+	}
+	if untracked := gitOutput(repo, "ls-files", "--others", "--exclude-standard"); untracked != "" {
+		ws.Untracked = strings.Split(untracked, "\n")
+		job.logf("Warning: %d untracked file(s) are not included", len(ws.Untracked))
+	}
+
+	diffPath := componentPath(stamp, envWorkspace)
+	var size int64
+	err := writeComponent(diffPath, func(w io.Writer) error {
+		cmd := gitCommand(ctx, repo, "diff", "HEAD", "--binary")
+		counter := &countingWriter{w: w}
+		cmd.Stdout = counter
+		var stderr strings.Builder
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("git diff: %v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		size = counter.n
+		return nil
+	})
+	if err != nil {
+		os.Remove(diffPath)
+		return err
+	}
+	if size > 0 {
+		ws.DiffFile = filepath.Base(diffPath)[len(".environment-"+stamp+"-"):]
+		files[ws.DiffFile] = diffPath
+		job.logf("Workspace at %.8s with uncommitted changes (%s)", commit, formatSize(size))
+	} else {
+		os.Remove(diffPath)
+		job.logf("Workspace at %.8s, clean", commit)
+	}
+	manifest.Workspace = ws
+	return nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeEnvironmentArchive writes the manifest and the component files to a
+// temp file and moves it to path once complete
+func writeEnvironmentArchive(path string, manifest *EnvironmentManifest, files map[string]string) error {
+	tmp, err := os.CreateTemp(snapshotsDir, ".environment-*.tar")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	tw := tar.NewWriter(tmp)
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := tw.WriteHeader(&tar.Header{Name: envManifest, Mode: 0644, Size: int64(len(data)), ModTime: now}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := addTarFile(tw, name, files[name]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0644)
+}
+
+func addTarFile(tw *tar.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// extractEnvironment unpacks the components of the archive at path into
+// hidden work files and returns the manifest and a map from archive names to
+// work files. Encrypted components stay encrypted.
+func extractEnvironment(path string) (*EnvironmentManifest, map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var manifest *EnvironmentManifest
+	files := make(map[string]string)
+	cleanup := func() {
+		for _, p := range files {
+			os.Remove(p)
+		}
+	}
+
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		if header.Name == envManifest {
+			manifest = &EnvironmentManifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				cleanup()
+				return nil, nil, fmt.Errorf("invalid manifest: %v", err)
+			}
+			continue
+		}
+		if header.Name != filepath.Base(header.Name) || strings.HasPrefix(header.Name, ".") {
+			cleanup()
+			return nil, nil, fmt.Errorf("unexpected file %q in archive", header.Name)
+		}
+		// Keep the extension: restoreCommand goes by it
+		out, err := os.CreateTemp(snapshotsDir, ".environment-restore-*-"+header.Name)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		files[header.Name] = out.Name()
+		_, err = io.Copy(out, tr)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+	}
+	if manifest == nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("%s has no manifest", filepath.Base(path))
+	}
+	return manifest, files, nil
+}
+
+// parseComponents reads a comma-separated component list; empty means all
+func parseComponents(s string) (map[string]bool, error) {
+	components := map[string]bool{componentPostgres: true, componentValkey: true, componentWorkspace: true}
+	if s == "" {
+		return components, nil
+	}
+	selected := make(map[string]bool)
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if !components[c] {
+			return nil, fmt.Errorf("unknown component %q (use postgres, valkey or workspace)", c)
+		}
+		selected[c] = true
+	}
+	return selected, nil
+}
+
+// startEnvironmentRestoreJob restores the selected components of an
+// environment snapshot in the background
+func startEnvironmentRestoreJob(filename, path string, components map[string]bool, safety bool) (*Job, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	if components[componentPostgres] && !databaseMu.TryLock() {
+		return nil, errDatabaseBusy
+	}
+
+	job := jobs.start("environment-restore", filename, func(ctx context.Context, job *Job) error {
+		if components[componentPostgres] {
+			defer databaseMu.Unlock()
+		}
+		return runEnvironmentRestore(ctx, job, filename, path, components, safety)
+	})
+	return job, nil
+}
+
+// runEnvironmentRestore puts back Postgres first, since it is the component
+// most likely to fail, then Valkey, then the workspace
+func runEnvironmentRestore(ctx context.Context, job *Job, filename, path string, components map[string]bool, safety bool) error {
+	job.logf("Unpacking %s", filename)
+	manifest, files, err := extractEnvironment(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}()
+	component := func(name string) (string, error) {
+		if p, ok := files[name]; ok {
+			return p, nil
+		}
+		return "", fmt.Errorf("%s is missing from the archive", name)
+	}
+
+	if components[componentPostgres] && manifest.Postgres != nil {
+		dump, err := component(manifest.Postgres.File)
+		if err != nil {
+			return err
+		}
+		if err := runRestore(ctx, job, filename, dump, safety); err != nil {
+			return fmt.Errorf("postgres: %v", err)
+		}
+	}
+
+	if components[componentValkey] && manifest.Valkey != nil {
+		keys, err := component(manifest.Valkey.File)
+		if err != nil {
+			return err
+		}
+		if err := runValkeyRestore(job, filename, keys, safety); err != nil {
+			return fmt.Errorf("valkey: %v", err)
+		}
+	}
+
+	if components[componentWorkspace] && manifest.Workspace != nil {
+		diff := ""
+		if manifest.Workspace.DiffFile != "" {
+			if diff, err = component(manifest.Workspace.DiffFile); err != nil {
+				return err
+			}
+		}
+		if err := restoreWorkspace(ctx, job, filename, manifest.Workspace, diff); err != nil {
+			return fmt.Errorf("workspace: %v", err)
+		}
+	}
+
+	for name, reason := range manifest.Skipped {
+		job.logf("Note: %s was not captured in this snapshot (%s)", name, reason)
+	}
+	job.logf("Environment restored")
+	return nil
+}
+
+// runValkeyRestore checks the whole dump at path before flushing Valkey.
+// With safety, the current keys are saved first as an environment snapshot
+// of their own (so the restore can be undone with components=valkey) and
+// are put back if loading the dump fails.
+func runValkeyRestore(job *Job, filename, path string, safety bool) error {
+	job.logf("Checking the Valkey key dump")
+	keys, err := readComponent(path, checkValkeyDump)
+	if err != nil {
+		return err
+	}
+
+	var undo string
+	if safety {
+		if undo, err = saveValkeyBeforeRestore(job, filename); err != nil {
+			return fmt.Errorf("pre-restore dump failed: %v", err)
+		}
+		defer os.Remove(undo)
+	}
+
+	job.logf("Restoring %d Valkey keys", keys)
+	_, err = readComponent(path, func(r io.Reader) (int, error) { return restoreValkey(r, job) })
+	if err != nil && undo != "" {
+		job.logf("Restore failed, putting back the previous keys: %v", err)
+		if _, uerr := readComponent(undo, func(r io.Reader) (int, error) { return restoreValkey(r, job) }); uerr != nil {
+			job.logf("Could not put back the previous keys: %v", uerr)
+		}
+	}
+	return err
+}
+
+// readComponent runs read on the decrypted contents of a component file
+func readComponent(path string, read func(r io.Reader) (int, error)) (int, error) {
+	r, err := openSnapshotFile(path)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return read(r)
+}
+
+// saveValkeyBeforeRestore dumps the current keys into a pre-restore
+// environment snapshot holding only Valkey. It returns the dump's work
+// file, which the caller removes.
+func saveValkeyBeforeRestore(job *Job, filename string) (string, error) {
+	stamp := time.Now().Format("20060102150405")
+	work := componentPath(stamp+"-pre-restore", envValkey)
+	var keys int
+	var dbs []int
+	err := writeComponent(work, func(w io.Writer) error {
+		var err error
+		keys, dbs, err = dumpValkey(w, job)
+		return err
+	})
+	if err != nil {
+		os.Remove(work)
+		return "", err
+	}
+
+	name := filepath.Base(work)[len(".environment-"+stamp+"-pre-restore-"):]
+	manifest := &EnvironmentManifest{
+		Version:   1,
+		Kind:      kindPreRestore,
+		Label:     kindPreRestore,
+		Notes:     fmt.Sprintf("Automatic Valkey dump taken before restoring %s", filename),
+		CreatedAt: time.Now(),
+		Valkey:    &EnvironmentValkey{File: name, Keys: keys, Databases: dbs},
+		Skipped: map[string]string{
+			componentPostgres:  "pre-restore snapshot of Valkey only",
+			componentWorkspace: "pre-restore snapshot of Valkey only",
+		},
+	}
+	archive := uniqueSnapshotFilename(time.Now().Format("2006-01-02T1504")+"_"+kindPreRestore, extEnvironment)
+	path := filepath.Join(snapshotsDir, archive)
+	if err := writeEnvironmentArchive(path, manifest, map[string]string{name: work}); err != nil {
+		os.Remove(path)
+		os.Remove(work)
+		return "", err
+	}
+	job.logf("Saved %d Valkey keys to %s", keys, archive)
+	data, _ := json.MarshalIndent(manifest, "", "  ")
+	if err := os.WriteFile(metaPath(path), data, 0644); err != nil {
+		log.Printf("Warning: Could not write environment manifest: %v", err)
+	}
+	prunePreRestoreEnvironments(job)
+	invalidateCache()
+	return work, nil
+}
+
+// prunePreRestoreEnvironments keeps the newest PRE_RESTORE_KEEP pre-restore
+// Valkey archives, as prunePreRestoreSnapshots does for database snapshots
+func prunePreRestoreEnvironments(job *Job) {
+	var archives []string
+	for _, env := range listEnvironments() {
+		if env.Manifest != nil && env.Manifest.Kind == kindPreRestore {
+			archives = append(archives, env.Filename)
+		}
+	}
+	keep := preRestoreKeep()
+	if len(archives) <= keep {
+		return
+	}
+	for _, name := range archives[keep:] {
+		job.logf("Pruning old pre-restore archive %s", name)
+		path := filepath.Join(snapshotsDir, name)
+		if err := os.Remove(path); err != nil {
+			log.Printf("Warning: Could not prune %s: %v", path, err)
+			continue
+		}
+		os.Remove(metaPath(path))
+	}
+}
+
+// restoreWorkspace checks out the recorded commit and re-applies the
+// uncommitted changes. Local changes are stashed first, never discarded.
+func restoreWorkspace(ctx context.Context, job *Job, filename string, ws *EnvironmentWorkspace, diffPath string) error {
+	repo := workspaceRepo()
+	if repo == "" {
+		return fmt.Errorf("no git repository in /workspace")
+	}
+	run := func(stdin io.Reader, args ...string) error {
+		cmd := gitCommand(ctx, repo, args...)
+		cmd.Stdin = stdin
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+
+	if err := run(nil, "cat-file", "-e", ws.Commit+"^{commit}"); err != nil {
+		return fmt.Errorf("commit %.8s is not in %s; fetch it first", ws.Commit, repo)
+	}
+
+	if gitOutput(repo, "status", "--porcelain") != "" {
+		job.logf("Stashing local changes in %s", repo)
+		if err := run(nil, "stash", "push", "--include-untracked", "-m", "devbox: before restoring "+filename); err != nil {
+			return err
+		}
+	}
+
+	switch head := gitOutput(repo, "rev-parse", "--verify", "--quiet", "refs/heads/"+ws.Branch); {
+	case ws.Branch == "":
+		job.logf("Checking out %.8s (detached)", ws.Commit)
+		if err := run(nil, "checkout", "--detach", ws.Commit); err != nil {
+			return err
+		}
+	case head == ws.Commit:
+		job.logf("Checking out %s", ws.Branch)
+		if err := run(nil, "checkout", ws.Branch); err != nil {
+			return err
+		}
+	case head == "":
+		job.logf("Creating branch %s at %.8s", ws.Branch, ws.Commit)
+		if err := run(nil, "checkout", "-b", ws.Branch, ws.Commit); err != nil {
+			return err
+		}
+	default:
+		// Moving the branch back could lose commits, so leave it alone
+		job.logf("Branch %s has moved on since the snapshot; checking out %.8s detached", ws.Branch, ws.Commit)
+		if err := run(nil, "checkout", "--detach", ws.Commit); err != nil {
+			return err
+		}
+	}
+
+	if diffPath != "" {
+		job.logf("Applying uncommitted changes")
+		r, err := openSnapshotFile(diffPath)
+		if err != nil {
+			return err
+		}
+		err = run(r, "apply", "--binary", "--whitespace=nowarn", "-")
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if len(ws.Untracked) > 0 {
+		job.logf("Note: %d untracked file(s) were not captured and are not restored", len(ws.Untracked))
+	}
+	return nil
+}
+
+func handleEnvironments(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"environments": listEnvironments(),
+	})
+}
+
+func handleCreateEnvironment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if adminDB == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "no connection to the database",
+		})
+		return
+	}
+	if err := validateLabel(r.URL.Query().Get("label")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, filename := startEnvironmentJob(r.URL.Query().Get("label"), r.URL.Query().Get("notes"), r.URL.Query().Get("created_by"))
+
+	// Scripts can pass wait=1 to block until the snapshot has been written
+	if r.URL.Query().Get("wait") != "" {
+		info := job.Wait()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  info.Status == jobSucceeded,
+			"error":    info.Error,
+			"job_id":   info.ID,
+			"filename": filename,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"job_id":   job.Info().ID,
+		"filename": filename,
+	})
+}
+
+// handleRestoreEnvironment restores an environment snapshot. components
+// limits the restore to some of postgres, valkey and workspace; safety=false
+// skips the pre-restore snapshot of the database.
+func handleRestoreEnvironment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filename := r.URL.Query().Get("filename")
+	path, err := resolveEnvironmentPath(filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	components, err := parseComponents(r.URL.Query().Get("components"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, err := startEnvironmentRestoreJob(filename, path, components, r.URL.Query().Get("safety") != "false")
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	// Scripts can pass wait=1 to block until the restore has finished
+	if r.URL.Query().Get("wait") != "" {
+		info := job.Wait()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": info.Status == jobSucceeded,
+			"error":   info.Error,
+			"job_id":  info.ID,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"job_id":  job.Info().ID,
+	})
+}
+
+func handleDeleteEnvironment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path, err := resolveEnvironmentPath(r.URL.Query().Get("filename"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	os.Remove(metaPath(path))
+	invalidateCache()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+	})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PlanNode is a node of an EXPLAIN (ANALYZE, BUFFERS, FORMAT JSON) plan.
+// Times are per loop, as PostgreSQL reports them; the computed fields at the
+// end account for loops.
+type PlanNode struct {
+	NodeType            string      `json:"Node Type"`
+	RelationName        string      `json:"Relation Name,omitempty"`
+	Alias               string      `json:"Alias,omitempty"`
+	IndexName           string      `json:"Index Name,omitempty"`
+	JoinType            string      `json:"Join Type,omitempty"`
+	Strategy            string      `json:"Strategy,omitempty"`
+	StartupCost         float64     `json:"Startup Cost"`
+	TotalCost           float64     `json:"Total Cost"`
+	PlanRows            float64     `json:"Plan Rows"`
+	ActualStartupTime   float64     `json:"Actual Startup Time"`
+	ActualTotalTime     float64     `json:"Actual Total Time"`
+	ActualRows          float64     `json:"Actual Rows"`
+	ActualLoops         float64     `json:"Actual Loops"`
+	SharedHitBlocks     int64       `json:"Shared Hit Blocks"`
+	SharedReadBlocks    int64       `json:"Shared Read Blocks"`
+	Filter              string      `json:"Filter,omitempty"`
+	RowsRemovedByFilter float64     `json:"Rows Removed by Filter,omitempty"`
+	IndexCond           string      `json:"Index Cond,omitempty"`
+	HashCond            string      `json:"Hash Cond,omitempty"`
+	JoinFilter          string      `json:"Join Filter,omitempty"`
+	SortKey             []string    `json:"Sort Key,omitempty"`
+	SortMethod          string      `json:"Sort Method,omitempty"`
+	SortSpaceType       string      `json:"Sort Space Type,omitempty"`
+	Plans               []*PlanNode `json:"Plans,omitempty"`
+
+	// SelfMs is the time spent in this node excluding its children, over
+	// all loops
+	SelfMs   float64
+	Percent  float64  // SelfMs as a share of the execution time
+	Hot      bool     // among the costliest nodes
+	Warnings []string `json:",omitempty"`
+}
+
+// ExplainResult is what /api/explain returns. Raw is PostgreSQL's own JSON
+// output, for pasting into other plan visualizers.
+type ExplainResult struct {
+	Statement   string
+	Plan        *PlanNode
+	PlanningMs  float64
+	ExecutionMs float64
+	Warnings    []string
+	Raw         json.RawMessage
+}
+
+// explainTimeout bounds the statement being explained (EXPLAIN_TIMEOUT,
+// seconds, default 60), since ANALYZE runs it for real
+func explainTimeout() time.Duration {
+	seconds := parseInt(getEnv("EXPLAIN_TIMEOUT", "60"))
+	if seconds <= 0 {
+		seconds = 60
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// explainStatement runs EXPLAIN (ANALYZE, BUFFERS, FORMAT JSON) for sql in a
+// transaction that is always rolled back, so INSERT, UPDATE, DELETE and DDL
+// leave no trace. The statement is prepared, which makes PostgreSQL reject
+// anything but a single statement, so it cannot COMMIT its way out.
+func explainStatement(ctx context.Context, sql string) (*ExplainResult, error) {
+	if db == nil {
+		return nil, fmt.Errorf("no connection to the database")
+	}
+	sql = strings.TrimRight(strings.TrimSpace(sql), "; \t\r\n")
+	if sql == "" {
+		return nil, fmt.Errorf("no statement to explain")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, explainTimeout()+5*time.Second)
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL statement_timeout = %d", explainTimeout().Milliseconds())); err != nil {
+		return nil, err
+	}
+	stmt, err := tx.PrepareContext(ctx, "EXPLAIN (ANALYZE, BUFFERS, FORMAT JSON) "+sql)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	var raw []byte
+	if err := stmt.QueryRowContext(ctx).Scan(&raw); err != nil {
+		return nil, err
+	}
+	stmt.Close()
+	if err := tx.Rollback(); err != nil {
+		return nil, err
+	}
+
+	var plans []struct {
+		Plan          *PlanNode `json:"Plan"`
+		PlanningTime  float64   `json:"Planning Time"`
+		ExecutionTime float64   `json:"Execution Time"`
+	}
+	if err := json.Unmarshal(raw, &plans); err != nil || len(plans) == 0 || plans[0].Plan == nil {
+		return nil, fmt.Errorf("could not parse the plan: %v", err)
+	}
+	result := &ExplainResult{
+		Statement:   sql,
+		Plan:        plans[0].Plan,
+		PlanningMs:  plans[0].PlanningTime,
+		ExecutionMs: plans[0].ExecutionTime,
+		Warnings:    []string{},
+		Raw:         raw,
+	}
+	analyzePlan(ctx, result)
+	return result, nil
+}
+
+// analyzePlan fills in the computed fields of every node, marks the
+// costliest ones and collects warnings
+func analyzePlan(ctx context.Context, result *ExplainResult) {
+	var nodes []*PlanNode
+	var walk func(n *PlanNode)
+	walk = func(n *PlanNode) {
+		nodes = append(nodes, n)
+		loops := max(n.ActualLoops, 1)
+		n.SelfMs = n.ActualTotalTime * loops
+		for _, child := range n.Plans {
+			n.SelfMs -= child.ActualTotalTime * max(child.ActualLoops, 1)
+			walk(child)
+		}
+		// Parallel workers and CTEs can make children add up to more than
+		// their parent
+		n.SelfMs = max(n.SelfMs, 0)
+		if result.ExecutionMs > 0 {
+			n.Percent = 100 * n.SelfMs / result.ExecutionMs
+		}
+	}
+	walk(result.Plan)
+
+	// The costliest nodes are the slowest few that take a real share of the
+	// time, so a fast query doesn't light up everywhere
+	ranked := append([]*PlanNode(nil), nodes...)
+	sort.Slice(ranked, func(i, j int) bool { return ranked[i].SelfMs > ranked[j].SelfMs })
+	for i, n := range ranked {
+		if i >= 3 || n.Percent < 10 {
+			break
+		}
+		n.Hot = true
+	}
+
+	threshold := float64(parseInt(getEnv("EXPLAIN_SEQSCAN_ROWS", "10000")))
+	estimates := make(map[string]float64)
+	for _, n := range nodes {
+		if n.NodeType != "Seq Scan" || n.RelationName == "" {
+			continue
+		}
+		rows, ok := estimates[n.RelationName]
+		if !ok {
+			rows = tableRowEstimate(ctx, n.RelationName)
+			estimates[n.RelationName] = rows
+		}
+		loops := max(n.ActualLoops, 1)
+		scanned := (n.ActualRows + n.RowsRemovedByFilter) * loops
+		if max(rows, scanned/loops) < threshold {
+			continue
+		}
+		warning := fmt.Sprintf("Seq Scan on %s (~%.0f rows)", n.RelationName, max(rows, scanned/loops))
+		switch {
+		case n.Filter != "" && n.RowsRemovedByFilter > n.ActualRows:
+			warning += fmt.Sprintf(" keeps %.0f of the %.0f rows it reads; an index for %s may help",
+				n.ActualRows, n.RowsRemovedByFilter+n.ActualRows, n.Filter)
+		case loops > 1:
+			warning += fmt.Sprintf(" runs %.0f times; an index on the join column may help", loops)
+		default:
+			warning += " reads the whole table"
+		}
+		n.Warnings = append(n.Warnings, warning)
+		result.Warnings = append(result.Warnings, warning)
+	}
+}
+
+// tableRowEstimate returns pg_class.reltuples for the largest table named
+// name in any schema, or 0 if unknown. The plan only gives the schema with
+// VERBOSE, so a name that exists in several schemas errs on the large side.
+func tableRowEstimate(ctx context.Context, name string) float64 {
+	if db == nil {
+		return 0
+	}
+	var rows *float64
+	db.QueryRowContext(ctx, `
+		SELECT max(reltuples)::float8 FROM pg_class
+		WHERE relname = $1 AND relkind IN ('r', 'm', 'p')
+	`, name).Scan(&rows)
+	if rows == nil {
+		return 0
+	}
+	return *rows
+}
+
+// handleExplain explains the statement in the sql form field (or query
+// parameter). The statement really runs, inside a transaction that is
+// rolled back.
+func handleExplain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, err := explainStatement(r.Context(), r.FormValue("sql"))
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"result":  result,
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAnalyzePlan(t *testing.T) {
+	tests := []struct {
+		name      string
+		plan      string
+		execution float64
+		self      []float64 // SelfMs of the nodes, depth first
+		hot       []bool
+		warnings  []string // substrings, one per expected warning
+	}{
+		{
+			name: "self time excludes children",
+			plan: `{"Node Type": "Hash Join", "Actual Total Time": 10, "Actual Loops": 1, "Plans": [
+				{"Node Type": "Seq Scan", "Relation Name": "orders", "Actual Total Time": 6, "Actual Rows": 100, "Actual Loops": 1},
+				{"Node Type": "Hash", "Actual Total Time": 3, "Actual Loops": 1, "Plans": [
+					{"Node Type": "Index Scan", "Relation Name": "users", "Actual Total Time": 2.5, "Actual Loops": 1}
+				]}
+			]}`,
+			execution: 10,
+			self:      []float64{1, 6, 0.5, 2.5},
+			hot:       []bool{true, true, false, true},
+		},
+		{
+			name: "loops multiply per-loop times",
+			plan: `{"Node Type": "Nested Loop", "Actual Total Time": 50, "Actual Loops": 1, "Plans": [
+				{"Node Type": "Seq Scan", "Relation Name": "users", "Actual Total Time": 1, "Actual Rows": 10, "Actual Loops": 1},
+				{"Node Type": "Index Scan", "Relation Name": "orders", "Actual Total Time": 0.4, "Actual Rows": 5, "Actual Loops": 100}
+			]}`,
+			execution: 50,
+			self:      []float64{9, 1, 40},
+			hot:       []bool{true, false, true},
+		},
+		{
+			name: "parallel children never make a parent negative",
+			plan: `{"Node Type": "Gather", "Actual Total Time": 5, "Actual Loops": 1, "Plans": [
+				{"Node Type": "Seq Scan", "Relation Name": "events", "Actual Total Time": 4, "Actual Rows": 10, "Actual Loops": 3}
+			]}`,
+			execution: 5,
+			self:      []float64{0, 12},
+			hot:       []bool{false, true},
+		},
+		{
+			name: "only the three slowest are hot",
+			plan: `{"Node Type": "Append", "Actual Total Time": 100, "Actual Loops": 1, "Plans": [
+				{"Node Type": "Index Scan", "Actual Total Time": 25, "Actual Loops": 1},
+				{"Node Type": "Index Scan", "Actual Total Time": 24, "Actual Loops": 1},
+				{"Node Type": "Index Scan", "Actual Total Time": 23, "Actual Loops": 1},
+				{"Node Type": "Index Scan", "Actual Total Time": 22, "Actual Loops": 1}
+			]}`,
+			execution: 100,
+			self:      []float64{6, 25, 24, 23, 22},
+			hot:       []bool{false, true, true, true, false},
+		},
+		{
+			name: "filtered seq scan",
+			plan: `{"Node Type": "Seq Scan", "Relation Name": "orders", "Actual Total Time": 80, "Actual Rows": 12, "Actual Loops": 1,
+				"Filter": "(status = 'open'::text)", "Rows Removed by Filter": 49988}`,
+			execution: 80,
+			self:      []float64{80},
+			hot:       []bool{true},
+			warnings:  []string{"Seq Scan on orders (~50000 rows) keeps 12 of the 50000 rows it reads; an index for (status = 'open'::text) may help"},
+		},
+		{
+			name: "repeated seq scan",
+			plan: `{"Node Type": "Nested Loop", "Actual Total Time": 90, "Actual Loops": 1, "Plans": [
+				{"Node Type": "Seq Scan", "Relation Name": "users", "Actual Total Time": 0.1, "Actual Rows": 20, "Actual Loops": 1},
+				{"Node Type": "Seq Scan", "Relation Name": "orders", "Actual Total Time": 4, "Actual Rows": 15000, "Actual Loops": 20}
+			]}`,
+			execution: 90,
+			self:      []float64{9.9, 0.1, 80},
+			hot:       []bool{true, false, true},
+			warnings:  []string{"Seq Scan on orders (~15000 rows) runs 20 times"},
+		},
+		{
+			name:      "whole table",
+			plan:      `{"Node Type": "Seq Scan", "Relation Name": "events", "Actual Total Time": 30, "Actual Rows": 20000, "Actual Loops": 1}`,
+			execution: 30,
+			self:      []float64{30},
+			hot:       []bool{true},
+			warnings:  []string{"Seq Scan on events (~20000 rows) reads the whole table"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var plan PlanNode
+			if err := json.Unmarshal([]byte(tt.plan), &plan); err != nil {
+				t.Fatal(err)
+			}
+			result := &ExplainResult{Plan: &plan, ExecutionMs: tt.execution, Warnings: []string{}}
+			analyzePlan(context.Background(), result)
+
+			var nodes []*PlanNode
+			var walk func(n *PlanNode)
+			walk = func(n *PlanNode) {
+				nodes = append(nodes, n)
+				for _, c := range n.Plans {
+					walk(c)
+				}
+			}
+			walk(result.Plan)
+
+			var self []float64
+			var hot []bool
+			for _, n := range nodes {
+				self = append(self, math.Round(n.SelfMs*1000)/1000)
+				hot = append(hot, n.Hot)
+			}
+			if !reflect.DeepEqual(self, tt.self) {
+				t.Errorf("SelfMs = %v, want %v", self, tt.self)
+			}
+			if !reflect.DeepEqual(hot, tt.hot) {
+				t.Errorf("Hot = %v, want %v", hot, tt.hot)
+			}
+			if len(result.Warnings) != len(tt.warnings) {
+				t.Fatalf("Warnings = %q, want %d", result.Warnings, len(tt.warnings))
+			}
+			for i, w := range tt.warnings {
+				if !strings.Contains(result.Warnings[i], w) {
+					t.Errorf("warning %q does not contain %q", result.Warnings[i], w)
+				}
+			}
+		})
+	}
+}
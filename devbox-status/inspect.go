@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// SnapshotContents describes what a snapshot holds, read from the file
+// without restoring it
+type SnapshotContents struct {
+	Filename   string          `json:"filename"`
+	Format     string          `json:"format"`
+	Schemas    []string        `json:"schemas"`
+	Extensions []string        `json:"extensions"`
+	Tables     []SnapshotTable `json:"tables"`
+	DDL        string          `json:"ddl,omitempty"`
+}
+
+// SnapshotTable is a table in a snapshot. Rows counts the lines of its COPY
+// block (or INSERT statements for --inserts dumps), so it is approximate.
+type SnapshotTable struct {
+	Schema  string `json:"schema"`
+	Name    string `json:"name"`
+	Rows    int64  `json:"rows"`
+	HasData bool   `json:"has_data"`
+}
+
+func (t SnapshotTable) qualified() string {
+	return t.Schema + "." + t.Name
+}
+
+// tocEntry is an object in a dump: a "-- Name: ...; Type: ...; Schema: ..."
+// header in a SQL script, or a line of pg_restore -l output
+type tocEntry struct {
+	Name, Type, Schema string
+}
+
+// dumpParser reads a plain SQL dump (or pg_restore's script output) line by
+// line, collecting the objects it defines and counting COPY rows. If
+// ddlTable is set, the statements belonging to that table are collected.
+type dumpParser struct {
+	schemas    map[string]bool
+	extensions map[string]bool
+	tables     map[string]*SnapshotTable
+
+	ddlTable  *SnapshotTable
+	ddl       strings.Builder
+	capturing bool
+	indexOnly bool
+	separate  bool
+
+	entry  tocEntry
+	inCopy *SnapshotTable
+}
+
+func newDumpParser(ddlTable *SnapshotTable) *dumpParser {
+	return &dumpParser{
+		schemas:    make(map[string]bool),
+		extensions: make(map[string]bool),
+		tables:     make(map[string]*SnapshotTable),
+		ddlTable:   ddlTable,
+	}
+}
+
+var copyStatementRe = regexp.MustCompile(`^COPY ([^ (]+)`)
+
+func (p *dumpParser) table(schema, name string) *SnapshotTable {
+	key := schema + "." + name
+	t, ok := p.tables[key]
+	if !ok {
+		t = &SnapshotTable{Schema: schema, Name: name}
+		p.tables[key] = t
+	}
+	return t
+}
+
+// parse reads r to the end
+func (p *dumpParser) parse(r io.Reader) error {
+	br := bufio.NewReaderSize(r, 64<<10)
+	var line []byte
+	for {
+		// Only the first 64KB of a line is kept; data rows can be far longer
+		chunk, isPrefix, err := br.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if line == nil {
+			line = append(line[:0], chunk...)
+		}
+		if isPrefix {
+			continue
+		}
+		p.line(string(line))
+		line = nil
+	}
+}
+
+func (p *dumpParser) line(line string) {
+	if p.inCopy != nil {
+		if line == `\.` {
+			p.inCopy = nil
+		} else {
+			p.inCopy.Rows++
+		}
+		return
+	}
+
+	if entry, ok := parseTOCHeader(line); ok {
+		p.entry = entry
+		p.add(entry)
+		p.capturing, p.indexOnly = p.belongsToDDLTable(entry)
+		p.separate = p.ddl.Len() > 0
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(line, "COPY ") && isCopyFromStdin([]byte(line)):
+		if p.entry.Type == "TABLE DATA" {
+			p.inCopy = p.table(p.entry.Schema, p.entry.Name)
+		} else if m := copyStatementRe.FindStringSubmatch(line); m != nil {
+			schema, name := splitQualifiedName(m[1])
+			p.inCopy = p.table(schema, name)
+		}
+		if p.inCopy != nil {
+			p.inCopy.HasData = true
+		}
+		return
+	case strings.HasPrefix(line, "INSERT INTO ") && p.entry.Type == "TABLE DATA":
+		t := p.table(p.entry.Schema, p.entry.Name)
+		t.HasData = true
+		t.Rows++
+		return
+	}
+
+	if !p.capturing || line == "" || strings.HasPrefix(line, "--") || strings.HasPrefix(line, "SET ") {
+		return
+	}
+	if p.indexOnly && !p.referencesDDLTable(line) {
+		return
+	}
+	// Objects are separated by a blank line
+	if p.separate {
+		p.ddl.WriteString("\n")
+		p.separate = false
+	}
+	p.ddl.WriteString(line)
+	p.ddl.WriteString("\n")
+}
+
+// add records the schemas, extensions and tables defined by entry
+func (p *dumpParser) add(e tocEntry) {
+	if e.Schema != "" && e.Schema != "-" {
+		p.schemas[e.Schema] = true
+	}
+	switch e.Type {
+	case "SCHEMA":
+		p.schemas[e.Name] = true
+	case "EXTENSION":
+		p.extensions[e.Name] = true
+	case "TABLE", "TABLE DATA":
+		p.table(e.Schema, e.Name)
+	}
+}
+
+// belongsToDDLTable reports whether entry is part of the chosen table's DDL.
+// pg_dump names constraints, defaults, triggers and policies
+// "<table> <object>"; indexes have to be matched on their statement.
+func (p *dumpParser) belongsToDDLTable(e tocEntry) (capture, indexOnly bool) {
+	t := p.ddlTable
+	if t == nil || e.Schema != t.Schema {
+		return false, false
+	}
+	switch e.Type {
+	case "TABLE DATA", "SEQUENCE SET":
+		return false, false
+	case "INDEX":
+		return true, true
+	}
+	return e.Name == t.Name || strings.HasPrefix(e.Name, t.Name+" ") ||
+		e.Name == "TABLE "+t.Name || strings.HasPrefix(e.Name, "COLUMN "+t.Name+"."), false
+}
+
+func (p *dumpParser) referencesDDLTable(line string) bool {
+	t := p.ddlTable
+	for _, name := range []string{
+		dumpIdentifier(t.Schema) + "." + dumpIdentifier(t.Name),
+		pq.QuoteIdentifier(t.Schema) + "." + pq.QuoteIdentifier(t.Name),
+	} {
+		if strings.Contains(line, " ON "+name+" ") || strings.Contains(line, " ON ONLY "+name+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+var plainIdentifierRe = regexp.MustCompile(`^[a-z_][a-z0-9_$]*$`)
+
+// dumpIdentifier quotes name the way pg_dump does: only when it has to
+func dumpIdentifier(name string) string {
+	if plainIdentifierRe.MatchString(name) {
+		return name
+	}
+	return pq.QuoteIdentifier(name)
+}
+
+// contents returns what the parser found, sorted by name
+func (p *dumpParser) contents() *SnapshotContents {
+	c := &SnapshotContents{
+		Schemas:    sortedKeys(p.schemas),
+		Extensions: sortedKeys(p.extensions),
+		Tables:     []SnapshotTable{},
+		DDL:        strings.TrimSpace(p.ddl.String()),
+	}
+	for _, t := range p.tables {
+		c.Tables = append(c.Tables, *t)
+	}
+	sort.Slice(c.Tables, func(i, j int) bool {
+		return c.Tables[i].qualified() < c.Tables[j].qualified()
+	})
+	return c
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// parseTOCHeader parses pg_dump's object headers:
+//
+//	-- Name: users; Type: TABLE; Schema: public; Owner: postgres
+//	-- Data for Name: users; Type: TABLE DATA; Schema: public; Owner: postgres
+func parseTOCHeader(line string) (tocEntry, bool) {
+	var rest string
+	switch {
+	case strings.HasPrefix(line, "-- Name: "):
+		rest = strings.TrimPrefix(line, "-- ")
+	case strings.HasPrefix(line, "-- Data for Name: "):
+		rest = strings.TrimPrefix(line, "-- Data for ")
+	default:
+		return tocEntry{}, false
+	}
+
+	var e tocEntry
+	for _, field := range strings.Split(rest, "; ") {
+		key, value, _ := strings.Cut(field, ": ")
+		switch key {
+		case "Name":
+			e.Name = value
+		case "Type":
+			e.Type = value
+		case "Schema":
+			e.Schema = value
+		}
+	}
+	return e, e.Type != ""
+}
+
+// splitQualifiedName splits schema.table as written in SQL, removing quotes.
+// Unqualified names are in public.
+func splitQualifiedName(name string) (string, string) {
+	var parts []string
+	var cur strings.Builder
+	quoted := false
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '"' && quoted && i+1 < len(name) && name[i+1] == '"':
+			cur.WriteByte('"')
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == '.' && !quoted:
+			parts = append(parts, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	parts = append(parts, cur.String())
+	if len(parts) == 1 {
+		return "public", parts[0]
+	}
+	return parts[0], parts[1]
+}
+
+// tocDescriptions are the pg_restore -l object types that contain spaces
+var tocDescriptions = []string{
+	"MATERIALIZED VIEW DATA", "SEQUENCE OWNED BY", "TEXT SEARCH CONFIGURATION",
+	"TEXT SEARCH DICTIONARY", "TEXT SEARCH PARSER", "TEXT SEARCH TEMPLATE",
+	"FOREIGN DATA WRAPPER", "DATABASE PROPERTIES", "PUBLICATION TABLE",
+	"PUBLICATION TABLES IN SCHEMA", "MATERIALIZED VIEW", "CHECK CONSTRAINT",
+	"FK CONSTRAINT", "DEFAULT ACL", "EVENT TRIGGER", "FOREIGN TABLE",
+	"FOREIGN SERVER", "INDEX ATTACH", "LARGE OBJECT", "ROW SECURITY",
+	"SEQUENCE SET", "SHELL TYPE", "TABLE ATTACH", "TABLE DATA", "USER MAPPING",
+}
+
+var tocListRe = regexp.MustCompile(`^\d+; \d+ \d+ (.+)$`)
+
+// parseTOCList parses a pg_restore -l line such as
+//
+//	218; 1259 16386 TABLE public users postgres
+func parseTOCList(line string) (tocEntry, bool) {
+	m := tocListRe.FindStringSubmatch(line)
+	if m == nil {
+		return tocEntry{}, false
+	}
+	rest := m[1]
+
+	var e tocEntry
+	for _, desc := range tocDescriptions {
+		if strings.HasPrefix(rest, desc+" ") {
+			e.Type = desc
+			break
+		}
+	}
+	if e.Type == "" {
+		e.Type, _, _ = strings.Cut(rest, " ")
+	}
+	fields := strings.Fields(strings.TrimPrefix(rest, e.Type))
+	if len(fields) < 2 {
+		return tocEntry{}, false
+	}
+	e.Schema = fields[0]
+	// The owner comes last but is omitted for some objects (e.g. extensions)
+	if len(fields) > 2 {
+		e.Name = strings.Join(fields[1:len(fields)-1], " ")
+	} else {
+		e.Name = fields[1]
+	}
+	return e, true
+}
+
+// isCompressedPlain reports whether the snapshot at path is a gzipped SQL dump
+func isCompressedPlain(path string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(path, extEncrypted), extPlainCompressed)
+}
+
+// openPlainDump opens a .sql or .sql.gz snapshot, encrypted or not, for
+// reading as SQL
+func openPlainDump(path string) (io.ReadCloser, error) {
+	f, err := openSnapshotFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !isCompressedPlain(path) {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, f}, nil
+}
+
+// archiveTOC returns pg_restore's table of contents listing for the archive
+// at path
+func archiveTOC(ctx context.Context, path string) ([]byte, error) {
+	cmd, closer, err := pgRestoreCommand(ctx, path, "-l")
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("pg_restore -l failed: %v", err)
+	}
+	return output, nil
+}
+
+// parsePgRestoreScript feeds pg_restore's SQL output for an archive to p
+func parsePgRestoreScript(ctx context.Context, p *dumpParser, path string, args ...string) error {
+	cmd, closer, err := pgRestoreCommand(ctx, path, append([]string{"-f", "-"}, args...)...)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	parseErr := p.parse(stdout)
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("pg_restore: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return parseErr
+}
+
+// inspectSnapshot reads the contents of the snapshot at path. With ddlTable
+// set, its DDL is extracted too.
+func inspectSnapshot(ctx context.Context, path string, ddlTable *SnapshotTable) (*SnapshotContents, error) {
+	p := newDumpParser(ddlTable)
+
+	if snapshotFormat(path) == formatPlain {
+		r, err := openPlainDump(path)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		if err := p.parse(r); err != nil {
+			return nil, err
+		}
+	} else {
+		// The table of contents lists the objects; row counts need the data
+		output, err := archiveTOC(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			if e, ok := parseTOCList(line); ok {
+				p.add(e)
+			}
+		}
+		if err := parsePgRestoreScript(ctx, p, path, "--data-only"); err != nil {
+			return nil, err
+		}
+		if ddlTable != nil {
+			if err := parsePgRestoreScript(ctx, p, path, "--schema-only"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	c := p.contents()
+	c.Filename = filepath.Base(path)
+	c.Format = snapshotFormat(path)
+	return c, nil
+}
+
+// contentsCache remembers inspections so that searching every snapshot for a
+// table only reads each file once. Entries are keyed by path and invalidated
+// when the file's size or mtime changes.
+var contentsCache = struct {
+	sync.Mutex
+	entries map[string]cachedContents
+}{entries: make(map[string]cachedContents)}
+
+type cachedContents struct {
+	size     int64
+	modTime  time.Time
+	contents *SnapshotContents
+}
+
+func cachedInspectSnapshot(ctx context.Context, path string) (*SnapshotContents, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	size := snapshotSize(path)
+
+	contentsCache.Lock()
+	cached, ok := contentsCache.entries[path]
+	contentsCache.Unlock()
+	if ok && cached.size == size && cached.modTime.Equal(info.ModTime()) {
+		return cached.contents, nil
+	}
+
+	contents, err := inspectSnapshot(ctx, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	contentsCache.Lock()
+	contentsCache.entries[path] = cachedContents{size: size, modTime: info.ModTime(), contents: contents}
+	contentsCache.Unlock()
+	return contents, nil
+}
+
+// handleInspectSnapshot reports a snapshot's contents; table=<schema.name>
+// adds that table's DDL
+func handleInspectSnapshot(w http.ResponseWriter, r *http.Request) {
+	path, err := resolveSnapshotPath(r.URL.Query().Get("filename"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var contents *SnapshotContents
+	if table := r.URL.Query().Get("table"); table != "" {
+		schema, name := splitQualifiedName(table)
+		contents, err = inspectSnapshot(r.Context(), path, &SnapshotTable{Schema: schema, Name: name})
+	} else {
+		contents, err = cachedInspectSnapshot(r.Context(), path)
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"contents": contents,
+	})
+}
+
+// TableMatch is a snapshot that contains the table being searched for
+type TableMatch struct {
+	Filename string `json:"filename"`
+	Schema   string `json:"schema"`
+	Name     string `json:"name"`
+	Rows     int64  `json:"rows"`
+	HasData  bool   `json:"has_data"`
+}
+
+// handleFindTable lists the snapshots containing a table, given as name or
+// schema.name
+func handleFindTable(w http.ResponseWriter, r *http.Request) {
+	table := r.URL.Query().Get("table")
+	if table == "" {
+		http.Error(w, "Missing table", http.StatusBadRequest)
+		return
+	}
+
+	files, _ := listSnapshotFiles()
+	matches := []TableMatch{}
+	var failed []string
+	for _, file := range files {
+		contents, err := cachedInspectSnapshot(r.Context(), file)
+		if err != nil {
+			failed = append(failed, filepath.Base(file))
+			continue
+		}
+		for _, t := range contents.Tables {
+			if t.Name == table || t.qualified() == table {
+				matches = append(matches, TableMatch{
+					Filename: contents.Filename,
+					Schema:   t.Schema,
+					Name:     t.Name,
+					Rows:     t.Rows,
+					HasData:  t.HasData,
+				})
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"matches": matches,
+		"failed":  failed,
+	})
+}
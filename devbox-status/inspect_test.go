@@ -0,0 +1,229 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOCHeader(t *testing.T) {
+	tests := []struct {
+		line string
+		want tocEntry
+		ok   bool
+	}{
+		{"-- Name: users; Type: TABLE; Schema: public; Owner: postgres", tocEntry{"users", "TABLE", "public"}, true},
+		{"-- Data for Name: users; Type: TABLE DATA; Schema: public; Owner: postgres", tocEntry{"users", "TABLE DATA", "public"}, true},
+		{"-- Name: citext; Type: EXTENSION; Schema: -; Owner: -", tocEntry{"citext", "EXTENSION", "-"}, true},
+		{"-- Name: users users_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres", tocEntry{"users users_pkey", "CONSTRAINT", "public"}, true},
+		{"-- Name: users", tocEntry{}, false},
+		{"-- PostgreSQL database dump", tocEntry{}, false},
+		{"CREATE TABLE public.users (", tocEntry{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseTOCHeader(tt.line)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("parseTOCHeader(%q) = %+v, %v, want %+v, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseTOCList(t *testing.T) {
+	tests := []struct {
+		line string
+		want tocEntry
+		ok   bool
+	}{
+		{"218; 1259 16386 TABLE public users postgres", tocEntry{"users", "TABLE", "public"}, true},
+		{"3405; 0 16386 TABLE DATA public users postgres", tocEntry{"users", "TABLE DATA", "public"}, true},
+		{"2; 3079 16385 EXTENSION - citext", tocEntry{"citext", "EXTENSION", "-"}, true},
+		{"5; 2615 2200 SCHEMA - public postgres", tocEntry{"public", "SCHEMA", "-"}, true},
+		{"3250; 2606 16400 CONSTRAINT public users users_pkey postgres", tocEntry{"users users_pkey", "CONSTRAINT", "public"}, true},
+		{"3260; 2606 16410 FK CONSTRAINT public orders orders_user_id_fkey postgres", tocEntry{"orders orders_user_id_fkey", "FK CONSTRAINT", "public"}, true},
+		{"3400; 0 16420 MATERIALIZED VIEW DATA public totals postgres", tocEntry{"totals", "MATERIALIZED VIEW DATA", "public"}, true},
+		{";", tocEntry{}, false},
+		{"; Archive created at 2024-01-15 10:30:00 UTC", tocEntry{}, false},
+		{"218; 1259 16386 TABLE", tocEntry{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseTOCList(tt.line)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("parseTOCList(%q) = %+v, %v, want %+v, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSplitQualifiedName(t *testing.T) {
+	tests := []struct {
+		name, schema, table string
+	}{
+		{"users", "public", "users"},
+		{"public.users", "public", "users"},
+		{"app.users", "app", "users"},
+		{`"My Schema"."User Table"`, "My Schema", "User Table"},
+		{`app."a.b"`, "app", "a.b"},
+		{`"say ""hi"""`, "public", `say "hi"`},
+	}
+	for _, tt := range tests {
+		schema, table := splitQualifiedName(tt.name)
+		if schema != tt.schema || table != tt.table {
+			t.Errorf("splitQualifiedName(%q) = %q, %q, want %q, %q", tt.name, schema, table, tt.schema, tt.table)
+		}
+	}
+}
+
+const testDump = `--
+-- PostgreSQL database dump
+--
+
+SET statement_timeout = 0;
+
+--
+-- Name: app; Type: SCHEMA; Schema: -; Owner: postgres
+--
+
+CREATE SCHEMA app;
+
+--
+-- Name: citext; Type: EXTENSION; Schema: -; Owner: -
+--
+
+CREATE EXTENSION IF NOT EXISTS citext WITH SCHEMA public;
+
+--
+-- Name: users; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.users (
+    id integer NOT NULL,
+    email public.citext
+);
+
+--
+-- Name: events; Type: TABLE; Schema: app; Owner: postgres
+--
+
+CREATE TABLE app.events (
+    id integer NOT NULL
+);
+
+--
+-- Name: audit; Type: TABLE; Schema: app; Owner: postgres
+--
+
+CREATE TABLE app.audit (
+    id integer NOT NULL
+);
+
+--
+-- Data for Name: users; Type: TABLE DATA; Schema: public; Owner: postgres
+--
+
+COPY public.users (id, email) FROM stdin;
+1	a@example.com
+2	b@example.com
+\.
+
+--
+-- Data for Name: events; Type: TABLE DATA; Schema: app; Owner: postgres
+--
+
+INSERT INTO app.events VALUES (1);
+INSERT INTO app.events VALUES (2);
+INSERT INTO app.events VALUES (3);
+
+--
+-- Name: users users_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.users
+    ADD CONSTRAINT users_pkey PRIMARY KEY (id);
+
+--
+-- Name: users_email; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE INDEX users_email ON public.users USING btree (email);
+
+--
+-- Name: events_id; Type: INDEX; Schema: app; Owner: postgres
+--
+
+CREATE INDEX events_id ON app.events USING btree (id);
+`
+
+func TestDumpParser(t *testing.T) {
+	tests := []struct {
+		name     string
+		ddlTable *SnapshotTable
+		wantDDL  string
+	}{
+		{"contents only", nil, ""},
+		{"users DDL", &SnapshotTable{Schema: "public", Name: "users"}, `CREATE TABLE public.users (
+    id integer NOT NULL,
+    email public.citext
+);
+
+ALTER TABLE ONLY public.users
+    ADD CONSTRAINT users_pkey PRIMARY KEY (id);
+
+CREATE INDEX users_email ON public.users USING btree (email);`},
+		{"events DDL", &SnapshotTable{Schema: "app", Name: "events"}, `CREATE TABLE app.events (
+    id integer NOT NULL
+);
+
+CREATE INDEX events_id ON app.events USING btree (id);`},
+	}
+
+	wantTables := []SnapshotTable{
+		{Schema: "app", Name: "audit"},
+		{Schema: "app", Name: "events", Rows: 3, HasData: true},
+		{Schema: "public", Name: "users", Rows: 2, HasData: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newDumpParser(tt.ddlTable)
+			if err := p.parse(strings.NewReader(testDump)); err != nil {
+				t.Fatal(err)
+			}
+			c := p.contents()
+			if want := []string{"app", "public"}; !reflect.DeepEqual(c.Schemas, want) {
+				t.Errorf("Schemas = %v, want %v", c.Schemas, want)
+			}
+			if want := []string{"citext"}; !reflect.DeepEqual(c.Extensions, want) {
+				t.Errorf("Extensions = %v, want %v", c.Extensions, want)
+			}
+			if !reflect.DeepEqual(c.Tables, wantTables) {
+				t.Errorf("Tables = %+v, want %+v", c.Tables, wantTables)
+			}
+			if c.DDL != tt.wantDDL {
+				t.Errorf("DDL = %q, want %q", c.DDL, tt.wantDDL)
+			}
+		})
+	}
+}
+
+func TestDumpParserCopyWithoutHeader(t *testing.T) {
+	// A COPY outside a TABLE DATA entry is attributed by its statement
+	p := newDumpParser(nil)
+	dump := "COPY \"App\".\"Users\" (id) FROM stdin;\n1\n2\n3\n\\.\n"
+	if err := p.parse(strings.NewReader(dump)); err != nil {
+		t.Fatal(err)
+	}
+	want := []SnapshotTable{{Schema: "App", Name: "Users", Rows: 3, HasData: true}}
+	if got := p.contents().Tables; !reflect.DeepEqual(got, want) {
+		t.Errorf("Tables = %+v, want %+v", got, want)
+	}
+}
+
+func TestDumpParserCopyInFunctionBody(t *testing.T) {
+	// Only COPY ... FROM stdin; starts a data block
+	p := newDumpParser(nil)
+	dump := "CREATE FUNCTION public.export() RETURNS void AS $$\nCOPY public.users TO '/tmp/users.csv';\n$$ LANGUAGE sql;\n"
+	if err := p.parse(strings.NewReader(dump)); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.contents().Tables; len(got) != 0 {
+		t.Errorf("Tables = %+v, want none", got)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job states
+const (
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+const (
+	maxJobLogLines  = 500
+	maxFinishedJobs = 20
+)
+
+// Job is a long-running snapshot operation executed in the background.
+// Progress is published to subscribers as Server-Sent Events.
+type Job struct {
+	mu   sync.Mutex
+	info JobInfo
+	log  []string
+
+	cancel      context.CancelFunc
+	done        chan struct{}
+	subscribers map[chan jobEvent]struct{}
+}
+
+// JobInfo is the JSON representation of a job
+type JobInfo struct {
+	ID           string
+	Kind         string
+	Target       string
+	Status       string
+	Error        string `json:",omitempty"`
+	StartedAt    time.Time
+	FinishedAt   *time.Time `json:",omitempty"`
+	Bytes        int64
+	TotalBytes   int64
+	CurrentTable string
+	LastLog      string
+	Errors       []RestoreError `json:",omitempty"`
+	BlockedBy    []int          `json:",omitempty"` // sessions the job is waiting for
+}
+
+type jobEvent struct {
+	name string
+	data interface{}
+}
+
+type jobManager struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+var jobs = &jobManager{jobs: make(map[string]*Job)}
+
+// start registers a job and runs fn in the background. The job fails if
+// fn returns an error and is marked cancelled if its context was cancelled.
+func (m *jobManager) start(kind, target string, fn func(ctx context.Context, job *Job) error) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		info: JobInfo{
+			ID:        newJobID(),
+			Kind:      kind,
+			Target:    target,
+			Status:    jobRunning,
+			StartedAt: time.Now(),
+		},
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		subscribers: make(map[chan jobEvent]struct{}),
+	}
+
+	m.mu.Lock()
+	m.jobs[job.info.ID] = job
+	m.pruneLocked()
+	m.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		err := fn(ctx, job)
+		job.finish(ctx, err)
+		invalidateCache()
+	}()
+
+	return job
+}
+
+func (m *jobManager) get(id string) *Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.jobs[id]
+}
+
+// list returns running jobs first, then finished jobs, newest first
+func (m *jobManager) list() []JobInfo {
+	m.mu.Lock()
+	infos := make([]JobInfo, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		infos = append(infos, job.Info())
+	}
+	m.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		iRunning, jRunning := infos[i].Status == jobRunning, infos[j].Status == jobRunning
+		if iRunning != jRunning {
+			return iRunning
+		}
+		return infos[i].StartedAt.After(infos[j].StartedAt)
+	})
+	return infos
+}
+
+// activeTargets returns the snapshot filenames used by running jobs
+func (m *jobManager) activeTargets() map[string]bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	targets := make(map[string]bool)
+	for _, job := range m.jobs {
+		if info := job.Info(); info.Status == jobRunning {
+			targets[info.Target] = true
+		}
+	}
+	return targets
+}
+
+// pruneLocked forgets the oldest finished jobs beyond maxFinishedJobs
+func (m *jobManager) pruneLocked() {
+	var finished []JobInfo
+	for _, job := range m.jobs {
+		if info := job.Info(); info.Status != jobRunning {
+			finished = append(finished, info)
+		}
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].StartedAt.After(finished[j].StartedAt)
+	})
+	for _, info := range finished[maxFinishedJobs:] {
+		delete(m.jobs, info.ID)
+	}
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (j *Job) Info() JobInfo {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.info
+}
+
+func (j *Job) Log() []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]string(nil), j.log...)
+}
+
+func (j *Job) Cancel() {
+	j.cancel()
+}
+
+// Wait blocks until the job has finished and returns its final state
+func (j *Job) Wait() JobInfo {
+	<-j.done
+	return j.Info()
+}
+
+// update applies fn to the job's info and publishes the new state
+func (j *Job) update(fn func(info *JobInfo)) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	fn(&j.info)
+	j.broadcastLocked(jobEvent{name: "job", data: j.info})
+	j.mu.Unlock()
+}
+
+// setBytes records progress without publishing an event when nothing changed
+func (j *Job) setBytes(n int64) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	changed := j.info.Bytes != n
+	j.mu.Unlock()
+	if changed {
+		j.update(func(info *JobInfo) { info.Bytes = n })
+	}
+}
+
+var tableProgressRe = regexp.MustCompile(`(?:dumping contents of|processing data for) table "([^"]+)"`)
+
+// appendLog records a line of output from the job's command. Verbose
+// pg_dump/pg_restore lines that name a table also update CurrentTable.
+func (j *Job) appendLog(line string) {
+	if j == nil || line == "" {
+		return
+	}
+	j.mu.Lock()
+	j.log = append(j.log, line)
+	if len(j.log) > maxJobLogLines {
+		j.log = j.log[len(j.log)-maxJobLogLines:]
+	}
+	j.info.LastLog = line
+	if m := tableProgressRe.FindStringSubmatch(line); m != nil {
+		j.info.CurrentTable = m[1]
+	}
+	j.broadcastLocked(jobEvent{name: "log", data: line})
+	j.broadcastLocked(jobEvent{name: "job", data: j.info})
+	j.mu.Unlock()
+}
+
+func (j *Job) logf(format string, args ...interface{}) {
+	j.appendLog(fmt.Sprintf(format, args...))
+}
+
+func (j *Job) finish(ctx context.Context, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	j.info.FinishedAt = &now
+	// A cancel that arrives after fn returned must not hide its outcome; a
+	// killed command reports its own error, so ctx decides only on failure.
+	switch {
+	case err != nil && (errors.Is(err, context.Canceled) || ctx.Err() != nil):
+		j.info.Status = jobCancelled
+		j.info.Error = "cancelled"
+	case err != nil:
+		j.info.Status = jobFailed
+		j.info.Error = err.Error()
+	default:
+		j.info.Status = jobSucceeded
+	}
+
+	j.broadcastLocked(jobEvent{name: "job", data: j.info})
+	for ch := range j.subscribers {
+		close(ch)
+	}
+	j.subscribers = nil
+	close(j.done)
+}
+
+// subscribe returns a channel of events for a running job. The channel is
+// closed when the job finishes; nil is returned if it already has.
+func (j *Job) subscribe() (chan jobEvent, func()) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.info.Status != jobRunning {
+		return nil, func() {}
+	}
+
+	ch := make(chan jobEvent, 64)
+	j.subscribers[ch] = struct{}{}
+	return ch, func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		if _, ok := j.subscribers[ch]; ok {
+			delete(j.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// broadcastLocked delivers an event without blocking; slow subscribers miss
+// intermediate events but always receive the final state.
+func (j *Job) broadcastLocked(ev jobEvent) {
+	for ch := range j.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"jobs": jobs.list(),
+	})
+}
+
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	job := jobs.get(r.URL.Query().Get("id"))
+	if job == nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"job": job.Info(),
+		"log": job.Log(),
+	})
+}
+
+// handleJobEvents streams a job's progress as Server-Sent Events. A "job"
+// event carries the full JobInfo; "log" events carry single output lines.
+func handleJobEvents(w http.ResponseWriter, r *http.Request) {
+	job := jobs.get(r.URL.Query().Get("id"))
+	if job == nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	send := func(name string, data interface{}) {
+		payload, _ := json.Marshal(data)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, payload)
+		flusher.Flush()
+	}
+
+	events, unsubscribe := job.subscribe()
+	defer unsubscribe()
+
+	send("job", job.Info())
+	if events == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				// The final event may have been dropped; resend the final state
+				send("job", job.Info())
+				return
+			}
+			send(ev.name, ev.data)
+		}
+	}
+}
+
+func handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	job := jobs.get(r.URL.Query().Get("id"))
+	if job == nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	job.Cancel()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+	})
+}
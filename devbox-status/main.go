@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -10,9 +11,9 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -25,7 +26,20 @@ type StatusData struct {
 	DevServicePort    string
 	Hostname          string
 	Services          []Service
+	Overview          *DBOverview
+	Migrations        []MigrationStatus
 	Snapshots         []Snapshot
+	Retention         string
+	Schedules         []ScheduleStatus
+	Branches          []DBBranch
+	SideDatabases     []SideDatabase
+	BranchAutoSwitch  bool
+	AnonymizeProfiles []string
+	Encryption        bool
+	Remote            string
+	Environments      []EnvironmentSnapshot
+	ScheduleErrors    []string
+	LastRestore       *LastRestore
 	TailscaleStatus   *TailscaleStatus
 	CloudflaredActive bool
 }
@@ -37,9 +51,13 @@ type Service struct {
 }
 
 type Snapshot struct {
-	Filename string
-	Size     string
-	Date     string
+	Filename     string
+	Format       string
+	Size         string
+	Date         string
+	Verification string
+	Encrypted    bool
+	Meta         *SnapshotMeta
 }
 
 type TailscaleStatus struct {
@@ -52,43 +70,105 @@ type TailscaleStatus struct {
 }
 
 var (
-	cachedStatus  *StatusData
-	cacheTime     time.Time
-	cacheDuration = 10 * time.Second
-	snapshotsDir  = "/snapshots"
-	db            *sql.DB
+	cacheMu         sync.Mutex
+	cachedStatus    *StatusData
+	cacheTime       time.Time
+	cacheRefreshing bool
+	cacheGen        int // bumped by invalidateCache
+	cacheDuration   = 10 * time.Second
+	statusTimeout   = 5 * time.Second
+	snapshotsDir    = "/snapshots"
+	db              *sql.DB
+	adminDB         *sql.DB
 )
 
 func invalidateCache() {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
 	cachedStatus = nil
 	cacheTime = time.Time{}
+	cacheGen++
 }
 
 func main() {
 	// Initialize database connection
-	connStr := fmt.Sprintf(
-		"host=localhost port=5432 user=%s password=%s dbname=%s sslmode=disable",
-		getEnv("POSTGRES_USER", "postgres"),
-		getEnv("POSTGRES_PASSWORD", "postgres"),
-		getEnv("POSTGRES_DB", "devdb"),
-	)
-
 	var err error
-	db, err = sql.Open("postgres", connStr)
+	db, err = sql.Open("postgres", connString(getEnv("POSTGRES_DB", "devdb")))
 	if err != nil {
 		log.Printf("Warning: Could not connect to database: %v", err)
 	} else {
 		defer db.Close()
 	}
 
+	// Maintenance connection used to create, rename and drop databases
+	adminDB, err = sql.Open("postgres", connString("postgres"))
+	if err != nil {
+		log.Printf("Warning: Could not connect to maintenance database: %v", err)
+	} else {
+		defer adminDB.Close()
+	}
+
 	http.HandleFunc("/", handleStatus)
 	http.HandleFunc("/api/status", handleAPIStatus)
+	http.HandleFunc("/api/db/overview", handleDBOverview)
+	http.HandleFunc("/api/connections", handleConnections)
+	http.HandleFunc("/api/statements", handleStatements)
+	http.HandleFunc("/api/statements/reset", handleResetStatements)
+	http.HandleFunc("/api/statements/baseline", handleStatementBaseline)
+	http.HandleFunc("/api/statements/compare", handleCompareStatements)
+	http.HandleFunc("/api/explain", handleExplain)
+	http.HandleFunc("/api/migrations", handleMigrations)
+	http.HandleFunc("/api/connections/cancel", handleSignalBackend)
+	http.HandleFunc("/api/connections/terminate", handleSignalBackend)
 	http.HandleFunc("/api/snapshots", handleSnapshots)
 	http.HandleFunc("/api/snapshots/create", handleCreateSnapshot)
+	http.HandleFunc("/api/snapshots/subset", handleCreateSubset)
 	http.HandleFunc("/api/snapshots/restore", handleRestoreSnapshot)
 	http.HandleFunc("/api/snapshots/delete", handleDeleteSnapshot)
+	http.HandleFunc("/api/snapshots/download", handleDownloadSnapshot)
+	http.HandleFunc("/api/snapshots/verify", handleVerifySnapshot)
+	http.HandleFunc("/api/snapshots/inspect", handleInspectSnapshot)
+	http.HandleFunc("/api/snapshots/find", handleFindTable)
+	http.HandleFunc("/api/snapshots/upload", handleUploadSnapshot)
+	http.HandleFunc("/api/schema/diff", handleSchemaDiff)
+	http.HandleFunc("/api/datadiff", handleDataDiff)
+	http.HandleFunc("/api/datadiff/start", handleStartDataDiff)
+	http.HandleFunc("/api/snapshots/undo", handleUndoRestore)
+	http.HandleFunc("/api/snapshots/pin", handlePinSnapshot)
+	http.HandleFunc("/api/snapshots/retention", handleRetention)
+	http.HandleFunc("/api/snapshots/prune", handlePrune)
+	http.HandleFunc("/api/remote/snapshots", handleRemoteSnapshots)
+	http.HandleFunc("/api/remote/push", handleRemoteTransfer)
+	http.HandleFunc("/api/remote/pull", handleRemoteTransfer)
+	http.HandleFunc("/api/remote/sync", handleRemoteTransfer)
+	http.HandleFunc("/api/environments", handleEnvironments)
+	http.HandleFunc("/api/environments/create", handleCreateEnvironment)
+	http.HandleFunc("/api/environments/restore", handleRestoreEnvironment)
+	http.HandleFunc("/api/environments/delete", handleDeleteEnvironment)
+	http.HandleFunc("/api/branches", handleBranches)
+	http.HandleFunc("/api/branches/create", handleCreateBranch)
+	http.HandleFunc("/api/branches/switch", handleSwitchBranch)
+	http.HandleFunc("/api/branches/delete", handleDeleteBranch)
+	http.HandleFunc("/api/sidedbs", handleSideDatabases)
+	http.HandleFunc("/api/sidedbs/drop", handleDropSideDatabase)
+	http.HandleFunc("/api/pgweb/open", handleOpenInPgweb)
+	http.HandleFunc("/api/jobs", handleJobs)
+	http.HandleFunc("/api/jobs/get", handleJob)
+	http.HandleFunc("/api/jobs/events", handleJobEvents)
+	http.HandleFunc("/api/jobs/cancel", handleCancelJob)
 	http.HandleFunc("/api/tailscale/toggle-funnel", handleToggleFunnel)
 
+	go runRetentionPruner()
+
+	snapshotScheduler.load(getEnv("SNAPSHOT_SCHEDULE", ""), time.Now())
+	go snapshotScheduler.run()
+	verifyScheduler.load(getEnv("VERIFY_SCHEDULE", ""), time.Now())
+	go verifyScheduler.run()
+
+	if branchAutoSwitchEnabled() {
+		go runBranchWatcher()
+	}
+
 	log.Println("DevBox status server starting on :8082")
 	log.Fatal(http.ListenAndServe(":8082", nil))
 }
@@ -223,10 +303,175 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
             font-size: 11px;
             color: #00ffff;
         }
+        .snapshot-badge {
+            font-size: 10px;
+            padding: 0 6px;
+            border: 1px solid #ff00ff;
+            color: #ff00ff;
+            text-transform: uppercase;
+        }
+        .snapshot-badge.verify-verified {
+            border-color: #00ff00;
+            color: #00ff00;
+        }
+        .snapshot-badge.verify-failed {
+            border-color: #ff0000;
+            color: #ff0000;
+        }
+        .snapshot-badge.verify-unverified {
+            border-color: #0000ff;
+            color: #0000ff;
+        }
+        .snapshot-badge.verify-restorable {
+            border-color: #ffff00;
+            color: #ffff00;
+        }
+        .retention-row {
+            margin-top: 15px;
+            display: flex;
+            justify-content: space-between;
+            align-items: center;
+            gap: 10px;
+        }
+        .undo-banner {
+            margin-top: 15px;
+            padding: 10px;
+            border: 2px solid #ffff00;
+            display: flex;
+            justify-content: space-between;
+            align-items: center;
+            gap: 10px;
+        }
+        .snapshot-notes {
+            font-size: 11px;
+            color: #ffffff;
+            margin: 2px 0;
+        }
         .snapshot-actions {
             display: flex;
             gap: 6px;
         }
+        .snapshot-contents {
+            display: none;
+            padding: 8px 10px;
+            margin: -8px 0 8px;
+            background: #000040;
+            border: 1px solid #0000ff;
+            border-top: none;
+            font-size: 11px;
+        }
+        .snapshot-contents table {
+            border-collapse: collapse;
+            margin-top: 4px;
+        }
+        .snapshot-contents td {
+            padding: 1px 12px 1px 0;
+        }
+        .snapshot-contents a {
+            color: #ffff00;
+            cursor: pointer;
+        }
+        .overview-table {
+            width: 100%;
+            border-collapse: collapse;
+            margin-top: 10px;
+            font-size: 11px;
+        }
+        .overview-table th {
+            text-align: left;
+            color: #ffff00;
+            font-weight: 600;
+            border-bottom: 1px solid #0000ff;
+        }
+        .overview-table th, .overview-table td {
+            padding: 2px 8px 2px 0;
+            white-space: nowrap;
+        }
+        .overview-table td.num, .overview-table th.num {
+            text-align: right;
+        }
+        .overview-table .dead-high {
+            color: #ff5555;
+        }
+        .snapshot-meta.migration-missing {
+            color: #ff5555;
+        }
+        .plan-node {
+            padding-left: 16px;
+            border-left: 1px solid #0000ff;
+            font-size: 11px;
+        }
+        .plan-node > .plan-line {
+            padding: 2px 0;
+            white-space: nowrap;
+        }
+        .plan-node.hot > .plan-line .plan-type {
+            color: #ff5555;
+        }
+        .plan-type {
+            color: #ffff00;
+            font-weight: 600;
+        }
+        .plan-detail {
+            color: #00ffff;
+            padding-left: 12px;
+            white-space: pre-wrap;
+        }
+        .plan-warning {
+            color: #ff5555;
+            padding-left: 12px;
+        }
+        .diff-added {
+            color: #00ff00;
+        }
+        .diff-dropped {
+            color: #ff5555;
+        }
+        .diff-changed {
+            color: #ffff00;
+        }
+        .snapshot-contents pre {
+            margin-top: 8px;
+            padding: 6px;
+            background: #000000;
+            color: #c0c0c0;
+            white-space: pre-wrap;
+            max-height: 300px;
+            overflow-y: auto;
+        }
+        .job-item {
+            padding: 10px;
+            background: #000080;
+            border: 1px solid #0000ff;
+            margin-bottom: 8px;
+        }
+        .job-header {
+            display: flex;
+            justify-content: space-between;
+            align-items: center;
+            gap: 8px;
+        }
+        .job-log {
+            font-size: 11px;
+            color: #00ffff;
+            margin-top: 4px;
+            white-space: nowrap;
+            overflow: hidden;
+            text-overflow: ellipsis;
+        }
+        .job-error {
+            color: #ff5555;
+        }
+        .status-succeeded {
+            background: #00aa00;
+            color: #00ff00;
+            border-color: #00ff00;
+        }
+        .status-failed, .status-cancelled {
+            background: #aa0000;
+            color: #ff0000;
+            border-color: #ff0000;
+        }
         .btn {
             padding: 6px 12px;
             border: 2px solid;
@@ -269,7 +514,7 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
         .input-group {
             margin-bottom: 15px;
         }
-        .input-group input {
+        .input-group input, .input-group textarea {
             width: 100%;
             padding: 8px;
             border: 2px solid #00ffff;
@@ -278,12 +523,30 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
             font-size: 13px;
             font-family: 'IBM Plex Mono', monospace;
         }
-        .input-group input:focus {
+        .input-group select {
+            padding: 8px;
+            border: 2px solid #00ffff;
+            background: #000080;
+            color: #ffff00;
+            font-size: 13px;
+            font-family: 'IBM Plex Mono', monospace;
+        }
+        .input-row {
+            display: flex;
+            gap: 10px;
+        }
+        .input-row select {
+            flex: 1;
+        }
+        .input-group textarea {
+            resize: vertical;
+        }
+        .input-group input:focus, .input-group textarea:focus {
             outline: none;
             border-color: #ffff00;
             background: #0000aa;
         }
-        .input-group input::placeholder {
+        .input-group input::placeholder, .input-group textarea::placeholder {
             color: #0000ff;
         }
         .empty-state {
@@ -486,6 +749,9 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
         <div class="modal">
             <div class="modal-title" id="modalTitle"></div>
             <div class="modal-message" id="modalMessage"></div>
+            <div class="input-group" id="modalInputGroup" style="display: none;">
+                <input type="text" id="modalInput">
+            </div>
             <div class="modal-buttons">
                 <button class="modal-btn modal-btn-yes" id="modalYes">YES</button>
                 <button class="modal-btn modal-btn-no" id="modalNo">CANCEL</button>
@@ -565,30 +831,342 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
                 {{end}}
             </div>
 
+            {{with .Overview}}
+            <div class="card">
+                <h2>Database</h2>
+                <div class="snapshot-meta">{{.Database}} • {{.Size}} • {{.TableCount}} tables{{if .DeadTuples}} • {{.DeadTuples}} dead tuples{{end}}</div>
+                {{if .Tables}}
+                <div style="overflow-x: auto;">
+                <table class="overview-table">
+                    <tr>
+                        <th>Table</th>
+                        <th class="num">Total</th>
+                        <th class="num">Table</th>
+                        <th class="num">Indexes</th>
+                        <th class="num">TOAST</th>
+                        <th class="num" title="pg_class.reltuples, updated by VACUUM and ANALYZE">~Rows</th>
+                        <th class="num" title="Dead tuples as a share of live + dead">Dead</th>
+                        <th>Vacuumed</th>
+                        <th>Analyzed</th>
+                    </tr>
+                    {{range .Tables}}
+                    <tr>
+                        <td>{{if ne .Schema "public"}}{{.Schema}}.{{end}}{{.Name}}</td>
+                        <td class="num">{{.TotalSize}}</td>
+                        <td class="num">{{.TableSize}}</td>
+                        <td class="num">{{.IndexSize}}</td>
+                        <td class="num">{{.ToastSize}}</td>
+                        <td class="num">{{if lt .EstimatedRows 0}}?{{else}}{{.EstimatedRows}}{{end}}</td>
+                        <td class="num{{if ge .DeadRatio 0.2}} dead-high{{end}}" title="{{.DeadTuples}} dead, {{.LiveTuples}} live">{{.DeadPercent}}%</td>
+                        <td title="{{with .LastVacuum}}manual {{.Format "2006-01-02 15:04"}} {{end}}{{with .LastAutovacuum}}auto {{.Format "2006-01-02 15:04"}}{{end}}">{{with .Vacuumed}}{{.Format "2006-01-02 15:04"}}{{else}}never{{end}}</td>
+                        <td title="{{with .LastAnalyze}}manual {{.Format "2006-01-02 15:04"}} {{end}}{{with .LastAutoanalyze}}auto {{.Format "2006-01-02 15:04"}}{{end}}">{{with .Analyzed}}{{.Format "2006-01-02 15:04"}}{{else}}never{{end}}</td>
+                    </tr>
+                    {{end}}
+                </table>
+                </div>
+                {{end}}
+            </div>
+            {{end}}
+
+            {{if .Migrations}}
+            <div class="card">
+                <h2>Migrations</h2>
+                {{range .Migrations}}
+                <div class="snapshot-item">
+                    <div class="snapshot-info">
+                        <div class="snapshot-name">{{.Framework}}{{if .Dirty}} <span class="snapshot-badge verify-failed" title="A migration failed or was left half applied">dirty</span>{{end}}</div>
+                        {{if .Error}}<div class="snapshot-meta">{{.Table}} • could not be read: {{.Error}}</div>{{else}}
+                        <div class="snapshot-meta">{{.Table}} • {{.Applied}} applied{{if .Latest}} • latest {{.Latest}}{{end}}{{if .FilesError}} • migration files not checked: {{.FilesError}}{{else if not .Files}} • no migration files found in /workspace{{end}}</div>{{end}}
+                        {{if .Pending}}<div class="snapshot-meta">⚠ {{len .Pending}} pending: {{range $i, $id := .Pending}}{{if $i}}, {{end}}{{$id}}{{end}}</div>{{end}}
+                        {{if .Missing}}<div class="snapshot-meta migration-missing" title="Applied to the database, but not in the workspace: another branch's migrations?">⚠ {{len .Missing}} missing: {{range $i, $id := .Missing}}{{if $i}}, {{end}}{{$id}}{{end}}</div>{{end}}
+                    </div>
+                </div>
+                {{end}}
+            </div>
+            {{end}}
+
+            <div class="card">
+                <h2>Connections</h2>
+                <div class="retention-row" style="margin-top: 0;">
+                    <label class="snapshot-meta"><input type="checkbox" id="connectionsAll" style="width: auto;" onchange="loadConnections()"> all databases</label>
+                    <button class="btn btn-restore" onclick="loadConnections()">Refresh</button>
+                </div>
+                <div id="connectionList" style="margin-top: 10px;">
+                    <div class="empty-state">Loading…</div>
+                </div>
+            </div>
+
+            <div class="card">
+                <h2>Top Queries</h2>
+                <div class="input-row">
+                    <select id="statementOrder" title="Rank by" onchange="loadStatements()">
+                        <option value="total">Total time</option>
+                        <option value="mean">Mean time</option>
+                        <option value="calls">Calls</option>
+                    </select>
+                    <button class="btn btn-restore" onclick="loadStatements()">Refresh</button>
+                    <button class="btn btn-restore" onclick="captureBaseline()" title="Save the current statistics to compare against later">Capture baseline</button>
+                    <button class="btn btn-restore" onclick="compareStatements()" title="Compare with the baseline">Compare</button>
+                    <button class="btn btn-delete" onclick="resetStatements()" title="pg_stat_statements_reset()">Reset</button>
+                </div>
+                <div class="snapshot-meta" id="statementBaseline"></div>
+                <div id="statementList" style="overflow-x: auto;">
+                    <div class="empty-state">Loading…</div>
+                </div>
+            </div>
+
+            <div class="card">
+                <h2>Explain</h2>
+                <div class="input-group">
+                    <textarea id="explainSQL" rows="5" placeholder="SELECT … (runs with EXPLAIN ANALYZE in a transaction that is rolled back)"></textarea>
+                </div>
+                <button class="btn btn-create" onclick="runExplain()">Explain Analyze</button>
+                <div id="explainResult" style="overflow-x: auto; margin-top: 10px;"></div>
+            </div>
+
             <div class="card">
                 <h2>Database Snapshots</h2>
                 <div class="input-group">
                     <input type="text" id="snapshotLabel" placeholder="Snapshot label (optional)">
                 </div>
+                <div class="input-group">
+                    <input type="text" id="snapshotNotes" placeholder="Notes (optional)">
+                </div>
+                <div class="input-group input-row">
+                    <select id="snapshotFormat" title="Snapshot format">
+                        <option value="">Default format</option>
+                        <option value="plain">Plain SQL</option>
+                        <option value="custom">Custom (-Fc)</option>
+                        <option value="directory">Directory (-Fd)</option>
+                    </select>
+                    <select id="snapshotCompress" title="Compression level">
+                        <option value="">Default compression</option>
+                        <option value="0">No compression</option>
+                        <option value="1">Fast (1)</option>
+                        <option value="6">Balanced (6)</option>
+                        <option value="9">Best (9)</option>
+                    </select>
+                    {{if .AnonymizeProfiles}}
+                    <select id="snapshotAnonymize" title="Anonymization profile (.devbox/anonymize.json)">
+                        <option value="">Not anonymized</option>
+                        {{range .AnonymizeProfiles}}<option value="{{.}}">Anonymize: {{.}}</option>{{end}}
+                    </select>
+                    {{end}}
+                    {{if .Encryption}}
+                    <label class="snapshot-meta" title="Encrypt with the key in /etc/secrets (not available for directory snapshots)"><input type="checkbox" id="snapshotEncrypt" style="width: auto;" checked> 🔒 encrypt</label>
+                    {{end}}
+                </div>
+                <details class="snapshot-meta" style="margin-bottom: 10px;">
+                    <summary>Advanced options</summary>
+                    <div class="input-group input-row" style="margin-top: 8px;">
+                        <select id="snapshotContents" title="What the snapshot contains">
+                            <option value="">Schema and data</option>
+                            <option value="schema_only">Schema only</option>
+                            <option value="data_only">Data only</option>
+                        </select>
+                    </div>
+                    <div class="input-group input-row">
+                        <input type="text" id="snapshotTables" placeholder="Only tables (e.g. public.users, audit_*)">
+                        <input type="text" id="snapshotExcludeTables" placeholder="Exclude tables">
+                    </div>
+                    <div class="input-group input-row">
+                        <input type="text" id="snapshotSchemas" placeholder="Only schemas">
+                        <input type="text" id="snapshotExcludeSchemas" placeholder="Exclude schemas">
+                    </div>
+                    <div class="input-group">
+                        <input type="text" id="snapshotExcludeTableData" placeholder="Exclude data of tables (schema is kept)">
+                    </div>
+                </details>
                 <button class="btn btn-create" onclick="createSnapshot()">Create Snapshot</button>
+                <button class="btn btn-restore" onclick="createEnvironment()" title="Bundle the database, every Valkey key and the workspace git state into one archive">Create Environment Snapshot</button>
+                <div class="input-group input-row" style="margin-top: 10px;">
+                    <input type="text" id="subsetRoots" placeholder="Subset: users WHERE id IN (1, 2); orders 1%" title="Root tables with a filter or a percentage, separated by ;">
+                    <label class="snapshot-meta" title="Also include rows that reference the selected rows"><input type="checkbox" id="subsetChildren" style="width: auto;"> children</label>
+                    <button class="btn btn-restore" onclick="createSubset()" title="Snapshot the selected rows plus every row they reference">Create Subset</button>
+                </div>
+                <div class="input-row">
+                    <input type="file" id="snapshotUpload" accept=".sql,.gz,.dump" title="pg_dump file (plain SQL, gzipped SQL or custom format)">
+                    <button class="btn btn-restore" onclick="uploadSnapshot()">Upload</button>
+                </div>
+                <div class="input-row">
+                    <input type="text" id="findTable" placeholder="schema.table" onkeydown="if (event.key === 'Enter') findTable()">
+                    <button class="btn btn-restore" onclick="findTable()" title="List the snapshots that contain a table">Find table</button>
+                </div>
+                <div class="snapshot-contents" id="findTableResults" style="margin: 8px 0;"></div>
+                {{if .Remote}}
+                <div class="input-row">
+                    <button class="btn btn-restore" onclick="showRemoteSnapshots()" title="List the snapshots in {{.Remote}}">Remote snapshots</button>
+                    <button class="btn btn-restore" onclick="syncSnapshots()" title="Push snapshots missing from {{.Remote}} and pull the ones missing here">Sync with remote</button>
+                </div>
+                <div class="snapshot-contents" id="remoteSnapshots" style="margin: 8px 0;"></div>
+                {{end}}
+                <div class="input-row">
+                    <select id="schemaDiffFrom" title="Compare from">
+                        <option value="live">{{.PostgresDB}} (live)</option>
+                        {{range .Snapshots}}<option value="{{.Filename}}">{{.Filename}}</option>{{end}}
+                    </select>
+                    <select id="schemaDiffTo" title="Compare to">
+                        {{range .Snapshots}}<option value="{{.Filename}}">{{.Filename}}</option>{{end}}
+                        <option value="live">{{.PostgresDB}} (live)</option>
+                    </select>
+                    <button class="btn btn-restore" onclick="compareSchemas()">Compare schemas</button>
+                </div>
+                <div class="input-row">
+                    <input type="text" id="dataDiffTables" placeholder="public.users, public.orders" title="Tables to compare row by row (must have a primary key)">
+                    <button class="btn btn-restore" onclick="compareData()" title="Load both sources into throwaway databases and compare rows by primary key">Compare data</button>
+                </div>
+                <div class="snapshot-contents" id="schemaDiffResults" style="margin: 8px 0;"></div>
+                {{with .LastRestore}}
+                <div class="undo-banner">
+                    <div class="snapshot-meta">
+                        Restored {{if .RestoreOf}}{{.RestoreOf}}{{else}}a snapshot{{end}} at {{.RestoredAt.Format "2006-01-02 15:04"}}.
+                        Undo available until {{.UndoUntil.Format "15:04"}}.
+                    </div>
+                    <button class="btn btn-restore" onclick="undoRestore('{{.Snapshot}}')">Undo last restore</button>
+                </div>
+                {{end}}
+                <div class="retention-row">
+                    <span class="snapshot-meta">Retention: {{.Retention}}</span>
+                    <button class="btn btn-restore" onclick="previewPrune()">Preview prune</button>
+                </div>
                 <div style="margin-top: 20px;" id="snapshotList">
                     {{if .Snapshots}}
                         {{range .Snapshots}}
                         <div class="snapshot-item">
                             <div class="snapshot-info">
-                                <div class="snapshot-name">{{.Filename}}</div>
-                                <div class="snapshot-meta">{{.Size}} • {{.Date}}</div>
+                                <div class="snapshot-name">{{if .Encrypted}}<span title="Encrypted with the snapshot key">🔒</span> {{end}}{{.Filename}}{{with .Meta}}{{if .Kind}} <span class="snapshot-badge">{{.Kind}}</span>{{end}}{{if .Pinned}} <span class="snapshot-badge">📌 pinned</span>{{end}}{{with .Anonymization}} <span class="snapshot-badge" title="{{range $col, $rule := .Rules}}{{$col}}: {{$rule}}&#10;{{end}}">🎭 {{.Profile}}</span>{{end}}{{end}} <span class="snapshot-badge verify-{{.Verification}}"{{with .Meta}}{{with .Verification}} title="{{.CheckedAt.Format "2006-01-02 15:04"}} • sha256 {{.SHA256}}{{if .Error}} • {{.Error}}{{end}}"{{end}}{{end}}>{{if eq .Verification "verified"}}✓ verified{{else if eq .Verification "failed"}}✗ failed{{else if eq .Verification "restorable"}}◐ no row counts{{else}}unverified{{end}}</span></div>
+                                <div class="snapshot-meta">{{.Format}} • {{.Size}} • {{.Date}}</div>
+                                {{with .Meta}}
+                                {{if .Notes}}<div class="snapshot-notes">{{.Notes}}</div>{{end}}
+                                {{with .Scope}}<div class="snapshot-meta">⚠ Partial: {{.String}}</div>{{end}}
+                                {{with .Subset}}<div class="snapshot-meta">Subset of {{range $i, $root := .Roots}}{{if $i}}; {{end}}{{$root}}{{end}}{{if .Children}} with child rows{{end}}</div>{{end}}
+                                <div class="snapshot-meta">
+                                    {{if .GitBranch}}⎇ {{.GitBranch}}{{if .GitCommit}} @ {{printf "%.8s" .GitCommit}}{{end}} • {{end}}
+                                    {{range .Migrations}}{{.Summary}} • {{else}}{{if .MigrationVersion}}migration {{.MigrationVersion}} • {{end}}{{end}}
+                                    {{.TableCount}} tables{{if .ServerVersion}} • PG {{.ServerVersion}}{{end}}{{if .CreatedBy}} • by {{.CreatedBy}}{{end}}
+                                </div>
+                                {{end}}
                             </div>
                             <div class="snapshot-actions">
-                                <button class="btn btn-restore" onclick="restoreSnapshot('{{.Filename}}')">Restore</button>
+                                <button class="btn btn-restore" onclick="pinSnapshot('{{.Filename}}', {{if .Meta}}{{not .Meta.Pinned}}{{else}}true{{end}})" title="Pinned snapshots are never pruned">{{if .Meta}}{{if .Meta.Pinned}}Unpin{{else}}Pin{{end}}{{else}}Pin{{end}}</button>
+                                <button class="btn btn-restore" onclick="restoreSnapshot('{{.Filename}}', '{{with .Meta}}{{with .Scope}}{{.String}}{{end}}{{end}}')">Restore</button>
+                                <button class="btn btn-restore" onclick="restoreSideDatabase('{{.Filename}}', '{{$.PostgresDB}}_{{slice .Date 0 10}}')" title="Restore into a separate database next to {{$.PostgresDB}}">Restore as…</button>
+                                <button class="btn btn-restore" onclick="verifySnapshot('{{.Filename}}')" title="Test-restore into a throwaway database">Verify</button>
+                                {{if $.Remote}}<button class="btn btn-restore" onclick="pushSnapshot('{{.Filename}}')" title="Upload to {{$.Remote}}">Push</button>{{end}}
+                                <button class="btn btn-restore" onclick="inspectSnapshot('{{.Filename}}', this)" title="List the schemas, tables and extensions in this snapshot">Inspect</button>
+                                <button class="btn btn-restore" onclick="schemaDiffSnapshot('{{.Filename}}', this)" title="Show how restoring this snapshot would change the schema of {{$.PostgresDB}}">Schema diff</button>
+                                <button class="btn btn-restore" onclick="downloadSnapshot('{{.Filename}}')">Download</button>
                                 <button class="btn btn-delete" onclick="deleteSnapshot('{{.Filename}}')">Delete</button>
                             </div>
                         </div>
+                        <div class="snapshot-contents"></div>
                         {{end}}
                     {{else}}
                         <div class="empty-state">No snapshots yet</div>
                     {{end}}
                 </div>
+                {{if .Environments}}
+                <h3 style="margin-top: 20px;">Environment snapshots</h3>
+                {{range .Environments}}
+                <div class="snapshot-item">
+                    <div class="snapshot-info">
+                        <div class="snapshot-name">{{.Filename}}</div>
+                        <div class="snapshot-meta">{{.Size}} • {{.Date}}</div>
+                        {{with .Manifest}}
+                        {{if .Notes}}<div class="snapshot-notes">{{.Notes}}</div>{{end}}
+                        <div class="snapshot-meta">
+                            {{with .Postgres}}🐘 {{.Database}}{{with .Meta}} ({{.TableCount}} tables){{end}} • {{end}}
+                            {{with .Valkey}}Valkey {{.Keys}} keys • {{end}}
+                            {{with .Workspace}}⎇ {{if .Branch}}{{.Branch}} @ {{end}}{{printf "%.8s" .Commit}}{{if .DiffFile}} + uncommitted changes{{end}}{{end}}
+                            {{range $name, $reason := .Skipped}} • <span title="{{$reason}}">no {{$name}}</span>{{end}}
+                        </div>
+                        {{end}}
+                    </div>
+                    <div class="snapshot-actions">
+                        <button class="btn btn-restore" onclick="restoreEnvironment('{{.Filename}}')">Restore</button>
+                        <button class="btn btn-delete" onclick="deleteEnvironment('{{.Filename}}')">Delete</button>
+                    </div>
+                </div>
+                {{end}}
+                {{end}}
+            </div>
+
+            {{if or .Schedules .ScheduleErrors}}
+            <div class="card">
+                <h2>Schedules</h2>
+                {{range .Schedules}}
+                <div class="service">
+                    <div>
+                        <div class="service-name">{{.Name}}: {{.Expr}}</div>
+                        <div class="snapshot-meta">
+                            Next: {{if .NextRun.IsZero}}never{{else}}{{.NextRun.Format "2006-01-02 15:04"}}{{end}}
+                            {{if not .LastRun.IsZero}}• Last: {{.LastRun.Format "2006-01-02 15:04"}} ({{.LastResult}}){{end}}
+                        </div>
+                    </div>
+                </div>
+                {{end}}
+                {{range .ScheduleErrors}}
+                <div class="job-log job-error">{{.}}</div>
+                {{end}}
+            </div>
+            {{end}}
+
+            {{if .SideDatabases}}
+            <div class="card">
+                <h2>Side Databases</h2>
+                <div class="retention-row">
+                    <span class="snapshot-meta">Snapshots restored next to {{.PostgresDB}}</span>
+                    <button class="btn btn-restore" onclick="openInPgweb('{{.PostgresDB}}')">pgweb: {{.PostgresDB}}</button>
+                </div>
+                <div style="margin-top: 20px;">
+                    {{range .SideDatabases}}
+                    <div class="snapshot-item">
+                        <div class="snapshot-info">
+                            <div class="snapshot-name">{{.Name}}</div>
+                            <div class="snapshot-meta">from {{.Snapshot}} • {{.Size}}</div>
+                        </div>
+                        <div class="snapshot-actions">
+                            <button class="btn btn-restore" onclick="openInPgweb('{{.Name}}')">Open in pgweb</button>
+                            <button class="btn btn-delete" onclick="dropSideDatabase('{{.Name}}')">Drop</button>
+                        </div>
+                    </div>
+                    {{end}}
+                </div>
+            </div>
+            {{end}}
+
+            {{if .Branches}}
+            <div class="card">
+                <h2>Database Branches</h2>
+                <div class="input-group">
+                    <input type="text" id="branchName" placeholder="New branch name">
+                </div>
+                <button class="btn btn-create" onclick="createBranch()">Branch from active</button>
+                {{if .BranchAutoSwitch}}<div class="snapshot-meta" style="margin-top: 10px;">Following the git branch checked out in /workspace</div>{{end}}
+                <div style="margin-top: 20px;">
+                    {{range .Branches}}
+                    <div class="snapshot-item">
+                        <div class="snapshot-info">
+                            <div class="snapshot-name">⎇ {{.Name}}{{if .Active}} <span class="snapshot-badge">active</span>{{end}}</div>
+                            <div class="snapshot-meta">{{.Database}} • {{.Size}}</div>
+                        </div>
+                        {{if not .Active}}
+                        <div class="snapshot-actions">
+                            <button class="btn btn-restore" onclick="switchBranch('{{.Name}}')">Switch</button>
+                            <button class="btn btn-delete" onclick="deleteBranch('{{.Name}}')">Delete</button>
+                        </div>
+                        {{end}}
+                    </div>
+                    {{end}}
+                </div>
+            </div>
+            {{end}}
+
+            <div class="card">
+                <h2>Jobs</h2>
+                <div id="jobList">
+                    <div class="empty-state">No recent jobs</div>
+                </div>
             </div>
         </div>
     </div>
@@ -668,6 +1246,16 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
             });
         }
 
+        async function showPrompt(title, message, value) {
+            const group = document.getElementById('modalInputGroup');
+            const input = document.getElementById('modalInput');
+            input.value = value;
+            group.style.display = 'block';
+            const confirmed = await showConfirm(title, message);
+            group.style.display = 'none';
+            return confirmed ? input.value.trim() : null;
+        }
+
         async function toggleFunnel(currentlyEnabled) {
             if (!currentlyEnabled) {
                 const confirmed = await showConfirm(
@@ -690,67 +1278,1232 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
                 .catch(err => showToast('ERROR', String(err), 'error'));
         }
 
-        function createSnapshot() {
-            const label = document.getElementById('snapshotLabel').value;
-            fetch(basePath + '/api/snapshots/create?label=' + encodeURIComponent(label), { method: 'POST' })
+        // Background jobs (snapshot and restore)
+        const jobSources = {};
+        const jobs = {};
+
+        function renderJobs() {
+            const list = document.getElementById('jobList');
+            const items = Object.values(jobs).sort((a, b) => {
+                if ((a.Status === 'running') !== (b.Status === 'running')) {
+                    return a.Status === 'running' ? -1 : 1;
+                }
+                return new Date(b.StartedAt) - new Date(a.StartedAt);
+            });
+            list.innerHTML = '';
+            if (items.length === 0) {
+                list.innerHTML = '<div class="empty-state">No recent jobs</div>';
+                return;
+            }
+            items.forEach(job => {
+                const item = document.createElement('div');
+                item.className = 'job-item';
+
+                const header = document.createElement('div');
+                header.className = 'job-header';
+                const name = document.createElement('div');
+                name.className = 'snapshot-name';
+                name.textContent = job.Kind + ' · ' + job.Target;
+                const badge = document.createElement('span');
+                badge.className = 'status-badge status-' + job.Status;
+                badge.textContent = job.Status;
+                header.appendChild(name);
+                header.appendChild(badge);
+                if (job.Status === 'running') {
+                    const cancel = document.createElement('button');
+                    cancel.className = 'btn btn-delete';
+                    cancel.textContent = 'Cancel';
+                    cancel.onclick = () => cancelJob(job.ID);
+                    header.appendChild(cancel);
+                }
+                item.appendChild(header);
+
+                const meta = document.createElement('div');
+                meta.className = 'snapshot-meta';
+                let progress = formatBytes(job.Bytes);
+                if (job.TotalBytes > 0) {
+                    progress += ' / ' + formatBytes(job.TotalBytes);
+                }
+                if (job.CurrentTable) {
+                    progress += ' • ' + job.CurrentTable;
+                }
+                meta.textContent = progress;
+                item.appendChild(meta);
+
+                const log = document.createElement('div');
+                log.className = 'job-log';
+                log.textContent = job.Error || job.LastLog || '';
+                log.title = log.textContent;
+                item.appendChild(log);
+
+                if (job.Status === 'running' && job.BlockedBy && job.BlockedBy.length) {
+                    const blocked = document.createElement('div');
+                    blocked.className = 'job-log job-error';
+                    blocked.textContent = 'Waiting for session(s) ' + job.BlockedBy.join(', ') + ' ';
+                    const terminate = document.createElement('button');
+                    terminate.className = 'btn btn-delete';
+                    terminate.textContent = 'Terminate blocking sessions';
+                    terminate.onclick = () => terminateSessions(job.BlockedBy);
+                    blocked.appendChild(terminate);
+                    item.appendChild(blocked);
+                }
+
+                (job.Errors || []).forEach(err => {
+                    const line = document.createElement('div');
+                    line.className = 'job-log job-error';
+                    line.textContent = (err.Location ? err.Location + ': ' : '') + err.Message +
+                        (err.Statement ? ' — ' + err.Statement : '');
+                    line.title = line.textContent;
+                    item.appendChild(line);
+                });
+
+                list.appendChild(item);
+            });
+        }
+
+        function formatBytes(bytes) {
+            const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+            let i = 0;
+            while (bytes >= 1024 && i < units.length - 1) {
+                bytes /= 1024;
+                i++;
+            }
+            return (i === 0 ? bytes : bytes.toFixed(1)) + ' ' + units[i];
+        }
+
+        function watchJob(id, onDone) {
+            if (jobSources[id]) return;
+            const source = new EventSource(basePath + '/api/jobs/events?id=' + encodeURIComponent(id));
+            jobSources[id] = source;
+            source.addEventListener('job', e => {
+                const job = JSON.parse(e.data);
+                jobs[job.ID] = job;
+                renderJobs();
+                if (job.Status !== 'running') {
+                    source.close();
+                    delete jobSources[id];
+                    if (onDone) onDone(job);
+                }
+            });
+            source.onerror = () => {
+                source.close();
+                delete jobSources[id];
+            };
+        }
+
+        function loadJobs() {
+            fetch(basePath + '/api/jobs')
                 .then(r => r.json())
                 .then(data => {
-                    if (data.success) {
-                        showToast('SNAPSHOT CREATED', 'Snapshot saved: ' + data.filename, 'success');
-                        setTimeout(() => location.reload(), 1500);
-                    } else {
+                    (data.jobs || []).forEach(job => {
+                        jobs[job.ID] = job;
+                        if (job.Status === 'running') watchJob(job.ID);
+                    });
+                    renderJobs();
+                });
+        }
+
+        function cancelJob(id) {
+            fetch(basePath + '/api/jobs/cancel?id=' + encodeURIComponent(id), { method: 'POST' })
+                .then(r => r.json())
+                .then(data => {
+                    if (!data.success) {
                         showToast('ERROR', data.error, 'error');
                     }
                 });
         }
 
-        async function restoreSnapshot(filename) {
-            const confirmed = await showConfirm(
-                '⚠️ RESTORE DATABASE',
-                'Restore from ' + filename + '?\n\nThis will DROP ALL current data!\n\nThis action cannot be undone.'
-            );
-            if (!confirmed) return;
+        // Sessions on the live database, excluding devbox-status itself
+        function connectedSessions() {
+            return fetch(basePath + '/api/connections?database=' + encodeURIComponent('{{.PostgresDB}}'))
+                .then(r => r.json())
+                .then(data => (data.sessions || []).filter(s => s.Application !== 'devbox-status'))
+                .catch(() => []);
+        }
 
-            fetch(basePath + '/api/snapshots/restore?filename=' + encodeURIComponent(filename), { method: 'POST' })
+        function loadConnections() {
+            const list = document.getElementById('connectionList');
+            const all = document.getElementById('connectionsAll').checked;
+            fetch(basePath + '/api/connections' + (all ? '' : '?database=' + encodeURIComponent('{{.PostgresDB}}')))
                 .then(r => r.json())
                 .then(data => {
-                    if (data.success) {
-                        showToast('DATABASE RESTORED', 'Successfully restored from snapshot', 'success');
-                        setTimeout(() => location.reload(), 1500);
-                    } else {
-                        showToast('ERROR', data.error, 'error');
+                    list.innerHTML = '';
+                    if (!data.success) {
+                        list.innerHTML = '<div class="job-log job-error"></div>';
+                        list.firstChild.textContent = data.error;
+                        return;
                     }
+                    if (!data.sessions.length) {
+                        list.innerHTML = '<div class="empty-state">No sessions</div>';
+                        return;
+                    }
+                    data.sessions.forEach(s => {
+                        const item = document.createElement('div');
+                        item.className = 'snapshot-item';
+                        const info = document.createElement('div');
+                        info.className = 'snapshot-info';
+                        info.style.minWidth = '0';
+
+                        const name = document.createElement('div');
+                        name.className = 'snapshot-name';
+                        name.textContent = 'pid ' + s.PID + ' · ' + (s.Application || 'unnamed') + ' · ' + s.Database;
+                        info.appendChild(name);
+
+                        const meta = document.createElement('div');
+                        meta.className = 'snapshot-meta';
+                        meta.textContent = s.State + ' ' + s.Duration + ' • ' + s.User + '@' + s.Client +
+                            (s.XactSeconds > 0 ? ' • transaction open ' + Math.round(s.XactSeconds) + 's' : '') +
+                            (s.WaitEvent ? ' • waiting on ' + s.WaitEvent : '');
+                        info.appendChild(meta);
+
+                        if (s.BlockedBy || s.Blocking || s.WaitingFor) {
+                            const locks = document.createElement('div');
+                            locks.className = 'job-log job-error';
+                            const parts = [];
+                            if (s.WaitingFor) parts.push('wants ' + s.WaitingFor);
+                            if (s.BlockedBy) parts.push('blocked by ' + s.BlockedBy.join(', '));
+                            if (s.Blocking) parts.push('blocking ' + s.Blocking.join(', '));
+                            locks.textContent = parts.join(' • ');
+                            info.appendChild(locks);
+                        }
+
+                        const query = document.createElement('div');
+                        query.className = 'job-log';
+                        query.textContent = s.Query;
+                        query.title = s.Query;
+                        info.appendChild(query);
+                        item.appendChild(info);
+
+                        const actions = document.createElement('div');
+                        actions.className = 'snapshot-actions';
+                        const cancel = document.createElement('button');
+                        cancel.className = 'btn btn-restore';
+                        cancel.textContent = 'Cancel';
+                        cancel.title = 'Cancel the running query (pg_cancel_backend)';
+                        cancel.disabled = s.State !== 'active';
+                        cancel.onclick = () => signalSession('cancel', [s.PID]);
+                        const terminate = document.createElement('button');
+                        terminate.className = 'btn btn-delete';
+                        terminate.textContent = 'Terminate';
+                        terminate.title = 'Close the connection (pg_terminate_backend)';
+                        terminate.onclick = () => terminateSessions([s.PID]);
+                        actions.appendChild(cancel);
+                        actions.appendChild(terminate);
+                        item.appendChild(actions);
+                        list.appendChild(item);
+                    });
                 });
         }
 
-        async function deleteSnapshot(filename) {
+        async function terminateSessions(pids) {
             const confirmed = await showConfirm(
-                'DELETE SNAPSHOT',
-                'Delete ' + filename + '?\n\nThis action cannot be undone.'
+                'TERMINATE SESSIONS',
+                'Terminate session(s) ' + pids.join(', ') + '?\n\nTheir open transactions are rolled back and the clients have to reconnect.'
             );
             if (!confirmed) return;
+            signalSession('terminate', pids);
+        }
 
-            fetch(basePath + '/api/snapshots/delete?filename=' + encodeURIComponent(filename), { method: 'POST' })
-                .then(r => r.json())
+        function signalSession(action, pids) {
+            fetch(basePath + '/api/connections/' + action + '?pid=' + pids.join(','), { method: 'POST' })
+                .then(r => r.ok ? r.json() : r.text().then(text => ({ success: false, error: text })))
                 .then(data => {
                     if (data.success) {
-                        showToast('DELETED', 'Snapshot deleted successfully', 'success');
-                        setTimeout(() => location.reload(), 1500);
+                        showToast(action === 'cancel' ? 'QUERY CANCELLED' : 'SESSION TERMINATED', 'pid ' + pids.join(', '), 'success');
                     } else {
                         showToast('ERROR', data.error, 'error');
                     }
+                    loadConnections();
                 });
         }
-    </script>
-</body>
-</html>`
 
-	t := template.Must(template.New("status").Parse(tmpl))
-	w.Header().Set("Content-Type", "text/html")
-	t.Execute(w, status)
-}
+        function formatMs(ms) {
+            if (ms >= 1000) return (ms / 1000).toFixed(2) + ' s';
+            return ms.toFixed(ms < 10 ? 2 : 0) + ' ms';
+        }
 
-func handleAPIStatus(w http.ResponseWriter, r *http.Request) {
+        // Builds a table from a header row and rows of cells; a cell is text
+        // or {text, title, className}
+        function buildTable(headers, rows) {
+            const table = document.createElement('table');
+            table.className = 'overview-table';
+            const head = document.createElement('tr');
+            headers.forEach(h => {
+                const th = document.createElement('th');
+                th.textContent = h.text || h;
+                if (h.className) th.className = h.className;
+                head.appendChild(th);
+            });
+            table.appendChild(head);
+            rows.forEach(cells => {
+                const tr = document.createElement('tr');
+                cells.forEach(cell => {
+                    const td = document.createElement('td');
+                    if (typeof cell === 'object') {
+                        td.textContent = cell.text;
+                        if (cell.title) td.title = cell.title;
+                        if (cell.className) td.className = cell.className;
+                    } else {
+                        td.textContent = cell;
+                    }
+                    tr.appendChild(td);
+                });
+                table.appendChild(tr);
+            });
+            return table;
+        }
+
+        function queryCell(query) {
+            return { text: query.length > 90 ? query.slice(0, 90) + '…' : query, title: query };
+        }
+
+        function showStatementError(error) {
+            const list = document.getElementById('statementList');
+            list.innerHTML = '<div class="job-log job-error"></div>';
+            list.firstChild.textContent = error;
+        }
+
+        function loadStatements() {
+            const order = document.getElementById('statementOrder').value;
+            fetch(basePath + '/api/statements?order=' + order)
+                .then(r => r.json())
+                .then(data => {
+                    if (!data.success) {
+                        showStatementError(data.error);
+                        return;
+                    }
+                    document.getElementById('statementBaseline').textContent = data.baseline ?
+                        'Baseline' + (data.baseline.label ? ' "' + data.baseline.label + '"' : '') + ' captured ' +
+                        new Date(data.baseline.captured_at).toLocaleString() + ' (' + data.baseline.statements + ' queries)' : '';
+                    const list = document.getElementById('statementList');
+                    list.innerHTML = '';
+                    if (!data.statements.length) {
+                        list.innerHTML = '<div class="empty-state">No queries recorded yet</div>';
+                        return;
+                    }
+                    list.appendChild(buildTable(
+                        ['Query', { text: 'Calls', className: 'num' }, { text: 'Total', className: 'num' }, { text: 'Mean', className: 'num' }, { text: 'Rows', className: 'num' }, { text: 'Cache hit', className: 'num' }],
+                        data.statements.map(s => [
+                            queryCell(s.Query),
+                            { text: String(s.Calls), className: 'num' },
+                            { text: formatMs(s.TotalMs), className: 'num' },
+                            { text: formatMs(s.MeanMs), className: 'num' },
+                            { text: String(s.Rows), className: 'num' },
+                            { text: s.BlocksHit + s.BlocksRead ? Math.round(100 * s.BlocksHit / (s.BlocksHit + s.BlocksRead)) + '%' : '', className: 'num' }
+                        ])
+                    ));
+                });
+        }
+
+        async function resetStatements() {
+            const confirmed = await showConfirm('RESET QUERY STATISTICS', 'Clear the statistics of every query?\n\nA captured baseline is kept.');
+            if (!confirmed) return;
+            fetch(basePath + '/api/statements/reset', { method: 'POST' })
+                .then(r => r.json())
+                .then(data => {
+                    if (data.success) {
+                        showToast('STATISTICS RESET', 'Query statistics cleared', 'success');
+                        loadStatements();
+                    } else {
+                        showToast('ERROR', data.error, 'error');
+                    }
+                });
+        }
+
+        async function captureBaseline() {
+            const label = await showPrompt('CAPTURE BASELINE', 'Save the current query statistics as the baseline?\n\nThis replaces the previous baseline. Label (optional):', '');
+            if (label === null) return;
+            fetch(basePath + '/api/statements/baseline?label=' + encodeURIComponent(label), { method: 'POST' })
+                .then(r => r.json())
+                .then(data => {
+                    if (data.success) {
+                        showToast('BASELINE CAPTURED', data.statements + ' queries', 'success');
+                        loadStatements();
+                    } else {
+                        showToast('ERROR', data.error, 'error');
+                    }
+                });
+        }
+
+        function compareStatements() {
+            fetch(basePath + '/api/statements/compare')
+                .then(r => r.json())
+                .then(data => {
+                    if (!data.success) {
+                        showToast('ERROR', data.error, 'error');
+                        return;
+                    }
+                    const list = document.getElementById('statementList');
+                    list.innerHTML = '';
+                    if (!data.comparisons.length) {
+                        list.innerHTML = '<div class="empty-state">No queries to compare</div>';
+                        return;
+                    }
+                    list.appendChild(buildTable(
+                        ['Query', { text: 'Calls before', className: 'num' }, { text: 'Calls after', className: 'num' }, { text: 'Mean before', className: 'num' }, { text: 'Mean after', className: 'num' }, { text: 'Change', className: 'num' }],
+                        data.comparisons.map(c => {
+                            let change = '';
+                            let cls = 'num';
+                            if (!c.Baseline) {
+                                change = 'new';
+                            } else if (!c.Current) {
+                                change = 'not run';
+                            } else if (c.MeanChange) {
+                                change = (c.MeanChange > 0 ? '+' : '') + Math.round(c.MeanChange * 100) + '%';
+                                if (c.MeanChange > 0.2) cls += ' dead-high';
+                            }
+                            return [
+                                queryCell(c.Query),
+                                { text: c.Baseline ? String(c.Baseline.Calls) : '', className: 'num' },
+                                { text: c.Current ? String(c.Current.Calls) : '', className: 'num' },
+                                { text: c.Baseline ? formatMs(c.Baseline.MeanMs) : '', className: 'num' },
+                                { text: c.Current ? formatMs(c.Current.MeanMs) : '', className: 'num' },
+                                { text: change, className: cls }
+                            ];
+                        })
+                    ));
+                });
+        }
+
+        function planNode(node) {
+            const div = document.createElement('div');
+            div.className = 'plan-node' + (node.Hot ? ' hot' : '');
+            const line = document.createElement('div');
+            line.className = 'plan-line';
+            const type = document.createElement('span');
+            type.className = 'plan-type';
+            let name = node['Node Type'];
+            if (node['Join Type'] && node['Node Type'].endsWith('Join')) name = node['Join Type'] + ' ' + name;
+            type.textContent = name;
+            line.appendChild(type);
+            let text = '';
+            if (node['Index Name']) text += ' using ' + node['Index Name'];
+            if (node['Relation Name']) {
+                text += ' on ' + node['Relation Name'];
+                if (node.Alias && node.Alias !== node['Relation Name']) text += ' ' + node.Alias;
+            }
+            const loops = node['Actual Loops'] || 1;
+            text += '  —  ' + formatMs(node.SelfMs) + ' (' + node.Percent.toFixed(1) + '%)';
+            text += ', rows ' + node['Actual Rows'] + ' of ' + node['Plan Rows'] + ' estimated';
+            if (loops > 1) text += ' × ' + loops + ' loops';
+            const blocks = (node['Shared Hit Blocks'] || 0) + (node['Shared Read Blocks'] || 0);
+            if (blocks) text += ', ' + blocks + ' blocks (' + (node['Shared Read Blocks'] || 0) + ' read)';
+            line.appendChild(document.createTextNode(text));
+            div.appendChild(line);
+
+            const details = [];
+            if (node['Index Cond']) details.push('Index Cond: ' + node['Index Cond']);
+            if (node['Hash Cond']) details.push('Hash Cond: ' + node['Hash Cond']);
+            if (node['Join Filter']) details.push('Join Filter: ' + node['Join Filter']);
+            if (node.Filter) details.push('Filter: ' + node.Filter + (node['Rows Removed by Filter'] ? ' (removed ' + node['Rows Removed by Filter'] + ' rows)' : ''));
+            if (node['Sort Key']) details.push('Sort Key: ' + node['Sort Key'].join(', ') + (node['Sort Method'] ? ' (' + node['Sort Method'] + ', ' + node['Sort Space Type'] + ')' : ''));
+            if (details.length) {
+                const detail = document.createElement('div');
+                detail.className = 'plan-detail';
+                detail.textContent = details.join('\n');
+                div.appendChild(detail);
+            }
+            (node.Warnings || []).forEach(w => {
+                const warning = document.createElement('div');
+                warning.className = 'plan-warning';
+                warning.textContent = '⚠ ' + w;
+                div.appendChild(warning);
+            });
+            (node.Plans || []).forEach(child => div.appendChild(planNode(child)));
+            return div;
+        }
+
+        function runExplain() {
+            const sql = document.getElementById('explainSQL').value;
+            if (!sql.trim()) return;
+            const target = document.getElementById('explainResult');
+            target.innerHTML = '<div class="empty-state">Running…</div>';
+            fetch(basePath + '/api/explain', { method: 'POST', body: new URLSearchParams({ sql: sql }) })
+                .then(r => r.json())
+                .then(data => {
+                    target.innerHTML = '';
+                    if (!data.success) {
+                        target.innerHTML = '<div class="job-log job-error"></div>';
+                        target.firstChild.textContent = data.error;
+                        return;
+                    }
+                    const result = data.result;
+                    const summary = document.createElement('div');
+                    summary.className = 'snapshot-meta';
+                    summary.textContent = 'Planning ' + formatMs(result.PlanningMs) + ', execution ' + formatMs(result.ExecutionMs) + ' — rolled back';
+                    target.appendChild(summary);
+                    result.Warnings.forEach(w => {
+                        const warning = document.createElement('div');
+                        warning.className = 'job-log job-error';
+                        warning.textContent = w;
+                        target.appendChild(warning);
+                    });
+                    const tree = planNode(result.Plan);
+                    tree.style.borderLeft = 'none';
+                    tree.style.paddingLeft = '0';
+                    target.appendChild(tree);
+                });
+        }
+
+        function createSnapshot() {
+            const label = document.getElementById('snapshotLabel').value;
+            const notes = document.getElementById('snapshotNotes').value;
+            const format = document.getElementById('snapshotFormat').value;
+            const compress = document.getElementById('snapshotCompress').value;
+            const params = new URLSearchParams({ label: label, notes: notes, format: format, compress: compress });
+            const anonymize = document.getElementById('snapshotAnonymize');
+            if (anonymize && anonymize.value) params.set('anonymize', anonymize.value);
+            const encrypt = document.getElementById('snapshotEncrypt');
+            if (encrypt && !encrypt.checked) params.set('encrypt', '0');
+            const contents = document.getElementById('snapshotContents').value;
+            if (contents) params.set(contents, '1');
+            [['table', 'snapshotTables'], ['exclude_table', 'snapshotExcludeTables'], ['schema', 'snapshotSchemas'],
+             ['exclude_schema', 'snapshotExcludeSchemas'], ['exclude_table_data', 'snapshotExcludeTableData']].forEach(([name, id]) => {
+                const value = document.getElementById(id).value.trim();
+                if (value) params.set(name, value);
+            });
+            fetch(basePath + '/api/snapshots/create?' + params.toString(), { method: 'POST' })
+                .then(r => r.json())
+                .then(data => {
+                    if (data.success) {
+                        showToast('SNAPSHOT STARTED', 'Writing ' + data.filename, 'success');
+                        watchJob(data.job_id, job => {
+                            if (job.Status === 'succeeded') {
+                                showToast('SNAPSHOT CREATED', 'Snapshot saved: ' + data.filename, 'success');
+                                setTimeout(() => location.reload(), 1500);
+                            } else {
+                                showToast('SNAPSHOT ' + job.Status.toUpperCase(), job.Error, 'error');
+                            }
+                        });
+                    } else {
+                        showToast('ERROR', data.error, 'error');
+                    }
+                });
+        }
+
+        function createEnvironment() {
+            const params = new URLSearchParams({
+                label: document.getElementById('snapshotLabel').value,
+                notes: document.getElementById('snapshotNotes').value
+            });
+            fetch(basePath + '/api/environments/create?' + params.toString(), { method: 'POST' })
+                .then(r => r.json())
+                .then(data => {
+                    if (!data.success) {
+                        showToast('ERROR', data.error, 'error');
+                        return;
+                    }
+                    showToast('ENVIRONMENT SNAPSHOT STARTED', 'Writing ' + data.filename, 'success');
+                    watchJob(data.job_id, job => {
+                        if (job.Status === 'succeeded') {
+                            showToast('ENVIRONMENT SNAPSHOT CREATED', 'Saved: ' + data.filename, 'success');
+                            setTimeout(() => location.reload(), 1500);
+                        } else {
+                            showToast('ENVIRONMENT SNAPSHOT ' + job.Status.toUpperCase(), job.Error, 'error');
+                        }
+                    });
+                });
+        }
+
+        async function restoreEnvironment(filename) {
+            const confirmed = await showConfirm(
+                'RESTORE ENVIRONMENT',
+                'Restore ' + filename + '?\n\nThis replaces the database and every Valkey key, and checks out the saved commit in /workspace. Local changes are stashed first.'
+            );
+            if (!confirmed) return;
+
+            fetch(basePath + '/api/environments/restore?filename=' + encodeURIComponent(filename), { method: 'POST' })
+                .then(r => r.ok ? r.json() : r.text().then(text => ({ success: false, error: text })))
+                .then(data => {
+                    if (!data.success) {
+                        showToast('ERROR', data.error, 'error');
+                        return;
+                    }
+                    showToast('RESTORE STARTED', filename, 'success');
+                    watchJob(data.job_id, job => {
+                        if (job.Status === 'succeeded') {
+                            showToast('ENVIRONMENT RESTORED', filename, 'success');
+                            setTimeout(() => location.reload(), 1500);
+                        } else {
+                            showToast('RESTORE ' + job.Status.toUpperCase(), job.Error, 'error');
+                        }
+                    });
+                });
+        }
+
+        async function deleteEnvironment(filename) {
+            const confirmed = await showConfirm(
+                'DELETE ENVIRONMENT SNAPSHOT',
+                'Delete ' + filename + '?\n\nThis action cannot be undone.'
+            );
+            if (!confirmed) return;
+
+            fetch(basePath + '/api/environments/delete?filename=' + encodeURIComponent(filename), { method: 'POST' })
+                .then(r => r.ok ? r.json() : r.text().then(text => ({ success: false, error: text })))
+                .then(data => {
+                    if (data.success) {
+                        showToast('DELETED', 'Environment snapshot deleted', 'success');
+                        setTimeout(() => location.reload(), 1500);
+                    } else {
+                        showToast('ERROR', data.error, 'error');
+                    }
+                });
+        }
+
+        function createSubset() {
+            const roots = document.getElementById('subsetRoots').value.split(';').map(r => r.trim()).filter(r => r);
+            if (!roots.length) {
+                showToast('ERROR', 'Enter at least one root table, e.g. users WHERE id = 1', 'error');
+                return;
+            }
+            const params = new URLSearchParams({
+                label: document.getElementById('snapshotLabel').value,
+                notes: document.getElementById('snapshotNotes').value
+            });
+            roots.forEach(root => params.append('root', root));
+            if (document.getElementById('subsetChildren').checked) params.set('children', '1');
+            fetch(basePath + '/api/snapshots/subset?' + params.toString(), { method: 'POST' })
+                .then(r => r.ok ? r.json() : r.text().then(text => ({ success: false, error: text })))
+                .then(data => {
+                    if (data.success) {
+                        showToast('SUBSET STARTED', 'Writing ' + data.filename, 'success');
+                        watchJob(data.job_id, job => {
+                            if (job.Status === 'succeeded') {
+                                showToast('SUBSET CREATED', 'Snapshot saved: ' + data.filename, 'success');
+                                setTimeout(() => location.reload(), 1500);
+                            } else {
+                                showToast('SUBSET ' + job.Status.toUpperCase(), job.Error, 'error');
+                            }
+                        });
+                    } else {
+                        showToast('ERROR', data.error, 'error');
+                    }
+                });
+        }
+
+        async function restoreSnapshot(filename, partial) {
+            const sessions = await connectedSessions();
+            const confirmed = await showConfirm(
+                '⚠️ RESTORE DATABASE',
+                'Restore from ' + filename + '?\n\nThis will REPLACE ALL current data!' +
+                (partial ? '\n\nThis is a PARTIAL snapshot (' + partial + '). Anything it does not contain will be missing after the restore.' : '') +
+                '\n\nA pre-restore snapshot of the current data is taken first so the restore can be undone.' +
+                (sessions.length ? '\n\n' + sessions.length + ' session(s) are connected to {{.PostgresDB}}: ' +
+                    sessions.map(s => (s.Application || 'pid ' + s.PID) + ' (' + s.State + ')').join(', ') +
+                    '. They are terminated when the restore swaps databases; the job offers to terminate them sooner if they hold it up.' : '')
+            );
+            if (!confirmed) return;
+
+            fetch(basePath + '/api/snapshots/restore?filename=' + encodeURIComponent(filename) + (partial ? '&partial=1' : ''), { method: 'POST' })
+                .then(r => r.json())
+                .then(data => {
+                    if (data.success) {
+                        showToast('RESTORE STARTED', 'Restoring from ' + filename, 'success');
+                        if (data.warning) showToast('PARTIAL SNAPSHOT', data.warning, 'warning');
+                        watchJob(data.job_id, job => {
+                            if (job.Status === 'succeeded') {
+                                showToast('DATABASE RESTORED', 'Successfully restored from snapshot', 'success');
+                                setTimeout(() => location.reload(), 1500);
+                            } else {
+                                showToast('RESTORE ' + job.Status.toUpperCase(), job.Error, 'error');
+                            }
+                        });
+                    } else {
+                        showToast('ERROR', data.error, 'error');
+                    }
+                });
+        }
+
+        async function restoreSideDatabase(filename, suggested) {
+            const target = await showPrompt(
+                'RESTORE AS SIDE DATABASE',
+                'Restore ' + filename + ' into a new database?\n\nThe current database is not touched.',
+                suggested.replace(/-/g, '_')
+            );
+            if (!target) return;
+
+            fetch(basePath + '/api/snapshots/restore?filename=' + encodeURIComponent(filename) + '&target=' + encodeURIComponent(target), { method: 'POST' })
+                .then(r => r.json())
+                .then(data => {
+                    if (data.success) {
+                        showToast('RESTORE STARTED', 'Restoring ' + filename + ' into ' + target, 'success');
+                        if (data.warning) showToast('PARTIAL SNAPSHOT', data.warning, 'warning');
+                        watchJob(data.job_id, job => {
+                            if (job.Status === 'succeeded') {
+                                showToast('DATABASE RESTORED', filename + ' is available as ' + target, 'success');
+                                setTimeout(() => location.reload(), 1500);
+                            } else {
+                                showToast('RESTORE ' + job.Status.toUpperCase(), job.Error, 'error');
+                            }
+                        });
+                    } else {
+                        showToast('ERROR', data.error, 'error');
+                    }
+                });
+        }
+
+        function openInPgweb(name) {
+            fetch(basePath + '/api/pgweb/open?db=' + encodeURIComponent(name), { method: 'POST' })
+                .then(r => r.json())
+                .then(data => {
+                    if (data.success) {
+                        window.open(data.url, '_blank');
+                    } else {
+                        showToast('ERROR', data.error, 'error');
+                    }
+                });
+        }
+
+        async function dropSideDatabase(name) {
+            const confirmed = await showConfirm(
+                'DROP DATABASE',
+                'Drop ' + name + '?\n\nThis action cannot be undone.'
+            );
+            if (!confirmed) return;
+
+            fetch(basePath + '/api/sidedbs/drop?name=' + encodeURIComponent(name), { method: 'POST' })
+                .then(r => r.json())
+                .then(data => {
+                    if (data.success) {
+                        showToast('DROPPED', name + ' dropped', 'success');
+                        setTimeout(() => location.reload(), 1500);
+                    } else {
+                        showToast('ERROR', data.error, 'error');
+                    }
+                });
+        }
+
+        async function undoRestore(filename) {
+            const confirmed = await showConfirm(
+                '⚠️ UNDO RESTORE',
+                'Put back the data from before the last restore (' + filename + ')?\n\nThe current data will be saved as a new pre-restore snapshot first.'
+            );
+            if (!confirmed) return;
+
+            fetch(basePath + '/api/snapshots/undo', { method: 'POST' })
+                .then(r => r.json())
+                .then(data => {
+                    if (data.success) {
+                        showToast('UNDO STARTED', 'Restoring ' + data.filename, 'success');
+                        watchJob(data.job_id, job => {
+                            if (job.Status === 'succeeded') {
+                                showToast('RESTORE UNDONE', 'Database restored from ' + data.filename, 'success');
+                                setTimeout(() => location.reload(), 1500);
+                            } else {
+                                showToast('UNDO ' + job.Status.toUpperCase(), job.Error, 'error');
+                            }
+                        });
+                    } else {
+                        showToast('ERROR', data.error, 'error');
+                    }
+                });
+        }
+
+        function pinSnapshot(filename, pinned) {
+            fetch(basePath + '/api/snapshots/pin?filename=' + encodeURIComponent(filename) + '&pinned=' + pinned, { method: 'POST' })
+                .then(r => r.json())
+                .then(data => {
+                    if (data.success) {
+                        showToast(pinned ? 'PINNED' : 'UNPINNED', filename, 'success');
+                        setTimeout(() => location.reload(), 1000);
+                    } else {
+                        showToast('ERROR', data.error, 'error');
+                    }
+                });
+        }
+
+        async function previewPrune() {
+            const plan = await fetch(basePath + '/api/snapshots/retention').then(r => r.json());
+            if (plan.Policy === 'disabled') {
+                showToast('RETENTION', 'No retention policy configured', 'warning');
+                return;
+            }
+            if (!plan.Delete || plan.Delete.length === 0) {
+                showToast('RETENTION', 'Nothing to prune (' + plan.Policy + ')', 'success');
+                return;
+            }
+            const confirmed = await showConfirm(
+                'PRUNE SNAPSHOTS',
+                'Retention policy: ' + plan.Policy + '\n\nThese snapshots will be deleted:\n' + plan.Delete.join('\n') + '\n\nPrune now?'
+            );
+            if (!confirmed) return;
+
+            fetch(basePath + '/api/snapshots/prune', { method: 'POST' })
+                .then(r => r.json())
+                .then(data => {
+                    if (data.success) {
+                        showToast('PRUNED', 'Deleted ' + (data.deleted || []).length + ' snapshot(s)', 'success');
+                        setTimeout(() => location.reload(), 1500);
+                    } else {
+                        showToast('ERROR', data.error, 'error');
+                    }
+                });
+        }
+
+        function verifySnapshot(filename) {
+            fetch(basePath + '/api/snapshots/verify?filename=' + encodeURIComponent(filename), { method: 'POST' })
+                .then(r => r.json())
+                .then(data => {
+                    if (data.success) {
+                        showToast('VERIFYING', 'Test-restoring ' + filename, 'success');
+                        watchJob(data.job_id, job => {
+                            if (job.Status === 'succeeded') {
+                                showToast('VERIFIED', filename + ' restores cleanly', 'success');
+                            } else {
+                                showToast('VERIFY ' + job.Status.toUpperCase(), job.Error, 'error');
+                            }
+                            setTimeout(() => location.reload(), 1500);
+                        });
+                    } else {
+                        showToast('ERROR', data.error, 'error');
+                    }
+                });
+        }
+
+        function downloadSnapshot(filename) {
+            window.location.href = basePath + '/api/snapshots/download?filename=' + encodeURIComponent(filename);
+        }
+
+        function inspectSnapshot(filename, button) {
+            const panel = button.closest('.snapshot-item').nextElementSibling;
+            if (panel.style.display === 'block') {
+                panel.style.display = 'none';
+                return;
+            }
+            panel.textContent = 'Reading ' + filename + '...';
+            panel.style.display = 'block';
+            fetch(basePath + '/api/snapshots/inspect?filename=' + encodeURIComponent(filename))
+                .then(r => r.json())
+                .then(data => {
+                    if (!data.success) {
+                        panel.textContent = 'Error: ' + data.error;
+                        return;
+                    }
+                    const c = data.contents;
+                    panel.textContent = '';
+                    const summary = document.createElement('div');
+                    summary.textContent = 'Schemas: ' + ((c.schemas || []).join(', ') || 'none') +
+                        ' • Extensions: ' + ((c.extensions || []).join(', ') || 'none');
+                    panel.appendChild(summary);
+
+                    const table = document.createElement('table');
+                    (c.tables || []).forEach(t => {
+                        const row = table.insertRow();
+                        const name = document.createElement('a');
+                        name.textContent = t.schema + '.' + t.name;
+                        name.title = 'Show DDL';
+                        name.onclick = () => showTableDDL(filename, t.schema + '.' + t.name, pre);
+                        row.insertCell().appendChild(name);
+                        row.insertCell().textContent = t.has_data ? '~' + t.rows.toLocaleString() + ' rows' : 'no data';
+                    });
+                    panel.appendChild(table);
+
+                    const pre = document.createElement('pre');
+                    pre.style.display = 'none';
+                    panel.appendChild(pre);
+                });
+        }
+
+        function showTableDDL(filename, table, pre) {
+            pre.textContent = 'Loading ' + table + '...';
+            pre.style.display = 'block';
+            fetch(basePath + '/api/snapshots/inspect?filename=' + encodeURIComponent(filename) + '&table=' + encodeURIComponent(table))
+                .then(r => r.json())
+                .then(data => {
+                    if (data.success) {
+                        pre.textContent = data.contents.ddl || 'No DDL found for ' + table;
+                    } else {
+                        pre.textContent = 'Error: ' + data.error;
+                    }
+                });
+        }
+
+        function schemaDiffSnapshot(filename, button) {
+            const panel = button.closest('.snapshot-item').nextElementSibling;
+            showSchemaDiff('live', filename, panel);
+        }
+
+        function compareSchemas() {
+            const from = document.getElementById('schemaDiffFrom').value;
+            const to = document.getElementById('schemaDiffTo').value;
+            if (from === to) {
+                showToast('ERROR', 'Choose two different sources to compare', 'error');
+                return;
+            }
+            showSchemaDiff(from, to, document.getElementById('schemaDiffResults'));
+        }
+
+        function showSchemaDiff(from, to, panel) {
+            panel.textContent = 'Comparing ' + from + ' with ' + to + '...';
+            panel.style.display = 'block';
+            fetch(basePath + '/api/schema/diff?from=' + encodeURIComponent(from) + '&to=' + encodeURIComponent(to))
+                .then(r => r.json())
+                .then(data => {
+                    if (!data.success) {
+                        panel.textContent = 'Error: ' + data.error;
+                        return;
+                    }
+                    panel.textContent = '';
+                    const add = (text, cls, indent) => {
+                        const line = document.createElement('div');
+                        line.textContent = text;
+                        if (cls) line.className = cls;
+                        if (indent) line.style.paddingLeft = '16px';
+                        panel.appendChild(line);
+                    };
+                    const d = data.diff;
+                    add('From ' + d.from + ' to ' + d.to + ':');
+                    if (data.identical) {
+                        add('Schemas are identical');
+                        return;
+                    }
+                    const marks = { added: '+', dropped: '-', changed: '~' };
+                    d.tables_added.forEach(t => add('+ table ' + t, 'diff-added'));
+                    d.tables_dropped.forEach(t => add('- table ' + t, 'diff-dropped'));
+                    d.tables_changed.forEach(t => {
+                        add('~ table ' + t.table, 'diff-changed');
+                        [['column', t.columns], ['index', t.indexes], ['constraint', t.constraints]].forEach(([kind, changes]) => {
+                            (changes || []).forEach(c => {
+                                let text = marks[c.change] + ' ' + kind + ' ' + c.name + ': ';
+                                text += c.change === 'changed' ? c.from + ' → ' + c.to : (c.to || c.from);
+                                add(text, 'diff-' + c.change, true);
+                            });
+                        });
+                    });
+                });
+        }
+
+        function compareData() {
+            const from = document.getElementById('schemaDiffFrom').value;
+            const to = document.getElementById('schemaDiffTo').value;
+            const tables = document.getElementById('dataDiffTables').value.trim();
+            const panel = document.getElementById('schemaDiffResults');
+            if (from === to || !tables) {
+                showToast('ERROR', 'Choose two different sources and the tables to compare', 'error');
+                return;
+            }
+            fetch(basePath + '/api/datadiff/start?from=' + encodeURIComponent(from) + '&to=' + encodeURIComponent(to) +
+                    '&tables=' + encodeURIComponent(tables), { method: 'POST' })
+                .then(r => r.json())
+                .then(data => {
+                    if (!data.success) {
+                        showToast('ERROR', data.error, 'error');
+                        return;
+                    }
+                    panel.textContent = 'Loading ' + from + ' and ' + to + ' into throwaway databases...';
+                    panel.style.display = 'block';
+                    watchJob(data.job_id, job => {
+                        if (job.Status === 'succeeded') {
+                            showDataDiff(data.job_id, panel);
+                        } else {
+                            panel.textContent = 'Data diff ' + job.Status + ': ' + job.Error;
+                        }
+                    });
+                });
+        }
+
+        function showDataDiff(id, panel) {
+            fetch(basePath + '/api/datadiff?id=' + encodeURIComponent(id))
+                .then(r => r.ok ? r.json() : r.text().then(text => ({ success: false, error: text })))
+                .then(data => {
+                    if (!data.success) {
+                        panel.textContent = 'Error: ' + data.error;
+                        return;
+                    }
+                    panel.textContent = '';
+                    const d = data.diff;
+                    const header = document.createElement('div');
+                    header.textContent = 'Rows from ' + d.from + ' to ' + d.to + ':';
+                    panel.appendChild(header);
+                    d.tables.forEach(t => {
+                        const line = document.createElement('div');
+                        if (t.error) {
+                            line.textContent = t.table + ': ' + t.error;
+                            line.className = 'diff-dropped';
+                            panel.appendChild(line);
+                            return;
+                        }
+                        const name = document.createElement('a');
+                        name.textContent = t.table;
+                        line.appendChild(name);
+                        line.appendChild(document.createTextNode(': ' + t.inserted + ' inserted, ' + t.deleted +
+                            ' deleted, ' + t.updated + ' updated' + (t.truncated ? ' (list truncated)' : '')));
+                        const rows = document.createElement('div');
+                        name.onclick = () => showDataDiffPage(id, t.table, 0, rows);
+                        panel.appendChild(line);
+                        panel.appendChild(rows);
+                    });
+                });
+        }
+
+        function showDataDiffPage(id, table, offset, container) {
+            fetch(basePath + '/api/datadiff?id=' + encodeURIComponent(id) + '&table=' + encodeURIComponent(table) + '&offset=' + offset)
+                .then(r => r.ok ? r.json() : r.text().then(text => ({ success: false, error: text })))
+                .then(data => {
+                    container.textContent = '';
+                    if (!data.success) {
+                        container.textContent = 'Error: ' + data.error;
+                        return;
+                    }
+                    const marks = { inserted: '+', deleted: '-', updated: '~' };
+                    const pre = document.createElement('pre');
+                    pre.textContent = data.changes.map(c => {
+                        let text = marks[c.change] + ' ' + c.key;
+                        if (c.row) {
+                            text += ' ' + JSON.stringify(c.row);
+                        }
+                        (c.columns || []).forEach(col => {
+                            text += '\n    ' + col.column + ': ' + JSON.stringify(col.from) + ' → ' + JSON.stringify(col.to);
+                        });
+                        return text;
+                    }).join('\n') || 'No changes';
+                    container.appendChild(pre);
+
+                    const nav = document.createElement('div');
+                    nav.textContent = (data.offset + 1) + '–' + (data.offset + data.changes.length) + ' of ' + data.total + ' ';
+                    const page = (label, to) => {
+                        const link = document.createElement('a');
+                        link.textContent = label + ' ';
+                        link.onclick = () => showDataDiffPage(id, table, to, container);
+                        nav.appendChild(link);
+                    };
+                    if (data.offset > 0) page('« prev', Math.max(data.offset - 100, 0));
+                    if (data.offset + data.changes.length < data.total) page('next »', data.offset + data.changes.length);
+                    container.appendChild(nav);
+                });
+        }
+
+        function findTable() {
+            const table = document.getElementById('findTable').value.trim();
+            const panel = document.getElementById('findTableResults');
+            if (!table) {
+                panel.style.display = 'none';
+                return;
+            }
+            panel.textContent = 'Searching snapshots for ' + table + '...';
+            panel.style.display = 'block';
+            fetch(basePath + '/api/snapshots/find?table=' + encodeURIComponent(table))
+                .then(r => r.json())
+                .then(data => {
+                    if (!data.success) {
+                        panel.textContent = 'Error: ' + data.error;
+                        return;
+                    }
+                    const matches = data.matches || [];
+                    panel.textContent = matches.length ? '' : 'No snapshot contains ' + table;
+                    matches.forEach(m => {
+                        const line = document.createElement('div');
+                        line.textContent = m.filename + ': ' + m.schema + '.' + m.name +
+                            (m.has_data ? ' (~' + m.rows.toLocaleString() + ' rows)' : ' (no data)');
+                        panel.appendChild(line);
+                    });
+                    (data.failed || []).forEach(f => {
+                        const line = document.createElement('div');
+                        line.textContent = 'Could not read ' + f;
+                        panel.appendChild(line);
+                    });
+                });
+        }
+
+        function showRemoteSnapshots() {
+            const panel = document.getElementById('remoteSnapshots');
+            panel.textContent = 'Listing remote snapshots...';
+            panel.style.display = 'block';
+            fetch(basePath + '/api/remote/snapshots')
+                .then(r => r.json())
+                .then(data => {
+                    if (!data.success) {
+                        panel.textContent = 'Error: ' + data.error;
+                        return;
+                    }
+                    panel.textContent = data.snapshots.length ? '' : 'No snapshots in ' + data.remote;
+                    data.snapshots.forEach(s => {
+                        const line = document.createElement('div');
+                        line.textContent = s.filename + ' • ' + s.size + ' • ' + s.date + ' ';
+                        if (s.local) {
+                            line.appendChild(document.createTextNode('✓ local'));
+                        } else {
+                            const pull = document.createElement('button');
+                            pull.className = 'btn btn-restore';
+                            pull.textContent = 'Pull';
+                            pull.onclick = () => transferSnapshot('pull', s.filename);
+                            line.appendChild(pull);
+                        }
+                        panel.appendChild(line);
+                    });
+                });
+        }
+
+        function pushSnapshot(filename) {
+            transferSnapshot('push', filename);
+        }
+
+        function transferSnapshot(action, filename) {
+            fetch(basePath + '/api/remote/' + action + '?filename=' + encodeURIComponent(filename), { method: 'POST' })
+                .then(r => r.ok ? r.json() : r.text().then(text => ({ success: false, error: text })))
+                .then(data => {
+                    if (!data.success) {
+                        showToast('ERROR', data.error, 'error');
+                        return;
+                    }
+                    showToast(action.toUpperCase() + ' STARTED', filename, 'success');
+                    watchJob(data.job_id, job => {
+                        if (job.Status === 'succeeded') {
+                            showToast(action === 'push' ? 'SNAPSHOT PUSHED' : 'SNAPSHOT PULLED', filename, 'success');
+                            if (action === 'pull') setTimeout(() => location.reload(), 1500);
+                        } else {
+                            showToast(action.toUpperCase() + ' ' + job.Status.toUpperCase(), job.Error, 'error');
+                        }
+                    });
+                });
+        }
+
+        function syncSnapshots() {
+            fetch(basePath + '/api/remote/sync', { method: 'POST' })
+                .then(r => r.json())
+                .then(data => {
+                    if (!data.success) {
+                        showToast('ERROR', data.error, 'error');
+                        return;
+                    }
+                    showToast('SYNC STARTED', 'Comparing local and remote snapshots', 'success');
+                    watchJob(data.job_id, job => {
+                        if (job.Status === 'succeeded') {
+                            showToast('SNAPSHOTS SYNCED', 'Local and remote snapshots are in sync', 'success');
+                            setTimeout(() => location.reload(), 1500);
+                        } else {
+                            showToast('SYNC ' + job.Status.toUpperCase(), job.Error, 'error');
+                        }
+                    });
+                });
+        }
+
+        function uploadSnapshot() {
+            const input = document.getElementById('snapshotUpload');
+            if (!input.files.length) {
+                showToast('ERROR', 'Choose a pg_dump file to upload', 'error');
+                return;
+            }
+            const file = input.files[0];
+            const form = new FormData();
+            form.append('notes', document.getElementById('snapshotNotes').value);
+            form.append('file', file);
+
+            showToast('UPLOADING', file.name + ' (' + formatBytes(file.size) + ')', 'success');
+            fetch(basePath + '/api/snapshots/upload', { method: 'POST', body: form })
+                .then(r => r.ok ? r.json() : r.text().then(text => ({ success: false, error: text })))
+                .then(data => {
+                    if (data.success) {
+                        showToast('UPLOADED', 'Saved as ' + data.filename, 'success');
+                        setTimeout(() => location.reload(), 1500);
+                    } else {
+                        showToast('UPLOAD FAILED', data.error, 'error');
+                    }
+                });
+        }
+
+        async function deleteSnapshot(filename) {
+            const confirmed = await showConfirm(
+                'DELETE SNAPSHOT',
+                'Delete ' + filename + '?\n\nThis action cannot be undone.'
+            );
+            if (!confirmed) return;
+
+            fetch(basePath + '/api/snapshots/delete?filename=' + encodeURIComponent(filename), { method: 'POST' })
+                .then(r => r.json())
+                .then(data => {
+                    if (data.success) {
+                        showToast('DELETED', 'Snapshot deleted successfully', 'success');
+                        setTimeout(() => location.reload(), 1500);
+                    } else {
+                        showToast('ERROR', data.error, 'error');
+                    }
+                });
+        }
+
+        function createBranch() {
+            const name = document.getElementById('branchName').value.trim();
+            if (!name) {
+                showToast('ERROR', 'Enter a branch name', 'error');
+                return;
+            }
+
+            fetch(basePath + '/api/branches/create?name=' + encodeURIComponent(name), { method: 'POST' })
+                .then(r => r.json())
+                .then(data => {
+                    if (data.success) {
+                        showToast('BRANCHING', 'Cloning the active database into ' + name, 'success');
+                        watchJob(data.job_id, job => {
+                            if (job.Status === 'succeeded') {
+                                showToast('BRANCH CREATED', name, 'success');
+                                setTimeout(() => location.reload(), 1500);
+                            } else {
+                                showToast('BRANCH ' + job.Status.toUpperCase(), job.Error, 'error');
+                            }
+                        });
+                    } else {
+                        showToast('ERROR', data.error, 'error');
+                    }
+                });
+        }
+
+        async function switchBranch(name) {
+            const confirmed = await showConfirm(
+                'SWITCH BRANCH',
+                'Make ' + name + ' the active database?\n\nOpen connections to the current database will be closed. Its data is kept as a branch.'
+            );
+            if (!confirmed) return;
+
+            fetch(basePath + '/api/branches/switch?name=' + encodeURIComponent(name), { method: 'POST' })
+                .then(r => r.json())
+                .then(data => {
+                    if (data.success) {
+                        watchJob(data.job_id, job => {
+                            if (job.Status === 'succeeded') {
+                                showToast('BRANCH SWITCHED', name + ' is now active', 'success');
+                                setTimeout(() => location.reload(), 1500);
+                            } else {
+                                showToast('SWITCH ' + job.Status.toUpperCase(), job.Error, 'error');
+                            }
+                        });
+                    } else {
+                        showToast('ERROR', data.error, 'error');
+                    }
+                });
+        }
+
+        async function deleteBranch(name) {
+            const confirmed = await showConfirm(
+                'DELETE BRANCH',
+                'Drop the database for branch ' + name + '?\n\nThis action cannot be undone.'
+            );
+            if (!confirmed) return;
+
+            fetch(basePath + '/api/branches/delete?name=' + encodeURIComponent(name), { method: 'POST' })
+                .then(r => r.json())
+                .then(data => {
+                    if (data.success) {
+                        showToast('DELETED', 'Branch ' + name + ' deleted', 'success');
+                        setTimeout(() => location.reload(), 1500);
+                    } else {
+                        showToast('ERROR', data.error, 'error');
+                    }
+                });
+        }
+
+        loadJobs();
+        loadConnections();
+        loadStatements();
+    </script>
+</body>
+</html>`
+
+	t := template.Must(template.New("status").Parse(tmpl))
+	w.Header().Set("Content-Type", "text/html")
+	t.Execute(w, status)
+}
+
+func handleAPIStatus(w http.ResponseWriter, r *http.Request) {
 	status := getStatus()
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(status)
@@ -770,43 +2523,79 @@ func handleCreateSnapshot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	label := r.URL.Query().Get("label")
-
-	timestamp := time.Now().Format("2006-01-02T1504")
-	filename := timestamp
-	if label != "" {
-		filename = fmt.Sprintf("%s_%s", timestamp, label)
+	opts, err := parseSnapshotOptions(r.URL.Query().Get("format"), r.URL.Query().Get("compress"), r.URL.Query().Get("encrypt"))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
 	}
-	filename += ".sql"
-
-	snapshotPath := filepath.Join(snapshotsDir, filename)
 
-	cmd := exec.Command("pg_dump",
-		"-h", "localhost",
-		"-U", getEnv("POSTGRES_USER", "postgres"),
-		"-d", getEnv("POSTGRES_DB", "devdb"),
-		"-F", "p",
-		"-f", snapshotPath,
-	)
-	cmd.Env = append(os.Environ(), fmt.Sprintf("PGPASSWORD=%s", getEnv("POSTGRES_PASSWORD", "postgres")))
+	if err := validateLabel(r.URL.Query().Get("label")); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
 
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("pg_dump failed: %v, output: %s", err, string(output))
+	if opts.Scope, err = parseSnapshotScope(r.URL.Query()); err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
-			"error":   fmt.Sprintf("%v: %s", err, string(output)),
+			"error":   err.Error(),
 		})
 		return
 	}
 
-	// Invalidate cache to show new snapshot immediately
-	invalidateCache()
+	kind := r.URL.Query().Get("kind")
+	if kind != kindManual && kind != kindPreRestore {
+		http.Error(w, "Invalid snapshot kind", http.StatusBadRequest)
+		return
+	}
+
+	var profile *AnonymizeProfile
+	if name := r.URL.Query().Get("anonymize"); name != "" {
+		if profile, err = findAnonymizeProfile(name); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+	}
+
+	job, filename := startSnapshotJob(CreateSnapshotRequest{
+		Label:     r.URL.Query().Get("label"),
+		Notes:     r.URL.Query().Get("notes"),
+		CreatedBy: r.URL.Query().Get("created_by"),
+		Kind:      kind,
+		RestoreOf: r.URL.Query().Get("restore_of"),
+		Options:   opts,
+		Anonymize: profile,
+	})
+
+	// Scripts can pass wait=1 to block until the snapshot has been written
+	if r.URL.Query().Get("wait") != "" {
+		info := job.Wait()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  info.Status == jobSucceeded,
+			"error":    info.Error,
+			"job_id":   info.ID,
+			"filename": filename,
+		})
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success":  true,
+		"job_id":   job.Info().ID,
 		"filename": filename,
 	})
 }
@@ -823,48 +2612,55 @@ func handleRestoreSnapshot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	snapshotPath := filepath.Join(snapshotsDir, filename)
-
-	// Drop and recreate schemas
-	dbName := getEnv("POSTGRES_DB", "devdb")
-	dbUser := getEnv("POSTGRES_USER", "postgres")
-
-	if db != nil {
-		// Drop all schemas except system ones
-		_, _ = db.Exec(`
-			DO $$ DECLARE
-				r RECORD;
-			BEGIN
-				FOR r IN (SELECT schema_name FROM information_schema.schemata
-						  WHERE schema_name NOT IN ('pg_catalog', 'information_schema', 'pg_toast'))
-				LOOP
-					EXECUTE 'DROP SCHEMA IF EXISTS ' || quote_ident(r.schema_name) || ' CASCADE';
-				END LOOP;
-			END $$;
-		`)
-
-		// Recreate public schema
-		db.Exec("CREATE SCHEMA IF NOT EXISTS public")
-		db.Exec(fmt.Sprintf("GRANT ALL ON SCHEMA public TO %s", dbUser))
-		db.Exec("GRANT ALL ON SCHEMA public TO public")
+	snapshotPath, err := resolveSnapshotPath(filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// Restore from snapshot
-	cmd := exec.Command("psql",
-		"-h", "localhost",
-		"-U", dbUser,
-		"-d", dbName,
-		"-f", snapshotPath,
-	)
-	cmd.Env = append(os.Environ(), fmt.Sprintf("PGPASSWORD=%s", getEnv("POSTGRES_PASSWORD", "postgres")))
+	// Pass target=<name> to restore into a new side database instead
+	if target := r.URL.Query().Get("target"); target != "" && target != getEnv("POSTGRES_DB", "devdb") {
+		job, err := startSideRestoreJob(filename, snapshotPath, target)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
 
-	output, err := cmd.CombinedOutput()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"job_id":   job.Info().ID,
+			"database": target,
+			"warning":  partialRestoreWarning(snapshotPath),
+		})
+		return
+	}
+
+	// Restoring a partial snapshot over the database loses whatever it leaves
+	// out, so it takes partial=1
+	warning := partialRestoreWarning(snapshotPath)
+	if warning != "" && r.URL.Query().Get("partial") != "1" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   warning + "; pass partial=1 to restore it anyway",
+		})
+		return
+	}
+
+	// Pass safety=false to skip the pre-restore snapshot
+	safety := r.URL.Query().Get("safety") != "false" && r.URL.Query().Get("safety") != "0"
+
+	job, err := startRestoreJob(filename, snapshotPath, safety)
 	if err != nil {
-		log.Printf("psql restore failed: %v, output: %s", err, string(output))
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
-			"error":   fmt.Sprintf("%v: %s", err, string(output)),
+			"error":   err.Error(),
 		})
 		return
 	}
@@ -872,6 +2668,8 @@ func handleRestoreSnapshot(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
+		"job_id":  job.Info().ID,
+		"warning": warning,
 	})
 }
 
@@ -887,8 +2685,13 @@ func handleDeleteSnapshot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	snapshotPath := filepath.Join(snapshotsDir, filename)
-	if err := os.Remove(snapshotPath); err != nil {
+	snapshotPath, err := resolveSnapshotPath(filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := deleteSnapshot(snapshotPath); err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
@@ -961,12 +2764,46 @@ func handleToggleFunnel(w http.ResponseWriter, r *http.Request) {
 }
 
 func getStatus() *StatusData {
-	// Return cached status if fresh enough
-	if cachedStatus != nil && time.Since(cacheTime) < cacheDuration {
-		return cachedStatus
+	cacheMu.Lock()
+	// Return cached status if fresh enough, or while another request is
+	// refreshing it
+	if cachedStatus != nil && (time.Since(cacheTime) < cacheDuration || cacheRefreshing) {
+		status := cachedStatus
+		cacheMu.Unlock()
+		return status
+	}
+	cacheRefreshing = true
+	gen := cacheGen
+	cacheMu.Unlock()
+
+	// Collected without the lock, so a slow database doesn't hold up
+	// requests that can be served from the cache
+	status := collectStatus()
+
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	cacheRefreshing = false
+	// A status collected across invalidateCache may be stale already
+	if gen == cacheGen {
+		cachedStatus = status
+		cacheTime = time.Now()
 	}
+	return status
+}
+
+// collectStatus gathers everything on the dashboard. Database queries share
+// one deadline.
+func collectStatus() *StatusData {
+	ctx, cancel := context.WithTimeout(context.Background(), statusTimeout)
+	defer cancel()
 
 	hostname, _ := os.Hostname()
+	schedules, scheduleErrors := snapshotScheduler.status()
+	verifySchedules, verifyErrors := verifyScheduler.status()
+	schedules = append(schedules, verifySchedules...)
+	scheduleErrors = append(scheduleErrors, verifyErrors...)
+	branches, _ := listBranches(ctx)
+	sideDBs, _ := listSideDatabases(ctx)
 
 	status := &StatusData{
 		ContainerName:     getEnv("CONTAINER_NAME", "devbox"),
@@ -975,14 +2812,23 @@ func getStatus() *StatusData {
 		DevServicePort:    getEnv("DEV_SERVICE_PORT", "3000"),
 		Hostname:          hostname,
 		Services:          getServices(),
+		Overview:          statusOverview(ctx),
+		Migrations:        statusMigrations(ctx),
 		Snapshots:         getSnapshots(),
+		Retention:         retentionPolicy().String(),
+		Schedules:         schedules,
+		ScheduleErrors:    scheduleErrors,
+		Branches:          branches,
+		SideDatabases:     sideDBs,
+		BranchAutoSwitch:  branchAutoSwitchEnabled(),
+		AnonymizeProfiles: anonymizeProfileNames(),
+		Encryption:        encryptionConfigured(),
+		Remote:            remoteName(),
+		Environments:      listEnvironments(),
+		LastRestore:       getLastRestore(),
 		TailscaleStatus:   getTailscaleStatus(),
 		CloudflaredActive: isCloudflaredActive(),
 	}
-
-	cachedStatus = status
-	cacheTime = time.Now()
-
 	return status
 }
 
@@ -1077,28 +2923,30 @@ func checkService(port int) string {
 func getSnapshots() []Snapshot {
 	var snapshots []Snapshot
 
-	files, err := filepath.Glob(filepath.Join(snapshotsDir, "*.sql"))
+	stored, err := localSnapshots.List(context.Background())
 	if err != nil {
 		return snapshots
 	}
 
 	// Sort by modification time (newest first)
-	sort.Slice(files, func(i, j int) bool {
-		iInfo, _ := os.Stat(files[i])
-		jInfo, _ := os.Stat(files[j])
-		return iInfo.ModTime().After(jInfo.ModTime())
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].ModTime.After(stored[j].ModTime)
 	})
 
-	for _, file := range files {
-		info, err := os.Stat(file)
-		if err != nil {
-			continue
-		}
+	for _, s := range stored {
+		file := localSnapshots.path(s.Name)
+
+		// Snapshots taken outside devbox-status may not have a sidecar
+		meta, _ := readSnapshotMeta(file)
 
 		snapshots = append(snapshots, Snapshot{
-			Filename: filepath.Base(file),
-			Size:     formatSize(info.Size()),
-			Date:     info.ModTime().Format("2006-01-02 15:04"),
+			Filename:     s.Name,
+			Format:       snapshotFormat(file),
+			Size:         formatSize(s.Size),
+			Date:         s.ModTime.Format("2006-01-02 15:04"),
+			Verification: verificationStatus(meta),
+			Encrypted:    isEncryptedSnapshot(file),
+			Meta:         meta,
 		})
 	}
 
@@ -1118,6 +2966,16 @@ func formatSize(bytes int64) string {
 	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
 
+// connString returns a lib/pq connection string for dbName on the local server
+func connString(dbName string) string {
+	return fmt.Sprintf(
+		"host=localhost port=5432 user=%s password=%s dbname=%s sslmode=disable fallback_application_name=devbox-status",
+		getEnv("POSTGRES_USER", "postgres"),
+		getEnv("POSTGRES_PASSWORD", "postgres"),
+		dbName,
+	)
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SnapshotMeta is written as a JSON sidecar next to each snapshot
+// (<snapshot>.json) and describes the database it was taken from.
+type SnapshotMeta struct {
+	Label            string    `json:"label,omitempty"`
+	Kind             string    `json:"kind,omitempty"`
+	RestoreOf        string    `json:"restore_of,omitempty"`
+	Pinned           bool      `json:"pinned,omitempty"`
+	Notes            string    `json:"notes,omitempty"`
+	CreatedBy        string    `json:"created_by,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+	Database         string    `json:"database"`
+	Format           string    `json:"format"`
+	Compression      int       `json:"compression"`
+	ServerVersion    string    `json:"server_version,omitempty"`
+	DBSizeBytes      int64     `json:"db_size_bytes"`
+	TableCount       int       `json:"table_count"`
+	GitBranch        string    `json:"git_branch,omitempty"`
+	GitCommit        string    `json:"git_commit,omitempty"`
+	MigrationVersion string    `json:"migration_version,omitempty"`
+	ChangeCounter    string    `json:"change_counter,omitempty"`
+
+	// Migrations is the migration state of each framework found, compared
+	// with the workspace at the time; MigrationVersion is the first one's
+	// latest migration
+	Migrations []MigrationStatus `json:"migrations,omitempty"`
+
+	// TableRows holds each table's row count ("schema.table") at the moment
+	// the snapshot was taken; verification compares the restore with it
+	TableRows     map[string]int64       `json:"table_rows,omitempty"`
+	Verification  *SnapshotVerification  `json:"verification,omitempty"`
+	Anonymization *SnapshotAnonymization `json:"anonymization,omitempty"`
+	Subset        *SnapshotSubset        `json:"subset,omitempty"`
+	Scope         *SnapshotScope         `json:"scope,omitempty"`
+}
+
+// metaPath returns the sidecar path for a snapshot
+func metaPath(snapshotPath string) string {
+	return snapshotPath + ".json"
+}
+
+func readSnapshotMeta(snapshotPath string) (*SnapshotMeta, error) {
+	data, err := os.ReadFile(metaPath(snapshotPath))
+	if err != nil {
+		return nil, err
+	}
+	var meta SnapshotMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// readOrInitSnapshotMeta reads a snapshot's sidecar. Snapshots taken outside
+// devbox-status get a minimal one, to be written by the caller.
+func readOrInitSnapshotMeta(snapshotPath string) (*SnapshotMeta, error) {
+	meta, err := readSnapshotMeta(snapshotPath)
+	if os.IsNotExist(err) {
+		return &SnapshotMeta{
+			Label:     snapshotLabel(filepath.Base(snapshotPath), nil),
+			CreatedAt: snapshotTime(snapshotPath, nil),
+			Format:    snapshotFormat(snapshotPath),
+		}, nil
+	}
+	return meta, err
+}
+
+func writeSnapshotMeta(snapshotPath string, meta *SnapshotMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temp file first so a half-written sidecar is never picked up
+	tmp := metaPath(snapshotPath) + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, metaPath(snapshotPath))
+}
+
+// collectSnapshotMeta gathers database and workspace details for a snapshot
+// that is about to be taken. Anything that cannot be determined is left empty.
+func collectSnapshotMeta(label, notes, createdBy string, opts SnapshotOptions) *SnapshotMeta {
+	meta := &SnapshotMeta{
+		Label:       label,
+		Notes:       notes,
+		CreatedBy:   createdBy,
+		CreatedAt:   time.Now(),
+		Database:    getEnv("POSTGRES_DB", "devdb"),
+		Format:      opts.Format,
+		Compression: opts.Compression,
+	}
+	if meta.CreatedBy == "" {
+		meta.CreatedBy = getEnv("USERNAME", "devbox")
+	}
+
+	if db != nil {
+		db.QueryRow("SHOW server_version").Scan(&meta.ServerVersion)
+		db.QueryRow("SELECT pg_database_size(current_database())").Scan(&meta.DBSizeBytes)
+		db.QueryRow(`
+			SELECT count(*) FROM pg_tables
+			WHERE schemaname NOT IN ('pg_catalog', 'information_schema')
+		`).Scan(&meta.TableCount)
+		meta.Migrations = snapshotMigrations()
+		if len(meta.Migrations) > 0 {
+			meta.MigrationVersion = meta.Migrations[0].Latest
+		}
+		meta.ChangeCounter = databaseChangeCounter()
+	}
+
+	if repo := workspaceRepo(); repo != "" {
+		meta.GitBranch = gitOutput(repo, "rev-parse", "--abbrev-ref", "HEAD")
+		meta.GitCommit = gitOutput(repo, "rev-parse", "HEAD")
+	}
+
+	return meta
+}
+
+// workspaceRepo locates the git repository for the project being developed.
+// WORKSPACE_REPO wins if set; otherwise /workspace itself, then the first
+// directory under /workspace that contains a .git entry.
+func workspaceRepo() string {
+	if repo := getEnv("WORKSPACE_REPO", ""); repo != "" {
+		return repo
+	}
+	if _, err := os.Stat("/workspace/.git"); err == nil {
+		return "/workspace"
+	}
+	matches, _ := filepath.Glob("/workspace/*/.git")
+	if len(matches) > 0 {
+		return filepath.Dir(matches[0])
+	}
+	return ""
+}
+
+// gitOutput runs git in repo and returns trimmed stdout, or "" on failure.
+// The repository is owned by the dev user, so ownership checks are disabled.
+func gitOutput(repo string, args ...string) string {
+	args = append([]string{"-c", "safe.directory=*", "-C", repo}, args...)
+	output, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
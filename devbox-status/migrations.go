@@ -0,0 +1,571 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// migrationsRoot is searched for migration files
+const migrationsRoot = "/workspace"
+
+// MigrationStatus is the state of one framework's migrations: what its table
+// in the live database records as applied, compared with the migration files
+// found under /workspace
+type MigrationStatus struct {
+	Framework string   `json:"framework"`
+	Table     string   `json:"table"`
+	Latest    string   `json:"latest,omitempty"`
+	Applied   int      `json:"applied"`
+	Dirty     bool     `json:"dirty,omitempty"` // a migration failed or was left half applied
+	Files     int      `json:"files"`           // migration files found, 0 if none
+	Pending   []string `json:"pending,omitempty"`
+	Missing   []string `json:"missing,omitempty"` // applied, but the file is gone
+	Error     string   `json:"error,omitempty"`   // the table could not be read
+	// FilesError is set when the search for migration files did not finish;
+	// Pending and Missing are then left empty
+	FilesError string `json:"files_error,omitempty"`
+}
+
+// Summary is a one-line description for the snapshot list
+func (m MigrationStatus) Summary() string {
+	s := m.Framework
+	if m.Latest != "" {
+		s += " " + m.Latest
+	}
+	var notes []string
+	if m.Error != "" {
+		notes = append(notes, "unreadable")
+	}
+	if m.FilesError != "" {
+		notes = append(notes, "files not checked")
+	}
+	if m.Dirty {
+		notes = append(notes, "dirty")
+	}
+	if len(m.Pending) > 0 {
+		notes = append(notes, fmt.Sprintf("%d pending", len(m.Pending)))
+	}
+	if len(m.Missing) > 0 {
+		notes = append(notes, fmt.Sprintf("%d missing", len(m.Missing)))
+	}
+	if len(notes) > 0 {
+		s += " (" + strings.Join(notes, ", ") + ")"
+	}
+	return s
+}
+
+// migrationTables lists the migration tables of common frameworks, in the
+// order they are reported. read fills in what the table records and returns
+// the applied migrations, using the same IDs as the framework's file matcher.
+var migrationTables = []struct {
+	table string
+	read  func(ctx context.Context, status *MigrationStatus) ([]string, error)
+}{
+	{"schema_migrations", readSchemaMigrations},
+	{"goose_db_version", readGooseMigrations},
+	{"_prisma_migrations", readPrismaMigrations},
+	{"flyway_schema_history", readFlywayMigrations},
+	{"knex_migrations", readKnexMigrations},
+	{"django_migrations", readDjangoMigrations},
+}
+
+// readSchemaMigrations handles both users of schema_migrations: Rails keeps
+// a row per applied migration, golang-migrate a single row with the current
+// version and a dirty flag
+func readSchemaMigrations(ctx context.Context, status *MigrationStatus) ([]string, error) {
+	var golangMigrate bool
+	if err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM pg_attribute
+			WHERE attrelid = to_regclass('schema_migrations') AND attname = 'dirty' AND NOT attisdropped)
+	`).Scan(&golangMigrate); err != nil {
+		return nil, err
+	}
+	if golangMigrate {
+		status.Framework = "golang-migrate"
+		var version *string
+		err := db.QueryRowContext(ctx, "SELECT version::text, dirty FROM schema_migrations LIMIT 1").Scan(&version, &status.Dirty)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if version == nil {
+			return nil, nil
+		}
+		status.Latest = trimVersion(*version)
+		return []string{status.Latest}, nil
+	}
+
+	status.Framework = "rails"
+	rows, err := db.QueryContext(ctx, "SELECT version::text FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var applied []string
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied = append(applied, trimVersion(version))
+	}
+	sortVersions(applied)
+	if len(applied) > 0 {
+		status.Latest = applied[len(applied)-1]
+	}
+	return applied, rows.Err()
+}
+
+// readGooseMigrations replays goose's log of applies and rollbacks: a
+// version is applied if its newest row says so. Version 0 is goose's own.
+func readGooseMigrations(ctx context.Context, status *MigrationStatus) ([]string, error) {
+	status.Framework = "goose"
+	rows, err := db.QueryContext(ctx, `
+		SELECT DISTINCT ON (version_id) version_id::text, is_applied
+		FROM goose_db_version WHERE version_id > 0
+		ORDER BY version_id, id DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var applied []string
+	for rows.Next() {
+		var version string
+		var isApplied bool
+		if err := rows.Scan(&version, &isApplied); err != nil {
+			return nil, err
+		}
+		if isApplied {
+			applied = append(applied, trimVersion(version))
+		}
+	}
+	sortVersions(applied)
+	if len(applied) > 0 {
+		status.Latest = applied[len(applied)-1]
+	}
+	return applied, rows.Err()
+}
+
+// readPrismaMigrations counts a migration that started but never finished
+// (and wasn't rolled back) as dirty, as prisma migrate does
+func readPrismaMigrations(ctx context.Context, status *MigrationStatus) ([]string, error) {
+	status.Framework = "prisma"
+	rows, err := db.QueryContext(ctx, `
+		SELECT migration_name, finished_at IS NOT NULL FROM _prisma_migrations
+		WHERE rolled_back_at IS NULL
+		ORDER BY started_at
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var applied []string
+	for rows.Next() {
+		var name string
+		var finished bool
+		if err := rows.Scan(&name, &finished); err != nil {
+			return nil, err
+		}
+		if !finished {
+			status.Dirty = true
+			continue
+		}
+		applied = append(applied, name)
+		status.Latest = name
+	}
+	return applied, rows.Err()
+}
+
+// readFlywayMigrations skips repeatable migrations, which have no version
+func readFlywayMigrations(ctx context.Context, status *MigrationStatus) ([]string, error) {
+	status.Framework = "flyway"
+	rows, err := db.QueryContext(ctx, `
+		SELECT version, success FROM flyway_schema_history
+		WHERE version IS NOT NULL
+		ORDER BY installed_rank
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var applied []string
+	for rows.Next() {
+		var version string
+		var success bool
+		if err := rows.Scan(&version, &success); err != nil {
+			return nil, err
+		}
+		if !success {
+			status.Dirty = true
+			continue
+		}
+		applied = append(applied, trimVersion(version))
+		status.Latest = trimVersion(version)
+	}
+	return applied, rows.Err()
+}
+
+// readKnexMigrations drops the file extension knex records, so a project
+// that moved from .js to .ts still matches its files
+func readKnexMigrations(ctx context.Context, status *MigrationStatus) ([]string, error) {
+	status.Framework = "knex"
+	applied, err := queryStrings(ctx, "SELECT name FROM knex_migrations ORDER BY id")
+	for i, name := range applied {
+		applied[i] = strings.TrimSuffix(name, path.Ext(name))
+	}
+	if len(applied) > 0 {
+		status.Latest = applied[len(applied)-1]
+	}
+	return applied, err
+}
+
+func readDjangoMigrations(ctx context.Context, status *MigrationStatus) ([]string, error) {
+	status.Framework = "django"
+	applied, err := queryStrings(ctx, "SELECT app || '.' || name FROM django_migrations ORDER BY applied, id")
+	if len(applied) > 0 {
+		status.Latest = applied[len(applied)-1]
+	}
+	return applied, err
+}
+
+func queryStrings(ctx context.Context, query string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	return result, rows.Err()
+}
+
+var (
+	leadingVersion  = regexp.MustCompile(`^(\d+)_`)
+	railsMigration  = regexp.MustCompile(`^(\d+)_\w+\.rb$`)
+	flywayMigration = regexp.MustCompile(`^V([0-9._]+?)__.+\.sql$`)
+	djangoMigration = regexp.MustCompile(`^\d{4}_\w+\.py$`)
+)
+
+// migrationFiles maps a framework to a matcher that returns the migration ID
+// for a file under /workspace (a slash-separated path relative to it), or
+// false if the file isn't one of its migrations
+var migrationFiles = map[string]func(rel string) (string, bool){
+	"rails": func(rel string) (string, bool) {
+		dir, name := path.Split(rel)
+		m := railsMigration.FindStringSubmatch(name)
+		if m == nil || !strings.HasSuffix(dir, "db/migrate/") {
+			return "", false
+		}
+		return trimVersion(m[1]), true
+	},
+	"golang-migrate": func(rel string) (string, bool) {
+		name := path.Base(rel)
+		m := leadingVersion.FindStringSubmatch(name)
+		if m == nil || !(strings.HasSuffix(name, ".up.sql") || strings.HasSuffix(name, ".up.json")) {
+			return "", false
+		}
+		return trimVersion(m[1]), true
+	},
+	"goose": func(rel string) (string, bool) {
+		dir, name := path.Split(rel)
+		m := leadingVersion.FindStringSubmatch(name)
+		if m == nil || !strings.Contains(strings.ToLower(dir), "migrat") {
+			return "", false
+		}
+		if strings.HasSuffix(name, ".up.sql") || strings.HasSuffix(name, ".down.sql") || strings.HasSuffix(name, "_test.go") {
+			return "", false
+		}
+		if path.Ext(name) != ".sql" && path.Ext(name) != ".go" {
+			return "", false
+		}
+		return trimVersion(m[1]), true
+	},
+	"prisma": func(rel string) (string, bool) {
+		parts := strings.Split(rel, "/")
+		n := len(parts)
+		if n < 3 || parts[n-1] != "migration.sql" || parts[n-3] != "migrations" {
+			return "", false
+		}
+		return parts[n-2], true
+	},
+	"flyway": func(rel string) (string, bool) {
+		m := flywayMigration.FindStringSubmatch(path.Base(rel))
+		if m == nil {
+			return "", false
+		}
+		return trimVersion(strings.ReplaceAll(m[1], "_", ".")), true
+	},
+	"knex": func(rel string) (string, bool) {
+		dir, name := path.Split(rel)
+		ext := path.Ext(name)
+		switch {
+		case ext != ".js" && ext != ".ts" && ext != ".cjs" && ext != ".mjs",
+			strings.HasSuffix(name, ".d.ts"),
+			leadingVersion.FindString(name) == "",
+			!strings.Contains(strings.ToLower(dir), "migrat"):
+			return "", false
+		}
+		return strings.TrimSuffix(name, ext), true
+	},
+	// The app label is assumed to be the name of the app's directory
+	"django": func(rel string) (string, bool) {
+		parts := strings.Split(rel, "/")
+		n := len(parts)
+		if n < 3 || parts[n-2] != "migrations" || !djangoMigration.MatchString(parts[n-1]) {
+			return "", false
+		}
+		return parts[n-3] + "." + strings.TrimSuffix(parts[n-1], ".py"), true
+	},
+}
+
+// skipDirs are never searched for migration files. Installed packages carry
+// their own migrations (Django's contrib apps, for one).
+var skipDirs = map[string]bool{
+	".git": true, "node_modules": true, "vendor": true, "venv": true, ".venv": true,
+	"site-packages": true, "__pycache__": true, "dist": true, "build": true,
+	"target": true, ".next": true, "tmp": true, "log": true,
+}
+
+// findMigrationFiles returns the migration IDs found under /workspace for
+// each of frameworks, searching at most 8 directories deep. If ctx ends
+// before the search does, the error is returned with what was found so far.
+func findMigrationFiles(ctx context.Context, frameworks []string) (map[string][]string, error) {
+	found := make(map[string][]string)
+	err := filepath.WalkDir(migrationsRoot, func(p string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(migrationsRoot, p)
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if rel != "." && (skipDirs[d.Name()] || strings.Count(rel, "/") >= 8) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		for _, framework := range frameworks {
+			if id, ok := migrationFiles[framework](rel); ok {
+				found[framework] = append(found[framework], id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return found, fmt.Errorf("search of %s stopped: %v", migrationsRoot, err)
+	}
+	return found, nil
+}
+
+// migrationStatus reports on every migration table in the live database. A
+// table that cannot be read is reported with its Error set.
+func migrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	if db == nil {
+		return nil, fmt.Errorf("no connection to the database")
+	}
+	var statuses []MigrationStatus
+	var applied [][]string
+	var frameworks []string
+	for _, m := range migrationTables {
+		var exists bool
+		if err := db.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", m.table).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		status := MigrationStatus{Table: m.table}
+		ids, err := m.read(ctx, &status)
+		if err != nil {
+			// A table that doesn't look the way its framework writes it
+			// should not hide the others
+			if status.Framework == "" {
+				status.Framework = m.table
+			}
+			status.Error = err.Error()
+			statuses = append(statuses, status)
+			applied = append(applied, nil)
+			continue
+		}
+		status.Applied = len(ids)
+		statuses = append(statuses, status)
+		applied = append(applied, ids)
+		frameworks = append(frameworks, status.Framework)
+	}
+	if len(statuses) == 0 {
+		return nil, nil
+	}
+
+	// Comparing with a partial search would report every migration not
+	// reached yet as pending or missing
+	files, err := findMigrationFiles(ctx, frameworks)
+	for i := range statuses {
+		switch {
+		case statuses[i].Error != "":
+		case err != nil:
+			statuses[i].FilesError = err.Error()
+		default:
+			compareMigrations(&statuses[i], applied[i], files[statuses[i].Framework])
+		}
+	}
+	return statuses, nil
+}
+
+// compareMigrations fills in the pending and missing migrations. Without any
+// files there is nothing to compare against, so nothing is reported missing.
+func compareMigrations(status *MigrationStatus, applied, files []string) {
+	status.Files = len(files)
+	if len(files) == 0 {
+		return
+	}
+
+	if status.Framework == "django" {
+		// Apps without migrations in the workspace are installed packages
+		apps := make(map[string]bool)
+		for _, id := range files {
+			apps[strings.SplitN(id, ".", 2)[0]] = true
+		}
+		var ours []string
+		for _, id := range applied {
+			if apps[strings.SplitN(id, ".", 2)[0]] {
+				ours = append(ours, id)
+			}
+		}
+		applied = ours
+	}
+
+	fileSet := make(map[string]bool)
+	for _, id := range files {
+		fileSet[id] = true
+	}
+	appliedSet := make(map[string]bool)
+	for _, id := range applied {
+		appliedSet[id] = true
+	}
+
+	for id := range fileSet {
+		// golang-migrate only records the current version; everything up to
+		// it has been applied
+		if status.Framework == "golang-migrate" && status.Latest != "" && compareVersions(id, status.Latest) <= 0 {
+			continue
+		}
+		if !appliedSet[id] {
+			status.Pending = append(status.Pending, id)
+		}
+	}
+	for id := range appliedSet {
+		if !fileSet[id] {
+			status.Missing = append(status.Missing, id)
+		}
+	}
+	sortVersions(status.Pending)
+	sortVersions(status.Missing)
+}
+
+// trimVersion drops leading zeros from each dotted part of a numeric
+// version, so 000042 matches 42 and flyway's 1.01 matches 1.1
+func trimVersion(v string) string {
+	parts := strings.Split(v, ".")
+	for i, part := range parts {
+		if trimmed := strings.TrimLeft(part, "0"); trimmed != part && isDigits(part) {
+			if trimmed == "" {
+				trimmed = "0"
+			}
+			parts[i] = trimmed
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// compareVersions orders migration IDs by their dotted parts, numerically
+// where both parts are numbers
+func compareVersions(a, b string) int {
+	pa, pb := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		x, y := pa[i], pb[i]
+		if isDigits(x) && isDigits(y) {
+			x, y = strings.TrimLeft(x, "0"), strings.TrimLeft(y, "0")
+			if len(x) != len(y) {
+				return len(x) - len(y)
+			}
+		}
+		if c := strings.Compare(x, y); c != 0 {
+			return c
+		}
+	}
+	return len(pa) - len(pb)
+}
+
+func sortVersions(ids []string) {
+	sort.Slice(ids, func(i, j int) bool { return compareVersions(ids[i], ids[j]) < 0 })
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// statusMigrations is the migration status for getStatus
+func statusMigrations(ctx context.Context) []MigrationStatus {
+	statuses, err := migrationStatus(ctx)
+	if err != nil {
+		return nil
+	}
+	return statuses
+}
+
+// snapshotMigrations is the migration status recorded in snapshot metadata
+func snapshotMigrations() []MigrationStatus {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	statuses, _ := migrationStatus(ctx)
+	return statuses
+}
+
+// handleMigrations reports the migration state of the live database
+func handleMigrations(w http.ResponseWriter, r *http.Request) {
+	statuses, err := migrationStatus(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	if statuses == nil {
+		statuses = []MigrationStatus{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"migrations": statuses,
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int // sign only
+	}{
+		{"1", "1", 0},
+		{"1", "2", -1},
+		{"9", "10", -1},
+		{"0009", "10", -1},
+		{"010", "10", 0},
+		{"20240115103000", "20231231235959", 1},
+		{"1.2", "1.10", -1},
+		{"1.2", "1.2.1", -1},
+		{"2", "1.9", 1},
+		{"app.0002_add_email", "app.0010_index", -1},
+		{"auth.0001_initial", "app.0001_initial", 1},
+		{"abc", "abd", -1},
+	}
+	sign := func(n int) int {
+		switch {
+		case n < 0:
+			return -1
+		case n > 0:
+			return 1
+		}
+		return 0
+	}
+	for _, tt := range tests {
+		if got := sign(compareVersions(tt.a, tt.b)); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := sign(compareVersions(tt.b, tt.a)); got != -tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestCompareMigrations(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  MigrationStatus
+		applied []string
+		files   []string
+		want    MigrationStatus
+	}{
+		{
+			name:    "no files",
+			status:  MigrationStatus{Framework: "rails"},
+			applied: []string{"20240101000000"},
+			want:    MigrationStatus{Framework: "rails"},
+		},
+		{
+			name:    "pending and missing",
+			status:  MigrationStatus{Framework: "rails"},
+			applied: []string{"20240101000000", "20240102000000", "20240105000000"},
+			files:   []string{"20240101000000", "20240102000000", "20240110000000", "20240103000000"},
+			want: MigrationStatus{
+				Framework: "rails",
+				Files:     4,
+				Pending:   []string{"20240103000000", "20240110000000"},
+				Missing:   []string{"20240105000000"},
+			},
+		},
+		{
+			name:    "numeric order",
+			status:  MigrationStatus{Framework: "goose"},
+			applied: []string{"1"},
+			files:   []string{"1", "10", "9", "2"},
+			want:    MigrationStatus{Framework: "goose", Files: 4, Pending: []string{"2", "9", "10"}},
+		},
+		{
+			name:    "golang-migrate only records the current version",
+			status:  MigrationStatus{Framework: "golang-migrate", Latest: "3"},
+			applied: []string{"3"},
+			files:   []string{"1", "2", "3", "4", "5"},
+			want:    MigrationStatus{Framework: "golang-migrate", Latest: "3", Files: 5, Pending: []string{"4", "5"}},
+		},
+		{
+			name:    "django ignores installed apps",
+			status:  MigrationStatus{Framework: "django"},
+			applied: []string{"auth.0001_initial", "shop.0001_initial", "shop.0002_price"},
+			files:   []string{"shop.0001_initial", "shop.0003_stock"},
+			want: MigrationStatus{
+				Framework: "django",
+				Files:     2,
+				Pending:   []string{"shop.0003_stock"},
+				Missing:   []string{"shop.0002_price"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := tt.status
+			compareMigrations(&status, tt.applied, tt.files)
+			if !reflect.DeepEqual(status, tt.want) {
+				t.Errorf("compareMigrations() = %+v, want %+v", status, tt.want)
+			}
+		})
+	}
+}
+
+func TestMigrationSummary(t *testing.T) {
+	tests := []struct {
+		status MigrationStatus
+		want   string
+	}{
+		{MigrationStatus{Framework: "rails", Latest: "20240101000000"}, "rails 20240101000000"},
+		{MigrationStatus{Framework: "goose", Latest: "3", Pending: []string{"4", "5"}, Missing: []string{"2"}}, "goose 3 (2 pending, 1 missing)"},
+		{MigrationStatus{Framework: "golang-migrate", Latest: "7", Dirty: true}, "golang-migrate 7 (dirty)"},
+		{MigrationStatus{Framework: "knex_migrations", Error: "permission denied"}, "knex_migrations (unreadable)"},
+		{MigrationStatus{Framework: "rails", Latest: "1", FilesError: "search of /workspace stopped"}, "rails 1 (files not checked)"},
+	}
+	for _, tt := range tests {
+		if got := tt.status.Summary(); got != tt.want {
+			t.Errorf("Summary() = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// overviewTables is how many of the largest tables the dashboard lists
+const overviewTables = 10
+
+// DBOverview summarizes the size of the live database and its largest tables
+type DBOverview struct {
+	Database   string
+	SizeBytes  int64
+	Size       string
+	TableCount int
+	DeadTuples int64
+	Tables     []TableStats
+}
+
+// TableStats describes one table. Sizes are in bytes; TableBytes is the main
+// relation only, so TotalBytes = TableBytes + IndexBytes + ToastBytes (plus
+// the free space and visibility maps).
+type TableStats struct {
+	Schema     string
+	Name       string
+	TableBytes int64
+	IndexBytes int64
+	ToastBytes int64
+	TotalBytes int64
+	TotalSize  string
+	TableSize  string
+	IndexSize  string
+	ToastSize  string
+	// EstimatedRows comes from pg_class.reltuples, which is only updated by
+	// VACUUM, ANALYZE and CREATE INDEX; -1 means the table was never analyzed
+	EstimatedRows   int64
+	LiveTuples      int64
+	DeadTuples      int64
+	DeadRatio       float64 // dead / (live + dead), 0 to 1
+	LastVacuum      *time.Time
+	LastAutovacuum  *time.Time
+	LastAnalyze     *time.Time
+	LastAutoanalyze *time.Time
+}
+
+// Vacuumed returns when the table was last vacuumed, by hand or by autovacuum
+func (t TableStats) Vacuumed() *time.Time {
+	return latest(t.LastVacuum, t.LastAutovacuum)
+}
+
+// Analyzed returns when the table was last analyzed, by hand or by autovacuum
+func (t TableStats) Analyzed() *time.Time {
+	return latest(t.LastAnalyze, t.LastAutoanalyze)
+}
+
+// DeadPercent is DeadRatio as a whole percentage, for the dashboard
+func (t TableStats) DeadPercent() int {
+	return int(t.DeadRatio*100 + 0.5)
+}
+
+func latest(a, b *time.Time) *time.Time {
+	if a == nil || (b != nil && b.After(*a)) {
+		return b
+	}
+	return a
+}
+
+// getDBOverview queries the live database for its size and its limit largest
+// tables, counting indexes and TOAST
+func getDBOverview(ctx context.Context, limit int) (*DBOverview, error) {
+	if db == nil {
+		return nil, fmt.Errorf("no connection to the database")
+	}
+	overview := &DBOverview{}
+	err := db.QueryRowContext(ctx, `
+		SELECT current_database(), pg_database_size(current_database()),
+			(SELECT count(*) FROM pg_stat_user_tables),
+			(SELECT coalesce(sum(n_dead_tup), 0) FROM pg_stat_user_tables)
+	`).Scan(&overview.Database, &overview.SizeBytes, &overview.TableCount, &overview.DeadTuples)
+	if err != nil {
+		return nil, err
+	}
+	overview.Size = formatSize(overview.SizeBytes)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT n.nspname, c.relname,
+			pg_relation_size(c.oid),
+			pg_indexes_size(c.oid),
+			CASE WHEN c.reltoastrelid = 0 THEN 0 ELSE pg_total_relation_size(c.reltoastrelid) END,
+			pg_total_relation_size(c.oid),
+			c.reltuples::bigint,
+			coalesce(s.n_live_tup, 0), coalesce(s.n_dead_tup, 0),
+			s.last_vacuum, s.last_autovacuum, s.last_analyze, s.last_autoanalyze
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_stat_user_tables s ON s.relid = c.oid
+		WHERE c.relkind IN ('r', 'm')
+			AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+			AND n.nspname NOT LIKE 'pg_toast%'
+		ORDER BY pg_total_relation_size(c.oid) DESC, n.nspname, c.relname
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t TableStats
+		var vacuum, autovacuum, analyze, autoanalyze sql.NullTime
+		if err := rows.Scan(&t.Schema, &t.Name, &t.TableBytes, &t.IndexBytes, &t.ToastBytes, &t.TotalBytes,
+			&t.EstimatedRows, &t.LiveTuples, &t.DeadTuples, &vacuum, &autovacuum, &analyze, &autoanalyze); err != nil {
+			return nil, err
+		}
+		t.TotalSize = formatSize(t.TotalBytes)
+		t.TableSize = formatSize(t.TableBytes)
+		t.IndexSize = formatSize(t.IndexBytes)
+		t.ToastSize = formatSize(t.ToastBytes)
+		if t.LiveTuples+t.DeadTuples > 0 {
+			t.DeadRatio = float64(t.DeadTuples) / float64(t.LiveTuples+t.DeadTuples)
+		}
+		t.LastVacuum = nullTime(vacuum)
+		t.LastAutovacuum = nullTime(autovacuum)
+		t.LastAnalyze = nullTime(analyze)
+		t.LastAutoanalyze = nullTime(autoanalyze)
+		overview.Tables = append(overview.Tables, t)
+	}
+	return overview, rows.Err()
+}
+
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// statusOverview is the overview for getStatus, which must not hang when
+// the database is busy or down
+func statusOverview(ctx context.Context) *DBOverview {
+	overview, err := getDBOverview(ctx, overviewTables)
+	if err != nil {
+		return nil
+	}
+	return overview
+}
+
+// handleDBOverview returns the database overview; limit sets how many tables
+// are listed (default 10)
+func handleDBOverview(w http.ResponseWriter, r *http.Request) {
+	limit := parseInt(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = overviewTables
+	}
+	overview, err := getDBOverview(r.Context(), limit)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"overview": overview,
+	})
+}
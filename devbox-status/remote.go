@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Sync directions
+const (
+	syncBoth = "both"
+	syncPush = "push"
+	syncPull = "pull"
+)
+
+var errNoRemote = errors.New("no remote snapshot storage configured (set SNAPSHOT_S3_BUCKET)")
+
+// transferSnapshot copies a snapshot and its sidecar, if any, from one store
+// to another. The sidecar goes last so a snapshot never shows up with the
+// metadata of an earlier copy.
+func transferSnapshot(ctx context.Context, job *Job, from, to SnapshotStore, name string) error {
+	info, err := from.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	job.logf("Copying %s (%s) from %s to %s", name, formatSize(info.Size), from, to)
+	job.update(func(j *JobInfo) { j.TotalBytes = info.Size })
+
+	r, err := from.Open(ctx, name)
+	if err != nil {
+		return err
+	}
+	err = to.Put(ctx, name, &countingReader{r: r, job: job}, info.Size)
+	r.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	sidecar := name + ".json"
+	meta, err := from.Stat(ctx, sidecar)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r, err = from.Open(ctx, sidecar)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return to.Put(ctx, sidecar, r, meta.Size)
+}
+
+// startTransferJob pushes (to the remote) or pulls (from it) one snapshot
+func startTransferJob(direction, filename string) (*Job, error) {
+	remote, err := remoteSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		return nil, errNoRemote
+	}
+	from, to := SnapshotStore(localSnapshots), remote
+	if direction == syncPull {
+		from, to = remote, localSnapshots
+	} else if strings.HasSuffix(filename, extDirectory) {
+		return nil, fmt.Errorf("directory-format snapshots cannot be pushed")
+	}
+
+	job := jobs.start(direction, filename, func(ctx context.Context, job *Job) error {
+		// A snapshot of the same name on the other side is another snapshot
+		// unless the sizes match
+		if existing, err := to.Stat(ctx, filename); err == nil {
+			if info, err := from.Stat(ctx, filename); err == nil && info.Size != existing.Size {
+				return fmt.Errorf("a different snapshot named %s already exists in %s", filename, to)
+			}
+		}
+		if err := transferSnapshot(ctx, job, from, to, filename); err != nil {
+			return err
+		}
+		if direction == syncPull {
+			invalidateCache()
+		}
+		return nil
+	})
+	return job, nil
+}
+
+// planSync compares the local and remote snapshots by name and size.
+// Snapshots with the same name but a different size are distinct snapshots
+// that happen to share a name (they only go down to the minute); they are
+// returned as conflicts and copied in neither direction. Pre-restore
+// snapshots and directory-format ones stay local.
+func planSync(ctx context.Context, remote SnapshotStore, mode string) (push, pull, conflicts []string, err error) {
+	local, err := localSnapshots.List(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stored, err := remote.List(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	localSizes := make(map[string]int64)
+	for _, s := range local {
+		localSizes[s.Name] = s.Size
+	}
+	remoteSizes := make(map[string]int64)
+	for _, s := range stored {
+		remoteSizes[s.Name] = s.Size
+		if size, ok := localSizes[s.Name]; ok && size != s.Size && !strings.HasSuffix(s.Name, extDirectory) {
+			conflicts = append(conflicts, s.Name)
+		}
+	}
+
+	if mode != syncPull {
+		for _, s := range local {
+			if _, ok := remoteSizes[s.Name]; ok || strings.HasSuffix(s.Name, extDirectory) {
+				continue
+			}
+			if meta, _ := readSnapshotMeta(localSnapshots.path(s.Name)); meta != nil && meta.Kind == kindPreRestore {
+				continue
+			}
+			push = append(push, s.Name)
+		}
+	}
+	if mode != syncPush {
+		for _, s := range stored {
+			if _, ok := localSizes[s.Name]; !ok {
+				pull = append(pull, s.Name)
+			}
+		}
+	}
+	sort.Strings(push)
+	sort.Strings(pull)
+	sort.Strings(conflicts)
+	return push, pull, conflicts, nil
+}
+
+// startSyncJob copies snapshots missing on either side. Snapshots that exist
+// on both sides are never overwritten; a size mismatch fails the job.
+func startSyncJob(mode string) (*Job, error) {
+	switch mode {
+	case syncBoth, syncPush, syncPull:
+	default:
+		return nil, fmt.Errorf("unknown sync mode %q (use both, push or pull)", mode)
+	}
+	remote, err := remoteSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		return nil, errNoRemote
+	}
+
+	job := jobs.start("sync", remote.String(), func(ctx context.Context, job *Job) error {
+		push, pull, conflicts, err := planSync(ctx, remote, mode)
+		if err != nil {
+			return err
+		}
+		job.logf("%d snapshot(s) to push, %d to pull", len(push), len(pull))
+
+		var failed []string
+		for _, name := range conflicts {
+			job.logf("%s differs between local and %s; rename one of them", name, remote)
+			failed = append(failed, name)
+		}
+		for _, name := range push {
+			if err := transferSnapshot(ctx, job, localSnapshots, remote, name); err != nil {
+				job.logf("Push failed: %v", err)
+				failed = append(failed, name)
+			}
+		}
+		for _, name := range pull {
+			if err := transferSnapshot(ctx, job, remote, localSnapshots, name); err != nil {
+				job.logf("Pull failed: %v", err)
+				failed = append(failed, name)
+			}
+		}
+		if len(pull) > 0 {
+			invalidateCache()
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("could not sync %s", strings.Join(failed, ", "))
+		}
+		return nil
+	})
+	return job, nil
+}
+
+// RemoteSnapshot is a snapshot in the remote store as shown on the dashboard
+type RemoteSnapshot struct {
+	Filename string `json:"filename"`
+	Size     string `json:"size"`
+	Date     string `json:"date"`
+	Local    bool   `json:"local"`
+}
+
+// handleRemoteSnapshots lists the snapshots in the remote store
+func handleRemoteSnapshots(w http.ResponseWriter, r *http.Request) {
+	fail := func(err error) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+	}
+
+	remote, err := remoteSnapshots()
+	if err == nil && remote == nil {
+		err = errNoRemote
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+	stored, err := remote.List(r.Context())
+	if err != nil {
+		fail(err)
+		return
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].ModTime.After(stored[j].ModTime) })
+
+	snapshots := []RemoteSnapshot{}
+	for _, s := range stored {
+		snapshots = append(snapshots, RemoteSnapshot{
+			Filename: s.Name,
+			Size:     formatSize(s.Size),
+			Date:     s.ModTime.Local().Format("2006-01-02 15:04"),
+			Local:    storeHas(r.Context(), localSnapshots, s.Name),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"remote":    remote.String(),
+		"snapshots": snapshots,
+	})
+}
+
+// handleRemoteTransfer serves /api/remote/push, /api/remote/pull and
+// /api/remote/sync
+func handleRemoteTransfer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var job *Job
+	var err error
+	switch action := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]; action {
+	case syncPush, syncPull:
+		filename := r.URL.Query().Get("filename")
+		if _, err := resolveSnapshotPath(filename); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		job, err = startTransferJob(action, filename)
+	default:
+		mode := r.URL.Query().Get("mode")
+		if mode == "" {
+			mode = syncBoth
+		}
+		job, err = startSyncJob(mode)
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	// Scripts can pass wait=1 to block until the transfer has finished
+	if r.URL.Query().Get("wait") != "" {
+		info := job.Wait()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": info.Status == jobSucceeded,
+			"error":   info.Error,
+			"job_id":  info.ID,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"job_id":  job.Info().ID,
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPlanSync(t *testing.T) {
+	local := useSnapshotsDir(t)
+	remoteDir := t.TempDir()
+	remote := &localStore{dir: remoteDir}
+
+	write := func(dir, name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(local, "2024-01-15T1030_only-local.dump", "a")
+	write(local, "2024-01-15T1031_same.dump", "same")
+	write(remoteDir, "2024-01-15T1031_same.dump", "same")
+	write(local, "2024-01-15T1032_clash.dump", "from this devbox")
+	write(remoteDir, "2024-01-15T1032_clash.dump", "from another devbox")
+	write(remoteDir, "2024-01-15T1033_only-remote.sql", "b")
+	write(local, "2024-01-15T1034_undo.dump", "c")
+	writeTestSnapshot(t, local, "2024-01-15T1034_undo.dump", &SnapshotMeta{Kind: kindPreRestore})
+
+	tests := []struct {
+		mode                      string
+		push, pull, wantConflicts []string
+	}{
+		{syncBoth, []string{"2024-01-15T1030_only-local.dump"}, []string{"2024-01-15T1033_only-remote.sql"}, []string{"2024-01-15T1032_clash.dump"}},
+		{syncPush, []string{"2024-01-15T1030_only-local.dump"}, nil, []string{"2024-01-15T1032_clash.dump"}},
+		{syncPull, nil, []string{"2024-01-15T1033_only-remote.sql"}, []string{"2024-01-15T1032_clash.dump"}},
+	}
+	for _, tt := range tests {
+		push, pull, conflicts, err := planSync(context.Background(), remote, tt.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(push, tt.push) || !reflect.DeepEqual(pull, tt.pull) || !reflect.DeepEqual(conflicts, tt.wantConflicts) {
+			t.Errorf("planSync(%s) = %v, %v, %v, want %v, %v, %v", tt.mode, push, pull, conflicts, tt.push, tt.pull, tt.wantConflicts)
+		}
+	}
+}
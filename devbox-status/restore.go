@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// RestoreError is a statement that failed while loading a snapshot
+type RestoreError struct {
+	Message   string
+	Statement string `json:",omitempty"`
+	Location  string `json:",omitempty"`
+}
+
+// databaseMu ensures only one restore or branch operation replaces or
+// clones POSTGRES_DB at a time
+var databaseMu sync.Mutex
+
+var errDatabaseBusy = errors.New("another restore or branch operation is already running")
+
+// startRestoreJob restores the snapshot at path in the background. Unless
+// safety is false, the current database is snapshotted before it is replaced.
+func startRestoreJob(filename, path string, safety bool) (*Job, error) {
+	if _, err := localSnapshots.Stat(context.Background(), filepath.Base(path)); err != nil {
+		return nil, err
+	}
+	if !databaseMu.TryLock() {
+		return nil, errDatabaseBusy
+	}
+
+	job := jobs.start("restore", filename, func(ctx context.Context, job *Job) error {
+		defer databaseMu.Unlock()
+		return runRestore(ctx, job, filename, path, safety)
+	})
+	return job, nil
+}
+
+// runRestore replaces POSTGRES_DB with the contents of a snapshot. The
+// snapshot is loaded into a freshly created scratch database first; only
+// once that succeeds without a single error is the scratch database swapped
+// in, so a failed or cancelled restore leaves the live database untouched.
+// When safety is set a pre-restore snapshot of the live database is taken
+// just before the swap so the restore can be undone.
+func runRestore(ctx context.Context, job *Job, filename, path string, safety bool) error {
+	if adminDB == nil {
+		return fmt.Errorf("no connection to the maintenance database")
+	}
+
+	dbName := getEnv("POSTGRES_DB", "devdb")
+	stamp := time.Now().Format("20060102150405")
+	scratch := scratchDBName(dbName, "restore_"+stamp)
+
+	job.update(func(info *JobInfo) { info.TotalBytes = snapshotSize(path) })
+	defer watchRestoreBlockers(ctx, job, dbName)()
+	if warning := partialRestoreWarning(path); warning != "" {
+		job.logf("Warning: %s", warning)
+	}
+
+	job.logf("Creating scratch database %s", scratch)
+	if err := createEmptyDatabase(ctx, scratch); err != nil {
+		return fmt.Errorf("could not create scratch database: %v", err)
+	}
+	swapped := false
+	defer func() {
+		if !swapped {
+			job.logf("Dropping scratch database %s", scratch)
+			dropDatabase(scratch)
+		}
+	}()
+
+	if err := loadSnapshot(ctx, job, path, scratch); err != nil {
+		return err
+	}
+
+	var safetyPath string
+	if safety && preRestoreSnapshotsEnabled() {
+		req := CreateSnapshotRequest{
+			Label:     kindPreRestore,
+			Kind:      kindPreRestore,
+			RestoreOf: filename,
+			Notes:     fmt.Sprintf("Automatic snapshot taken before restoring %s", filename),
+			Options:   SnapshotOptions{Format: formatCustom, Compression: -1, Encrypt: encryptionConfigured()},
+		}
+		safetyFile := snapshotFilename(req.Label, req.Options)
+		safetyPath = filepath.Join(snapshotsDir, safetyFile)
+
+		job.logf("Taking pre-restore snapshot %s", safetyFile)
+		if err := runSnapshot(ctx, nil, safetyPath, req); err != nil {
+			return fmt.Errorf("pre-restore snapshot failed: %v", err)
+		}
+	}
+
+	// The restored database takes over the live one's branch name
+	if branch := databaseBranch(dbName); branch != "" {
+		setDatabaseBranch(scratch, branch)
+	}
+
+	job.logf("Snapshot loaded; swapping %s into %s", scratch, dbName)
+	old := scratchDBName(dbName, "old_"+stamp)
+	if err := swapDatabase(ctx, job, scratch, dbName, old); err != nil {
+		// Nothing was restored, so there is nothing to undo
+		if safetyPath != "" {
+			deleteSnapshot(safetyPath)
+		}
+		return err
+	}
+	swapped = true
+
+	job.logf("Dropping previous database (now %s)", old)
+	if err := dropDatabase(old); err != nil {
+		job.logf("Warning: could not drop %s: %v", old, err)
+	}
+
+	job.logf("Restore complete")
+	return nil
+}
+
+// loadSnapshot restores the snapshot at path into target, collecting every
+// error reported by psql or pg_restore. Any error fails the load.
+// Data-only snapshots are loaded into the schema of POSTGRES_DB: its tables
+// are created first and its indexes and constraints added afterwards.
+func loadSnapshot(ctx context.Context, job *Job, path, target string) error {
+	if meta, _ := readSnapshotMeta(path); meta != nil && meta.Scope != nil && meta.Scope.DataOnly {
+		live := getEnv("POSTGRES_DB", "devdb")
+		job.logf("Data-only snapshot: creating the tables of %s first", live)
+		if err := copyDatabase(ctx, job, live, target, "--section=pre-data"); err != nil {
+			return fmt.Errorf("could not copy the schema of %s: %v", live, err)
+		}
+		if err := loadSnapshotData(ctx, job, path, target); err != nil {
+			return err
+		}
+		job.logf("Adding the indexes and constraints of %s", live)
+		if err := copyDatabase(ctx, job, live, target, "--section=post-data"); err != nil {
+			return fmt.Errorf("could not add indexes and constraints: %v", err)
+		}
+		return nil
+	}
+	return loadSnapshotData(ctx, job, path, target)
+}
+
+func loadSnapshotData(ctx context.Context, job *Job, path, target string) error {
+	cmd, closer, err := restoreCommand(ctx, path, target, job)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	collector := &restoreErrorCollector{}
+	runErr := runJobCommand(job, cmd, collector.observe)
+
+	errs := collector.Errors()
+	if len(errs) > 0 {
+		job.update(func(info *JobInfo) { info.Errors = errs })
+		return fmt.Errorf("restore failed with %d error(s); first: %s", len(errs), errs[0].Message)
+	}
+	return runErr
+}
+
+// swapDatabase replaces live with replacement. New connections to live are
+// refused, existing sessions get RESTORE_DRAIN_TIMEOUT seconds to finish
+// before being terminated, then live is renamed to old and replacement to
+// live. If the rename fails the original database is put back. The caller
+// decides what happens to old, which still refuses connections.
+func swapDatabase(ctx context.Context, job *Job, replacement, live, old string) error {
+	if err := setAllowConnections(ctx, live, false); err != nil {
+		return fmt.Errorf("could not block new connections to %s: %v", live, err)
+	}
+	allow := func(name string) {
+		if err := setAllowConnections(context.Background(), name, true); err != nil {
+			job.logf("Warning: could not re-enable connections to %s: %v", name, err)
+		}
+	}
+
+	if err := drainConnections(ctx, job, live); err != nil {
+		allow(live)
+		return err
+	}
+
+	if _, err := adminDB.Exec(fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", pq.QuoteIdentifier(live), pq.QuoteIdentifier(old))); err != nil {
+		allow(live)
+		return fmt.Errorf("could not rename %s: %v", live, err)
+	}
+	if _, err := adminDB.Exec(fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", pq.QuoteIdentifier(replacement), pq.QuoteIdentifier(live))); err != nil {
+		if _, rerr := adminDB.Exec(fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", pq.QuoteIdentifier(old), pq.QuoteIdentifier(live))); rerr != nil {
+			job.logf("Error: could not rename %s back to %s: %v", old, live, rerr)
+		}
+		allow(live)
+		return fmt.Errorf("could not rename %s to %s: %v", replacement, live, err)
+	}
+
+	resetDBPool()
+	return nil
+}
+
+// setAllowConnections toggles whether new sessions may connect to name
+func setAllowConnections(ctx context.Context, name string, allow bool) error {
+	_, err := adminDB.ExecContext(ctx, fmt.Sprintf("ALTER DATABASE %s WITH ALLOW_CONNECTIONS %t", pq.QuoteIdentifier(name), allow))
+	return err
+}
+
+// resetDBPool discards idle connections to POSTGRES_DB. Connections held by
+// devbox-status itself are terminated when the database is swapped or
+// cloned, so the pool has to reconnect.
+func resetDBPool() {
+	if db != nil {
+		db.SetMaxIdleConns(0)
+		db.SetMaxIdleConns(2)
+	}
+}
+
+// drainConnections waits for sessions on dbName to disconnect, then
+// terminates whatever is left. The sessions are published as the job's
+// BlockedBy while it waits, so they can be terminated sooner by hand.
+func drainConnections(ctx context.Context, job *Job, dbName string) error {
+	timeout := time.Duration(parseInt(getEnv("RESTORE_DRAIN_TIMEOUT", "5"))) * time.Second
+	deadline := time.Now().Add(timeout)
+	defer setBlockedBy(job, nil)
+	reported := false
+
+	for {
+		var count int
+		err := adminDB.QueryRowContext(ctx, `
+			SELECT count(*) FROM pg_stat_activity
+			WHERE datname = $1 AND pid <> pg_backend_pid()
+		`, dbName).Scan(&count)
+		if err != nil {
+			return fmt.Errorf("could not list connections to %s: %v", dbName, err)
+		}
+		if count == 0 {
+			return nil
+		}
+		if !reported {
+			reported = true
+			if sessions, err := listSessions(ctx, dbName); err == nil && len(sessions) > 0 {
+				described := make([]string, len(sessions))
+				for i, s := range sessions {
+					described[i] = s.Describe()
+				}
+				job.logf("Waiting up to %s for %d connection(s) to %s: %s", timeout, count, dbName, strings.Join(described, "; "))
+				setBlockedBy(job, sessions)
+			}
+		}
+		if time.Now().After(deadline) {
+			job.logf("Terminating %d remaining connection(s) to %s", count, dbName)
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	return terminateConnections(ctx, dbName)
+}
+
+// terminateConnections disconnects every other session on dbName and waits
+// for the backends to exit
+func terminateConnections(ctx context.Context, dbName string) error {
+	_, err := adminDB.ExecContext(ctx, `
+		SELECT pg_terminate_backend(pid) FROM pg_stat_activity
+		WHERE datname = $1 AND pid <> pg_backend_pid()
+	`, dbName)
+	if err != nil {
+		return fmt.Errorf("could not terminate connections to %s: %v", dbName, err)
+	}
+
+	for i := 0; i < 50; i++ {
+		var count int
+		if err := adminDB.QueryRowContext(ctx, `
+			SELECT count(*) FROM pg_stat_activity
+			WHERE datname = $1 AND pid <> pg_backend_pid()
+		`, dbName).Scan(&count); err != nil || count == 0 {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("connections to %s did not terminate", dbName)
+}
+
+// scratchDBName derives a database name from base and suffix that fits in
+// PostgreSQL's 63 byte identifier limit
+func scratchDBName(base, suffix string) string {
+	const maxIdentifier = 63
+	if len(base)+1+len(suffix) > maxIdentifier {
+		base = base[:maxIdentifier-1-len(suffix)]
+	}
+	return base + "_" + suffix
+}
+
+// createEmptyDatabase creates a database from template0 owned by POSTGRES_USER
+func createEmptyDatabase(ctx context.Context, name string) error {
+	_, err := adminDB.ExecContext(ctx, fmt.Sprintf("CREATE DATABASE %s TEMPLATE template0 OWNER %s",
+		pq.QuoteIdentifier(name), pq.QuoteIdentifier(getEnv("POSTGRES_USER", "postgres"))))
+	return err
+}
+
+// dropDatabase drops name, disconnecting anyone still using it
+func dropDatabase(name string) error {
+	_, err := adminDB.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s WITH (FORCE)", pq.QuoteIdentifier(name)))
+	return err
+}
+
+var (
+	psqlErrorRe      = regexp.MustCompile(`^psql:([^:]*:\d+): (?:ERROR|FATAL):\s+(.*)$`)
+	pgRestoreErrorRe = regexp.MustCompile(`^pg_restore: error: (.*)$`)
+)
+
+// restoreErrorCollector parses psql and pg_restore output into RestoreErrors.
+//
+// psql (run with --echo-errors) reports
+//
+//	psql:<stdin>:42: ERROR:  relation "users" does not exist
+//	psql:<stdin>:42: STATEMENT:  INSERT INTO users ...
+//
+// and pg_restore reports
+//
+//	pg_restore: error: could not execute query: ERROR:  ...
+//	Command was: CREATE TABLE ...
+//
+// pg_restore names the TOC entry being processed before the error itself.
+type restoreErrorCollector struct {
+	mu          sync.Mutex
+	errs        []RestoreError
+	tocEntry    string
+	inStatement bool
+}
+
+func (c *restoreErrorCollector) observe(line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if m := psqlErrorRe.FindStringSubmatch(line); m != nil {
+		c.errs = append(c.errs, RestoreError{Location: m[1], Message: m[2]})
+		c.inStatement = false
+		return
+	}
+	if i := strings.Index(line, ": STATEMENT:  "); strings.HasPrefix(line, "psql:") && i >= 0 && len(c.errs) > 0 {
+		c.errs[len(c.errs)-1].Statement = line[i+len(": STATEMENT:  "):]
+		c.inStatement = true
+		return
+	}
+	if m := pgRestoreErrorRe.FindStringSubmatch(line); m != nil {
+		c.errs = append(c.errs, RestoreError{Location: c.tocEntry, Message: m[1]})
+		c.tocEntry = ""
+		c.inStatement = false
+		return
+	}
+	if strings.HasPrefix(line, "Command was: ") && len(c.errs) > 0 {
+		c.errs[len(c.errs)-1].Statement = strings.TrimPrefix(line, "Command was: ")
+		c.inStatement = true
+		return
+	}
+	if strings.HasPrefix(line, "pg_restore: from TOC entry ") {
+		c.tocEntry = strings.TrimPrefix(line, "pg_restore: from ")
+		c.inStatement = false
+		return
+	}
+
+	// Multi-line statements continue until the next prefixed line
+	if c.inStatement && !strings.HasPrefix(line, "psql:") && !strings.HasPrefix(line, "pg_restore:") {
+		c.errs[len(c.errs)-1].Statement += "\n" + line
+		return
+	}
+	c.inStatement = false
+}
+
+func (c *restoreErrorCollector) Errors() []RestoreError {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]RestoreError(nil), c.errs...)
+}
+
+// preRestoreSnapshotsEnabled reports whether restores take a safety snapshot
+// first (PRE_RESTORE_SNAPSHOT, enabled by default)
+func preRestoreSnapshotsEnabled() bool {
+	return getEnv("PRE_RESTORE_SNAPSHOT", "true") != "false"
+}
+
+// restoreUndoWindow is how long after a restore it can be undone
+func restoreUndoWindow() time.Duration {
+	window, err := time.ParseDuration(getEnv("RESTORE_UNDO_WINDOW", "1h"))
+	if err != nil {
+		return time.Hour
+	}
+	return window
+}
+
+// LastRestore describes the most recent restore that can still be undone
+type LastRestore struct {
+	Snapshot   string // pre-restore snapshot holding the data that was replaced
+	RestoreOf  string // snapshot that was restored
+	RestoredAt time.Time
+	UndoUntil  time.Time
+}
+
+// preRestoreSnapshots returns pre-restore snapshot paths and their metadata,
+// newest first
+func preRestoreSnapshots() ([]string, map[string]*SnapshotMeta) {
+	files, _ := listSnapshotFiles()
+	metas := make(map[string]*SnapshotMeta)
+	var matches []string
+	for _, file := range files {
+		meta, err := readSnapshotMeta(file)
+		if err != nil || meta.Kind != kindPreRestore {
+			continue
+		}
+		metas[file] = meta
+		matches = append(matches, file)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return metas[matches[i]].CreatedAt.After(metas[matches[j]].CreatedAt)
+	})
+	return matches, metas
+}
+
+// getLastRestore returns the newest pre-restore snapshot if it is still
+// within RESTORE_UNDO_WINDOW, or nil.
+func getLastRestore() *LastRestore {
+	files, metas := preRestoreSnapshots()
+	if len(files) == 0 {
+		return nil
+	}
+	meta := metas[files[0]]
+	until := meta.CreatedAt.Add(restoreUndoWindow())
+	if time.Now().After(until) {
+		return nil
+	}
+	return &LastRestore{
+		Snapshot:   filepath.Base(files[0]),
+		RestoreOf:  meta.RestoreOf,
+		RestoredAt: meta.CreatedAt,
+		UndoUntil:  until,
+	}
+}
+
+// preRestoreKeep is how many pre-restore snapshots are kept
+// (PRE_RESTORE_KEEP, default 5, at least 1)
+func preRestoreKeep() int {
+	keep := parseInt(getEnv("PRE_RESTORE_KEEP", "5"))
+	if keep < 1 {
+		keep = 1
+	}
+	return keep
+}
+
+// prunePreRestoreSnapshots keeps the newest PRE_RESTORE_KEEP pre-restore
+// snapshots (default 5). They are pruned on their own so that automatic
+// snapshots never push out named ones.
+func prunePreRestoreSnapshots(job *Job) {
+	keep := preRestoreKeep()
+	files, _ := preRestoreSnapshots()
+	if len(files) <= keep {
+		return
+	}
+	for _, file := range files[keep:] {
+		job.logf("Pruning old pre-restore snapshot %s", filepath.Base(file))
+		if err := deleteSnapshot(file); err != nil {
+			log.Printf("Warning: Could not prune %s: %v", file, err)
+		}
+	}
+}
+
+func handleUndoRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	last := getLastRestore()
+	if last == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "No restore to undo",
+		})
+		return
+	}
+
+	// The undo itself takes a pre-restore snapshot, so it can be redone
+	job, err := startRestoreJob(last.Snapshot, filepath.Join(snapshotsDir, last.Snapshot), true)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"job_id":   job.Info().ID,
+		"filename": last.Snapshot,
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRestoreErrorCollector(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  []RestoreError
+	}{
+		{
+			name:  "no errors",
+			lines: []string{"SET", "CREATE TABLE", "pg_restore: creating TABLE \"public.users\""},
+			want:  nil,
+		},
+		{
+			name: "psql error with statement",
+			lines: []string{
+				"psql:/snapshots/x.sql:12: ERROR:  relation \"users\" already exists",
+				"psql:/snapshots/x.sql:12: STATEMENT:  CREATE TABLE users (",
+				"    id integer",
+				");",
+				"psql:/snapshots/x.sql:20: NOTICE:  extension \"citext\" already exists, skipping",
+			},
+			want: []RestoreError{{
+				Location:  "/snapshots/x.sql:12",
+				Message:   "relation \"users\" already exists",
+				Statement: "CREATE TABLE users (\n    id integer\n);",
+			}},
+		},
+		{
+			name: "pg_restore error with TOC entry",
+			lines: []string{
+				"pg_restore: from TOC entry 215; 1259 16385 TABLE users postgres",
+				"pg_restore: error: could not execute query: ERROR:  type \"citext\" does not exist",
+				"Command was: CREATE TABLE public.users (",
+				"    email citext",
+				");",
+				"pg_restore: creating INDEX \"public.users_email\"",
+			},
+			want: []RestoreError{{
+				Location:  "TOC entry 215; 1259 16385 TABLE users postgres",
+				Message:   "could not execute query: ERROR:  type \"citext\" does not exist",
+				Statement: "CREATE TABLE public.users (\n    email citext\n);",
+			}},
+		},
+		{
+			name: "TOC entry is used once",
+			lines: []string{
+				"pg_restore: from TOC entry 215; 1259 16385 TABLE users postgres",
+				"pg_restore: error: first",
+				"pg_restore: error: second",
+			},
+			want: []RestoreError{
+				{Location: "TOC entry 215; 1259 16385 TABLE users postgres", Message: "first"},
+				{Message: "second"},
+			},
+		},
+		{
+			name: "fatal psql error",
+			lines: []string{
+				"psql:/snapshots/x.sql:1: FATAL:  terminating connection",
+			},
+			want: []RestoreError{{Location: "/snapshots/x.sql:1", Message: "terminating connection"}},
+		},
+		{
+			name: "statement without an error is ignored",
+			lines: []string{
+				"Command was: DROP TABLE users;",
+				"psql:/snapshots/x.sql:3: STATEMENT:  SELECT 1;",
+			},
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c restoreErrorCollector
+			for _, line := range tt.lines {
+				c.observe(line)
+			}
+			if got := c.Errors(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Errors() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy decides which unlabelled snapshots are kept. A zero value
+// for a rule disables it; a policy with every rule disabled prunes nothing.
+type RetentionPolicy struct {
+	KeepLast   int // newest N snapshots
+	KeepDaily  int // newest snapshot of each of the last N days
+	KeepWeekly int // newest snapshot of each of the last N weeks
+}
+
+func retentionPolicy() RetentionPolicy {
+	return RetentionPolicy{
+		KeepLast:   parseInt(getEnv("RETAIN_LAST", "0")),
+		KeepDaily:  parseInt(getEnv("RETAIN_DAILY", "0")),
+		KeepWeekly: parseInt(getEnv("RETAIN_WEEKLY", "0")),
+	}
+}
+
+func (p RetentionPolicy) Enabled() bool {
+	return p.KeepLast > 0 || p.KeepDaily > 0 || p.KeepWeekly > 0
+}
+
+func (p RetentionPolicy) String() string {
+	if !p.Enabled() {
+		return "disabled"
+	}
+	var rules []string
+	if p.KeepLast > 0 {
+		rules = append(rules, fmt.Sprintf("last %d", p.KeepLast))
+	}
+	if p.KeepDaily > 0 {
+		rules = append(rules, fmt.Sprintf("%d daily", p.KeepDaily))
+	}
+	if p.KeepWeekly > 0 {
+		rules = append(rules, fmt.Sprintf("%d weekly", p.KeepWeekly))
+	}
+	return strings.Join(rules, ", ")
+}
+
+// RetentionDecision explains what the policy does with one snapshot
+type RetentionDecision struct {
+	Filename string
+	Keep     bool
+	Reasons  []string
+}
+
+// RetentionPlan is the outcome of applying a policy to the snapshots directory
+type RetentionPlan struct {
+	Policy    string
+	Decisions []RetentionDecision
+	Delete    []string
+}
+
+// planRetention works out which snapshots the policy would delete. Pinned
+// and labelled snapshots are always kept, as are snapshots still being
+// written. Pre-restore snapshots are pruned separately and ignored here.
+func planRetention(policy RetentionPolicy, now time.Time) RetentionPlan {
+	plan := RetentionPlan{Policy: policy.String()}
+
+	files, _ := listSnapshotFiles()
+	busy := jobs.activeTargets()
+
+	type candidate struct {
+		file    string
+		created time.Time
+	}
+	var candidates []candidate
+	decisions := make(map[string]*RetentionDecision)
+
+	for _, file := range files {
+		name := filepath.Base(file)
+		meta, _ := readSnapshotMeta(file)
+		if meta != nil && meta.Kind == kindPreRestore {
+			continue
+		}
+
+		d := &RetentionDecision{Filename: name}
+		decisions[name] = d
+
+		switch {
+		case busy[name]:
+			d.Keep, d.Reasons = true, []string{"in use"}
+		case meta != nil && meta.Pinned:
+			d.Keep, d.Reasons = true, []string{"pinned"}
+		case snapshotLabel(name, meta) != "":
+			d.Keep, d.Reasons = true, []string{"labelled"}
+		default:
+			candidates = append(candidates, candidate{file: name, created: snapshotTime(file, meta)})
+		}
+	}
+
+	// Newest first, so the first snapshot seen for a day or week is kept
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].created.After(candidates[j].created)
+	})
+
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	dailyCutoff := now.AddDate(0, 0, -policy.KeepDaily)
+	weeklyCutoff := now.AddDate(0, 0, -7*policy.KeepWeekly)
+
+	for i, c := range candidates {
+		d := decisions[c.file]
+		if i < policy.KeepLast {
+			d.Reasons = append(d.Reasons, "last")
+		}
+		if day := c.created.Format("2006-01-02"); policy.KeepDaily > 0 && c.created.After(dailyCutoff) && !days[day] {
+			days[day] = true
+			d.Reasons = append(d.Reasons, "daily")
+		}
+		year, week := c.created.ISOWeek()
+		if key := fmt.Sprintf("%d-W%02d", year, week); policy.KeepWeekly > 0 && c.created.After(weeklyCutoff) && !weeks[key] {
+			weeks[key] = true
+			d.Reasons = append(d.Reasons, "weekly")
+		}
+		d.Keep = len(d.Reasons) > 0 || !policy.Enabled()
+		if !d.Keep {
+			plan.Delete = append(plan.Delete, c.file)
+		}
+	}
+
+	for _, file := range files {
+		if d, ok := decisions[filepath.Base(file)]; ok {
+			plan.Decisions = append(plan.Decisions, *d)
+		}
+	}
+	return plan
+}
+
+// applyRetention deletes the snapshots selected by the policy
+func applyRetention(policy RetentionPolicy) (RetentionPlan, error) {
+	plan := planRetention(policy, time.Now())
+	var failed []string
+	for _, name := range plan.Delete {
+		log.Printf("Retention: deleting snapshot %s", name)
+		if err := deleteSnapshot(filepath.Join(snapshotsDir, name)); err != nil {
+			log.Printf("Retention: could not delete %s: %v", name, err)
+			failed = append(failed, name)
+		}
+	}
+	if len(plan.Delete) > 0 {
+		invalidateCache()
+	}
+	if len(failed) > 0 {
+		return plan, fmt.Errorf("could not delete %s", strings.Join(failed, ", "))
+	}
+	return plan, nil
+}
+
+// runRetentionPruner applies the retention policy every RETENTION_INTERVAL
+// (default 1h) for as long as the process runs.
+func runRetentionPruner() {
+	interval, err := time.ParseDuration(getEnv("RETENTION_INTERVAL", "1h"))
+	if err != nil || interval <= 0 {
+		interval = time.Hour
+	}
+
+	for {
+		if policy := retentionPolicy(); policy.Enabled() {
+			applyRetention(policy)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// snapshotLabel returns the label of a snapshot: from its metadata if
+// present, otherwise from a <timestamp>_<label>.<ext> filename. Files that
+// don't follow the naming scheme were named by hand and count as labelled.
+func snapshotLabel(filename string, meta *SnapshotMeta) string {
+	if meta != nil {
+		return meta.Label
+	}
+	stem := strings.TrimSuffix(filename, extEncrypted)
+	for _, ext := range []string{extPlainCompressed, extPlain, extCustom, extDirectory} {
+		if strings.HasSuffix(stem, ext) {
+			stem = strings.TrimSuffix(stem, ext)
+			break
+		}
+	}
+	const timestampLayout = "2006-01-02T1504"
+	if len(stem) < len(timestampLayout) {
+		return stem
+	}
+	if _, err := time.Parse(timestampLayout, stem[:len(timestampLayout)]); err != nil {
+		return stem
+	}
+	if rest := stem[len(timestampLayout):]; strings.HasPrefix(rest, "_") {
+		return rest[1:]
+	}
+	return ""
+}
+
+// snapshotTime is when a snapshot was taken, falling back to its mtime
+func snapshotTime(path string, meta *SnapshotMeta) time.Time {
+	if meta != nil && !meta.CreatedAt.IsZero() {
+		return meta.CreatedAt
+	}
+	if s, err := localSnapshots.Stat(context.Background(), filepath.Base(path)); err == nil {
+		return s.ModTime
+	}
+	return time.Time{}
+}
+
+// handleRetention reports what the retention policy would delete (dry run)
+func handleRetention(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(planRetention(retentionPolicy(), time.Now()))
+}
+
+func handlePrune(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	policy := retentionPolicy()
+	if !policy.Enabled() {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "No retention policy configured (set RETAIN_LAST, RETAIN_DAILY or RETAIN_WEEKLY)",
+		})
+		return
+	}
+
+	plan, err := applyRetention(policy)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"deleted": plan.Delete,
+	})
+}
+
+func handlePinSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path, err := resolveSnapshotPath(r.URL.Query().Get("filename"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Without the snapshot the sidecar would be an orphan
+	if _, err := os.Stat(path); err != nil {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return
+	}
+	pinned := r.URL.Query().Get("pinned") != "false"
+
+	meta, err := readOrInitSnapshotMeta(path)
+	if err == nil {
+		meta.Pinned = pinned
+		err = writeSnapshotMeta(path, meta)
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	invalidateCache()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"pinned":  pinned,
+	})
+}
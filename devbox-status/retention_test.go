@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// useSnapshotsDir points snapshotsDir and the local store at a temporary
+// directory for the duration of the test
+func useSnapshotsDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	oldDir, oldStore := snapshotsDir, localSnapshots
+	snapshotsDir, localSnapshots = dir, &localStore{dir: dir}
+	t.Cleanup(func() { snapshotsDir, localSnapshots = oldDir, oldStore })
+	return dir
+}
+
+// writeTestSnapshot creates an empty snapshot file with a sidecar
+func writeTestSnapshot(t *testing.T, dir, name string, meta *SnapshotMeta) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSnapshotMeta(path, meta); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlanRetention(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC) // a Friday
+	ago := func(hours int) time.Time { return now.Add(-time.Duration(hours) * time.Hour) }
+
+	snapshots := []struct {
+		name string
+		meta *SnapshotMeta
+	}{
+		{"a.dump", &SnapshotMeta{CreatedAt: ago(1)}},
+		{"b.dump", &SnapshotMeta{CreatedAt: ago(2)}},
+		{"c.dump", &SnapshotMeta{CreatedAt: ago(25)}},
+		{"d.dump", &SnapshotMeta{CreatedAt: ago(26)}},
+		{"e.dump", &SnapshotMeta{CreatedAt: ago(24 * 8)}},
+		{"f.dump", &SnapshotMeta{CreatedAt: ago(24 * 30)}},
+		{"labelled.dump", &SnapshotMeta{CreatedAt: ago(24 * 60), Label: "seed"}},
+		{"pinned.dump", &SnapshotMeta{CreatedAt: ago(24 * 60), Pinned: true}},
+		{"undo.dump", &SnapshotMeta{CreatedAt: ago(24 * 60), Kind: kindPreRestore}},
+	}
+
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		delete []string
+	}{
+		{"disabled", RetentionPolicy{}, nil},
+		{"last 2", RetentionPolicy{KeepLast: 2}, []string{"c.dump", "d.dump", "e.dump", "f.dump"}},
+		{"2 daily", RetentionPolicy{KeepDaily: 2}, []string{"b.dump", "d.dump", "e.dump", "f.dump"}},
+		{"2 weekly", RetentionPolicy{KeepWeekly: 2}, []string{"b.dump", "c.dump", "d.dump", "f.dump"}},
+		{"rules combine", RetentionPolicy{KeepLast: 1, KeepDaily: 2, KeepWeekly: 5}, []string{"b.dump", "d.dump"}},
+	}
+
+	dir := useSnapshotsDir(t)
+	for _, s := range snapshots {
+		writeTestSnapshot(t, dir, s.name, s.meta)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := planRetention(tt.policy, now)
+			got := append([]string(nil), plan.Delete...)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.delete) {
+				t.Errorf("Delete = %v, want %v", got, tt.delete)
+			}
+
+			reasons := make(map[string][]string)
+			for _, d := range plan.Decisions {
+				reasons[d.Filename] = d.Reasons
+			}
+			if _, ok := reasons["undo.dump"]; ok {
+				t.Errorf("pre-restore snapshot was considered")
+			}
+			if r := reasons["labelled.dump"]; !reflect.DeepEqual(r, []string{"labelled"}) {
+				t.Errorf("labelled.dump reasons = %v", r)
+			}
+			if r := reasons["pinned.dump"]; !reflect.DeepEqual(r, []string{"pinned"}) {
+				t.Errorf("pinned.dump reasons = %v", r)
+			}
+		})
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Store keeps snapshots in an S3-compatible bucket (AWS S3, MinIO, ...)
+// under an optional prefix. Requests use path-style addressing and are
+// signed with AWS Signature Version 4; bodies are sent unsigned so uploads
+// can be streamed. Snapshots larger than a part are uploaded in parts.
+type s3Store struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+const (
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	emptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// s3PartSize is the smallest part of a multipart upload; larger objects
+	// get larger parts to stay within S3's 10000 parts
+	s3PartSize = 64 << 20
+	s3MaxParts = 10000
+)
+
+// s3SecretKey reads SNAPSHOT_S3_SECRET_KEY, or the file the entrypoint
+// moves it to
+func s3SecretKey() string {
+	if key := getEnv("SNAPSHOT_S3_SECRET_KEY", ""); key != "" {
+		return key
+	}
+	data, _ := os.ReadFile("/etc/secrets/s3_secret_key")
+	return strings.TrimSpace(string(data))
+}
+
+// remoteSnapshots returns the configured remote store, or nil if
+// SNAPSHOT_S3_BUCKET is not set
+func remoteSnapshots() (SnapshotStore, error) {
+	bucket := getEnv("SNAPSHOT_S3_BUCKET", "")
+	if bucket == "" {
+		return nil, nil
+	}
+	region := getEnv("SNAPSHOT_S3_REGION", "us-east-1")
+	endpoint, err := url.Parse(getEnv("SNAPSHOT_S3_ENDPOINT", "https://s3."+region+".amazonaws.com"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid SNAPSHOT_S3_ENDPOINT %q", getEnv("SNAPSHOT_S3_ENDPOINT", ""))
+	}
+	prefix := strings.Trim(getEnv("SNAPSHOT_S3_PREFIX", ""), "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Store{
+		endpoint:  endpoint,
+		bucket:    bucket,
+		prefix:    prefix,
+		region:    region,
+		accessKey: getEnv("SNAPSHOT_S3_ACCESS_KEY", ""),
+		secretKey: s3SecretKey(),
+		client:    &http.Client{},
+	}, nil
+}
+
+// remoteName describes the remote store for the dashboard, or "" if there is
+// none
+func remoteName() string {
+	if remote, err := remoteSnapshots(); err == nil && remote != nil {
+		return remote.String()
+	}
+	return ""
+}
+
+func (s *s3Store) String() string {
+	return "s3://" + s.bucket + "/" + s.prefix
+}
+
+// objectURL builds the URL of key in the bucket with the given query
+func (s *s3Store) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = awsEscape(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+func (s *s3Store) do(ctx context.Context, method string, u *url.URL, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	payload := emptyPayload
+	if body != nil {
+		payload = unsignedPayload
+		req.ContentLength = size
+	}
+	s.sign(req, payload, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound && method != http.MethodPut && method != http.MethodPost {
+			return nil, errNotStored(strings.TrimPrefix(u.Path, "/"+s.bucket+"/"))
+		}
+		return nil, s3Error(resp)
+	}
+	return resp, nil
+}
+
+// s3Error turns an S3 error response into an error
+func s3Error(resp *http.Response) error {
+	var e struct {
+		Code    string
+		Message string
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+		return fmt.Errorf("s3: %s: %s", e.Code, e.Message)
+	}
+	return fmt.Errorf("s3: %s", resp.Status)
+}
+
+func (s *s3Store) List(ctx context.Context) ([]StoredSnapshot, error) {
+	var snapshots []StoredSnapshot
+	query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+	for {
+		resp, err := s.do(ctx, http.MethodGet, s.objectURL("", query), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: could not read listing: %v", err)
+		}
+
+		for _, obj := range result.Contents {
+			name := strings.TrimPrefix(obj.Key, s.prefix)
+			if strings.Contains(name, "/") || strings.HasPrefix(name, ".") || !isSnapshotFile(name) {
+				continue
+			}
+			snapshots = append(snapshots, StoredSnapshot{Name: name, Size: obj.Size, ModTime: obj.LastModified})
+		}
+		if !result.IsTruncated {
+			return snapshots, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *s3Store) Stat(ctx context.Context, name string) (StoredSnapshot, error) {
+	resp, err := s.do(ctx, http.MethodHead, s.objectURL(s.prefix+name, nil), nil, 0)
+	if err != nil {
+		return StoredSnapshot{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return StoredSnapshot{Name: name, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *s3Store) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.objectURL(s.prefix+name, nil), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Store) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("%s: size must be known to upload to S3", name)
+	}
+	if size > s3PartSize {
+		return s.putMultipart(ctx, name, r, size)
+	}
+	// Keep r from being closed by the HTTP client and send empty bodies
+	// with an explicit zero length
+	body := io.NopCloser(r)
+	if size == 0 {
+		body = http.NoBody
+	}
+	resp, err := s.do(ctx, http.MethodPut, s.objectURL(s.prefix+name, nil), body, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// putMultipart uploads size bytes of r in parts, since a single PUT is
+// limited to 5 GB. The upload is aborted if any part fails, so the bucket
+// is not left holding its parts.
+func (s *s3Store) putMultipart(ctx context.Context, name string, r io.Reader, size int64) error {
+	key := s.prefix + name
+	resp, err := s.do(ctx, http.MethodPost, s.objectURL(key, url.Values{"uploads": {""}}), http.NoBody, 0)
+	if err != nil {
+		return err
+	}
+	var upload struct {
+		UploadId string
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&upload)
+	resp.Body.Close()
+	if err != nil || upload.UploadId == "" {
+		return fmt.Errorf("s3: could not start multipart upload: %v", err)
+	}
+
+	err = s.uploadParts(ctx, key, upload.UploadId, r, size)
+	if err != nil {
+		// Abort with a fresh context: ctx may be why the upload failed
+		abortCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if resp, abortErr := s.do(abortCtx, http.MethodDelete, s.objectURL(key, url.Values{"uploadId": {upload.UploadId}}), nil, 0); abortErr == nil {
+			resp.Body.Close()
+		}
+	}
+	return err
+}
+
+// completedPart is a part of a multipart upload, as listed in
+// CompleteMultipartUpload
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (s *s3Store) uploadParts(ctx context.Context, key, uploadID string, r io.Reader, size int64) error {
+	partSize := max(int64(s3PartSize), (size+s3MaxParts-1)/s3MaxParts)
+	var parts []completedPart
+	for offset := int64(0); offset < size; offset += partSize {
+		n := min(partSize, size-offset)
+		number := len(parts) + 1
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		resp, err := s.do(ctx, http.MethodPut, s.objectURL(key, query), io.NopCloser(io.LimitReader(r, n)), n)
+		if err != nil {
+			return fmt.Errorf("part %d: %v", number, err)
+		}
+		resp.Body.Close()
+		parts = append(parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodPost, s.objectURL(key, url.Values{"uploadId": {uploadID}}), bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// CompleteMultipartUpload can fail after answering 200, with an Error
+	// document as the body
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if err := xml.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("s3: could not read the multipart upload result: %v", err)
+	}
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("s3: %s: %s", result.Code, result.Message)
+	}
+	return nil
+}
+
+func (s *s3Store) Delete(ctx context.Context, name string) error {
+	for _, key := range []string{name, name + ".json"} {
+		resp, err := s.do(ctx, http.MethodDelete, s.objectURL(s.prefix+key, nil), nil, 0)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// sign adds AWS Signature Version 4 headers to req. The signed headers are
+// host and every x-amz-* header.
+func (s *s3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes a query string the way Signature Version 4 expects:
+// sorted by key, with every value escaped
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, awsEscape(key, true)+"="+awsEscape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscape percent-encodes everything except unreserved characters, and
+// slashes too if encodeSlash is set
+func awsEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteString("%" + strings.ToUpper(strconv.FormatInt(int64(c)|0x100, 16)[1:]))
+		}
+	}
+	return b.String()
+}
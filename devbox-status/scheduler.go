@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// kindScheduled marks snapshots taken by the scheduler. They are unlabelled,
+// so retention rules apply to them like any other snapshot.
+const kindScheduled = "scheduled"
+
+// ScheduleStatus is shown on the dashboard for each configured schedule
+type ScheduleStatus struct {
+	Name       string
+	Expr       string
+	NextRun    time.Time
+	LastRun    time.Time
+	LastResult string
+}
+
+// scheduler runs action whenever one of its cron expressions falls due.
+// action is passed the due expressions and describes what it did.
+type scheduler struct {
+	name   string
+	action func(exprs string) string
+
+	mu      sync.Mutex
+	entries []*scheduleEntry
+	errors  []string
+}
+
+type scheduleEntry struct {
+	schedule   *CronSchedule
+	next       time.Time
+	lastRun    time.Time
+	lastResult string
+}
+
+var snapshotScheduler = &scheduler{name: "snapshot", action: takeScheduledSnapshot}
+
+// load parses a schedule such as SNAPSHOT_SCHEDULE: a semicolon separated
+// list of cron expressions, e.g. "0 2 * * *; 0 9-17 * * 1-5". Invalid entries
+// are logged and reported on the dashboard.
+func (s *scheduler) load(spec string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries, s.errors = nil, nil
+	for _, expr := range strings.Split(spec, ";") {
+		if strings.TrimSpace(expr) == "" {
+			continue
+		}
+		schedule, err := parseCron(expr)
+		if err != nil {
+			log.Printf("Warning: Ignoring %s schedule: %v", s.name, err)
+			s.errors = append(s.errors, err.Error())
+			continue
+		}
+		s.entries = append(s.entries, &scheduleEntry{schedule: schedule, next: schedule.Next(now)})
+	}
+}
+
+// run checks the schedules once a minute. Entries that fall due at the same
+// time share a single run of the action.
+func (s *scheduler) run() {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		s.tick(time.Now())
+	}
+}
+
+func (s *scheduler) tick(now time.Time) {
+	s.mu.Lock()
+	var due []*scheduleEntry
+	for _, entry := range s.entries {
+		if !entry.next.IsZero() && !now.Before(entry.next) {
+			due = append(due, entry)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(due) == 0 {
+		return
+	}
+
+	var exprs []string
+	for _, entry := range due {
+		exprs = append(exprs, entry.schedule.Expr)
+	}
+	result := s.action(strings.Join(exprs, ", "))
+
+	s.mu.Lock()
+	for _, entry := range due {
+		entry.lastRun = now
+		entry.lastResult = result
+		entry.next = entry.schedule.Next(now)
+	}
+	s.mu.Unlock()
+	invalidateCache()
+}
+
+func (s *scheduler) status() ([]ScheduleStatus, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var statuses []ScheduleStatus
+	for _, entry := range s.entries {
+		statuses = append(statuses, ScheduleStatus{
+			Name:       s.name,
+			Expr:       entry.schedule.Expr,
+			NextRun:    entry.next,
+			LastRun:    entry.lastRun,
+			LastResult: entry.lastResult,
+		})
+	}
+	return statuses, s.errors
+}
+
+// takeScheduledSnapshot runs the normal create-snapshot job unless the
+// database has not changed since the newest snapshot, and describes what
+// happened.
+func takeScheduledSnapshot(exprs string) string {
+	if current := databaseChangeCounter(); current != "" && current == latestChangeCounter() {
+		log.Printf("Scheduled snapshot skipped: database unchanged")
+		return "skipped (no changes)"
+	}
+
+	opts := defaultSnapshotOptions()
+	job, filename := startSnapshotJob(CreateSnapshotRequest{
+		Kind:      kindScheduled,
+		Notes:     fmt.Sprintf("Scheduled snapshot (%s)", exprs),
+		CreatedBy: "scheduler",
+		Options:   opts,
+	})
+
+	// Wait so that a slow dump is never overlapped by the next run
+	info := job.Wait()
+	if info.Status != jobSucceeded {
+		log.Printf("Scheduled snapshot failed: %s", info.Error)
+		return "failed: " + info.Error
+	}
+	return "created " + filename
+}
+
+// databaseChangeCounter identifies the current write state of POSTGRES_DB
+// from pg_stat_database's tuple counters. It changes whenever rows (including
+// catalog rows, i.e. DDL) are written, the statistics are reset, or the
+// database is replaced by a restore.
+func databaseChangeCounter() string {
+	if db == nil {
+		return ""
+	}
+	var oid, writes int64
+	var reset string
+	err := db.QueryRow(`
+		SELECT datid::bigint,
+		       tup_inserted + tup_updated + tup_deleted,
+		       coalesce(stats_reset::text, '')
+		FROM pg_stat_database
+		WHERE datname = current_database()
+	`).Scan(&oid, &writes, &reset)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d:%s", oid, writes, reset)
+}
+
+// latestChangeCounter returns the change counter recorded with the newest
+// full backup of POSTGRES_DB. Partial, subset, anonymized, uploaded and
+// pre-restore snapshots don't count: skipping a run because of one of them
+// would leave no complete copy of the data.
+func latestChangeCounter() string {
+	files, _ := listSnapshotFiles()
+	var newest *SnapshotMeta
+	for _, file := range files {
+		meta, err := readSnapshotMeta(file)
+		if err != nil || meta.Database != getEnv("POSTGRES_DB", "devdb") {
+			continue
+		}
+		if meta.Kind != kindManual && meta.Kind != kindScheduled {
+			continue
+		}
+		if meta.Scope != nil || meta.Subset != nil || meta.Anonymization != nil {
+			continue
+		}
+		if newest == nil || meta.CreatedAt.After(newest.CreatedAt) {
+			newest = meta
+		}
+	}
+	if newest == nil {
+		return ""
+	}
+	return newest.ChangeCounter
+}
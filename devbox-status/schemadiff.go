@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// liveSource names the running POSTGRES_DB as a schema diff source
+const liveSource = "live"
+
+// DBSchema is the structure of a database: its tables keyed by
+// "schema.table"
+type DBSchema struct {
+	Tables map[string]*SchemaTable
+}
+
+// SchemaTable holds a table's columns, indexes and constraints, each keyed
+// by name and described the way PostgreSQL prints them
+type SchemaTable struct {
+	Columns     map[string]string
+	Indexes     map[string]string
+	Constraints map[string]string
+}
+
+// SchemaDiff is the difference between two schemas, from the point of view
+// of turning From into To
+type SchemaDiff struct {
+	From          string      `json:"from"`
+	To            string      `json:"to"`
+	TablesAdded   []string    `json:"tables_added"`
+	TablesDropped []string    `json:"tables_dropped"`
+	TablesChanged []TableDiff `json:"tables_changed"`
+}
+
+// TableDiff lists what changed inside a table present in both schemas
+type TableDiff struct {
+	Table       string         `json:"table"`
+	Columns     []ObjectChange `json:"columns,omitempty"`
+	Indexes     []ObjectChange `json:"indexes,omitempty"`
+	Constraints []ObjectChange `json:"constraints,omitempty"`
+}
+
+// ObjectChange is a column, index or constraint that was added, dropped or
+// changed
+type ObjectChange struct {
+	Name   string `json:"name"`
+	Change string `json:"change"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+}
+
+// Empty reports whether the two schemas are identical
+func (d *SchemaDiff) Empty() bool {
+	return len(d.TablesAdded) == 0 && len(d.TablesDropped) == 0 && len(d.TablesChanged) == 0
+}
+
+// userRelationFilter restricts a pg_class query (aliased c, with namespace n)
+// to tables created by the application rather than the system or extensions
+const userRelationFilter = `
+	n.nspname NOT IN ('pg_catalog', 'information_schema')
+	AND n.nspname NOT LIKE 'pg_toast%'
+	AND NOT EXISTS (
+		SELECT 1 FROM pg_depend d
+		WHERE d.classid = 'pg_class'::regclass AND d.objid = c.oid AND d.deptype = 'e'
+	)`
+
+// readSchema reads the tables, columns, indexes and constraints of conn
+func readSchema(ctx context.Context, conn *sql.DB) (*DBSchema, error) {
+	s := &DBSchema{Tables: make(map[string]*SchemaTable)}
+	table := func(name string) *SchemaTable {
+		t, ok := s.Tables[name]
+		if !ok {
+			t = &SchemaTable{
+				Columns:     make(map[string]string),
+				Indexes:     make(map[string]string),
+				Constraints: make(map[string]string),
+			}
+			s.Tables[name] = t
+		}
+		return t
+	}
+
+	queries := []struct {
+		sql string
+		add func(t *SchemaTable, name, def string)
+	}{
+		{`
+			SELECT n.nspname || '.' || c.relname, a.attname,
+			       format_type(a.atttypid, a.atttypmod)
+			       || CASE WHEN a.attnotnull THEN ' NOT NULL' ELSE '' END
+			       || COALESCE(' DEFAULT ' || pg_get_expr(ad.adbin, ad.adrelid), '')
+			FROM pg_class c
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			JOIN pg_attribute a ON a.attrelid = c.oid AND a.attnum > 0 AND NOT a.attisdropped
+			LEFT JOIN pg_attrdef ad ON ad.adrelid = c.oid AND ad.adnum = a.attnum
+			WHERE c.relkind IN ('r', 'p') AND` + userRelationFilter,
+			func(t *SchemaTable, name, def string) { t.Columns[name] = def },
+		},
+		{`
+			SELECT n.nspname || '.' || c.relname, i.relname, pg_get_indexdef(i.oid)
+			FROM pg_class c
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			JOIN pg_index x ON x.indrelid = c.oid
+			JOIN pg_class i ON i.oid = x.indexrelid
+			WHERE c.relkind IN ('r', 'p') AND` + userRelationFilter,
+			func(t *SchemaTable, name, def string) { t.Indexes[name] = def },
+		},
+		{`
+			SELECT n.nspname || '.' || c.relname, con.conname, pg_get_constraintdef(con.oid)
+			FROM pg_class c
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			JOIN pg_constraint con ON con.conrelid = c.oid
+			WHERE c.relkind IN ('r', 'p') AND` + userRelationFilter,
+			func(t *SchemaTable, name, def string) { t.Constraints[name] = def },
+		},
+	}
+
+	// Tables without columns still need an entry
+	tables, err := conn.QueryContext(ctx, `
+		SELECT n.nspname || '.' || c.relname
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p') AND`+userRelationFilter)
+	if err != nil {
+		return nil, err
+	}
+	for tables.Next() {
+		var name string
+		if err := tables.Scan(&name); err != nil {
+			tables.Close()
+			return nil, err
+		}
+		table(name)
+	}
+	tables.Close()
+	if err := tables.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, q := range queries {
+		rows, err := conn.QueryContext(ctx, q.sql)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var tableName, name, def string
+			if err := rows.Scan(&tableName, &name, &def); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			q.add(table(tableName), name, def)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// diffSchemas compares two schemas. Tables are matched by qualified name and
+// their objects by name, so a rename shows up as a drop and an add.
+func diffSchemas(from, to *DBSchema) *SchemaDiff {
+	d := &SchemaDiff{
+		TablesAdded:   []string{},
+		TablesDropped: []string{},
+		TablesChanged: []TableDiff{},
+	}
+	for name := range to.Tables {
+		if _, ok := from.Tables[name]; !ok {
+			d.TablesAdded = append(d.TablesAdded, name)
+		}
+	}
+	for name, ft := range from.Tables {
+		tt, ok := to.Tables[name]
+		if !ok {
+			d.TablesDropped = append(d.TablesDropped, name)
+			continue
+		}
+		td := TableDiff{
+			Table:       name,
+			Columns:     diffObjects(ft.Columns, tt.Columns),
+			Indexes:     diffObjects(ft.Indexes, tt.Indexes),
+			Constraints: diffObjects(ft.Constraints, tt.Constraints),
+		}
+		if len(td.Columns)+len(td.Indexes)+len(td.Constraints) > 0 {
+			d.TablesChanged = append(d.TablesChanged, td)
+		}
+	}
+	sort.Strings(d.TablesAdded)
+	sort.Strings(d.TablesDropped)
+	sort.Slice(d.TablesChanged, func(i, j int) bool { return d.TablesChanged[i].Table < d.TablesChanged[j].Table })
+	return d
+}
+
+func diffObjects(from, to map[string]string) []ObjectChange {
+	var changes []ObjectChange
+	for name, def := range to {
+		old, ok := from[name]
+		switch {
+		case !ok:
+			changes = append(changes, ObjectChange{Name: name, Change: "added", To: def})
+		case old != def:
+			changes = append(changes, ObjectChange{Name: name, Change: "changed", From: old, To: def})
+		}
+	}
+	for name, def := range from {
+		if _, ok := to[name]; !ok {
+			changes = append(changes, ObjectChange{Name: name, Change: "dropped", From: def})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes
+}
+
+// schemaOnlyReader passes a plain SQL dump through without the rows of its
+// COPY blocks, so that loading it only creates the schema
+type schemaOnlyReader struct {
+	r      *bufio.Reader
+	buf    []byte
+	inCopy bool
+	err    error
+}
+
+func (s *schemaOnlyReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		var line []byte
+		line, s.err = s.r.ReadBytes('\n')
+		switch {
+		case s.inCopy:
+			if bytes.Equal(bytes.TrimRight(line, "\r\n"), []byte(`\.`)) {
+				s.inCopy = false
+			}
+		case isCopyFromStdin(line):
+			// Skip the statement too; an empty COPY would still need its data
+			s.inCopy = true
+		default:
+			s.buf = line
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// isCopyFromStdin reports whether line starts a COPY data block. Only the
+// whole statement counts: function bodies and comments can contain lines
+// that merely start with COPY.
+func isCopyFromStdin(line []byte) bool {
+	line = bytes.TrimRight(line, "\r\n")
+	return bytes.HasPrefix(line, []byte("COPY ")) && bytes.HasSuffix(line, []byte(" FROM stdin;"))
+}
+
+// loadSchemaOnly creates the tables, indexes and constraints of the snapshot
+// at path in target, without its data
+func loadSchemaOnly(ctx context.Context, path, target string) error {
+	if snapshotFormat(path) != formatPlain {
+		cmd, closer, err := pgRestoreCommand(ctx, path, "--schema-only", "--exit-on-error", "-d", target)
+		if err != nil {
+			return err
+		}
+		output, err := cmd.CombinedOutput()
+		closer.Close()
+		if err != nil {
+			return fmt.Errorf("pg_restore failed: %s", strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+
+	r, err := openPlainDump(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := pgCommand(ctx, "psql", "-X", "-q", "-d", target, "-v", "ON_ERROR_STOP=1")
+	cmd.Stdin = &schemaOnlyReader{r: bufio.NewReaderSize(r, 64<<10)}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("psql failed: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+var schemaScratchSeq atomic.Int64
+
+// snapshotSchema loads the schema of the snapshot at path into a throwaway
+// database and reads it back
+func snapshotSchema(ctx context.Context, path string) (*DBSchema, error) {
+	if adminDB == nil {
+		return nil, fmt.Errorf("no connection to the maintenance database")
+	}
+	suffix := "schema_" + time.Now().Format("20060102150405") + "_" + strconv.FormatInt(schemaScratchSeq.Add(1), 10)
+	scratch := scratchDBName(getEnv("POSTGRES_DB", "devdb"), suffix)
+	if err := createEmptyDatabase(ctx, scratch); err != nil {
+		return nil, fmt.Errorf("could not create scratch database: %v", err)
+	}
+	defer dropDatabase(scratch)
+
+	if err := loadSchemaOnly(ctx, path, scratch); err != nil {
+		return nil, err
+	}
+
+	conn, err := sql.Open("postgres", connString(scratch))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return readSchema(ctx, conn)
+}
+
+// schemaCache remembers snapshot schemas, invalidated like contentsCache
+var schemaCache = struct {
+	sync.Mutex
+	entries map[string]cachedSchema
+}{entries: make(map[string]cachedSchema)}
+
+type cachedSchema struct {
+	size    int64
+	modTime time.Time
+	schema  *DBSchema
+}
+
+// sourceSchema reads the schema of a diff source: liveSource or a snapshot
+// filename
+func sourceSchema(ctx context.Context, source string) (*DBSchema, error) {
+	if source == liveSource {
+		if db == nil {
+			return nil, fmt.Errorf("no connection to %s", getEnv("POSTGRES_DB", "devdb"))
+		}
+		return readSchema(ctx, db)
+	}
+
+	path, err := resolveSnapshotPath(source)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot %s not found", source)
+	}
+	size := snapshotSize(path)
+
+	schemaCache.Lock()
+	cached, ok := schemaCache.entries[path]
+	schemaCache.Unlock()
+	if ok && cached.size == size && cached.modTime.Equal(info.ModTime()) {
+		return cached.schema, nil
+	}
+
+	schema, err := snapshotSchema(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", source, err)
+	}
+	schemaCache.Lock()
+	schemaCache.entries[path] = cachedSchema{size: size, modTime: info.ModTime(), schema: schema}
+	schemaCache.Unlock()
+	return schema, nil
+}
+
+// handleSchemaDiff compares the schemas of from and to, each either "live"
+// or a snapshot filename
+func handleSchemaDiff(w http.ResponseWriter, r *http.Request) {
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+	if from == "" || to == "" {
+		http.Error(w, "Missing from or to", http.StatusBadRequest)
+		return
+	}
+
+	fail := func(err error) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+	}
+
+	fromSchema, err := sourceSchema(r.Context(), from)
+	if err != nil {
+		fail(err)
+		return
+	}
+	toSchema, err := sourceSchema(r.Context(), to)
+	if err != nil {
+		fail(err)
+		return
+	}
+	diff := diffSchemas(fromSchema, toSchema)
+	diff.From, diff.To = from, to
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"identical": diff.Empty(),
+		"diff":      diff,
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffSchemas(t *testing.T) {
+	users := func() *SchemaTable {
+		return &SchemaTable{
+			Columns:     map[string]string{"id": "integer not null", "email": "text"},
+			Indexes:     map[string]string{"users_pkey": "CREATE UNIQUE INDEX users_pkey ON public.users USING btree (id)"},
+			Constraints: map[string]string{"users_pkey": "PRIMARY KEY (id)"},
+		}
+	}
+	schema := func(tables map[string]*SchemaTable) *DBSchema { return &DBSchema{Tables: tables} }
+
+	tests := []struct {
+		name     string
+		from, to *DBSchema
+		want     *SchemaDiff
+	}{
+		{
+			name: "identical",
+			from: schema(map[string]*SchemaTable{"public.users": users()}),
+			to:   schema(map[string]*SchemaTable{"public.users": users()}),
+			want: &SchemaDiff{TablesAdded: []string{}, TablesDropped: []string{}, TablesChanged: []TableDiff{}},
+		},
+		{
+			name: "tables added and dropped",
+			from: schema(map[string]*SchemaTable{"public.users": users(), "public.legacy": {}}),
+			to:   schema(map[string]*SchemaTable{"public.users": users(), "public.orders": {}, "app.events": {}}),
+			want: &SchemaDiff{
+				TablesAdded:   []string{"app.events", "public.orders"},
+				TablesDropped: []string{"public.legacy"},
+				TablesChanged: []TableDiff{},
+			},
+		},
+		{
+			name: "objects added, dropped and changed",
+			from: schema(map[string]*SchemaTable{"public.users": users()}),
+			to: schema(map[string]*SchemaTable{"public.users": func() *SchemaTable {
+				u := users()
+				u.Columns["email"] = "text not null"
+				u.Columns["name"] = "text"
+				delete(u.Constraints, "users_pkey")
+				u.Indexes["users_email"] = "CREATE INDEX users_email ON public.users USING btree (email)"
+				return u
+			}()}),
+			want: &SchemaDiff{
+				TablesAdded:   []string{},
+				TablesDropped: []string{},
+				TablesChanged: []TableDiff{{
+					Table: "public.users",
+					Columns: []ObjectChange{
+						{Name: "email", Change: "changed", From: "text", To: "text not null"},
+						{Name: "name", Change: "added", To: "text"},
+					},
+					Indexes: []ObjectChange{
+						{Name: "users_email", Change: "added", To: "CREATE INDEX users_email ON public.users USING btree (email)"},
+					},
+					Constraints: []ObjectChange{
+						{Name: "users_pkey", Change: "dropped", From: "PRIMARY KEY (id)"},
+					},
+				}},
+			},
+		},
+		{
+			name: "a rename is a drop and an add",
+			from: schema(map[string]*SchemaTable{"public.users": {Columns: map[string]string{"mail": "text"}}}),
+			to:   schema(map[string]*SchemaTable{"public.users": {Columns: map[string]string{"email": "text"}}}),
+			want: &SchemaDiff{
+				TablesAdded:   []string{},
+				TablesDropped: []string{},
+				TablesChanged: []TableDiff{{
+					Table: "public.users",
+					Columns: []ObjectChange{
+						{Name: "email", Change: "added", To: "text"},
+						{Name: "mail", Change: "dropped", From: "text"},
+					},
+				}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffSchemas(tt.from, tt.to)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffSchemas() = %+v, want %+v", got, tt.want)
+			}
+			if got.Empty() != tt.want.Empty() {
+				t.Errorf("Empty() = %v, want %v", got.Empty(), tt.want.Empty())
+			}
+		})
+	}
+}
+
+func TestSchemaOnlyReader(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{
+			name: "copy block removed",
+			in:   "CREATE TABLE t (a int);\nCOPY public.t (a) FROM stdin;\n1\n2\n\\.\nALTER TABLE t ADD PRIMARY KEY (a);\n",
+			want: "CREATE TABLE t (a int);\nALTER TABLE t ADD PRIMARY KEY (a);\n",
+		},
+		{
+			name: "windows line endings",
+			in:   "COPY public.t (a) FROM stdin;\r\n1\r\n\\.\r\nSELECT 1;\r\n",
+			want: "SELECT 1;\r\n",
+		},
+		{
+			name: "lines merely starting with COPY are kept",
+			in:   "CREATE FUNCTION f() RETURNS void AS $$\nCOPY t TO '/tmp/t.csv';\n$$ LANGUAGE sql;\n-- COPY t FROM stdin; is how data is loaded\n",
+			want: "CREATE FUNCTION f() RETURNS void AS $$\nCOPY t TO '/tmp/t.csv';\n$$ LANGUAGE sql;\n-- COPY t FROM stdin; is how data is loaded\n",
+		},
+		{
+			name: "no trailing newline",
+			in:   "SELECT 1;",
+			want: "SELECT 1;",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := io.ReadAll(&schemaOnlyReader{r: bufio.NewReader(strings.NewReader(tt.in))})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
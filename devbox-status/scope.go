@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// SnapshotScope limits what pg_dump includes in a snapshot. Table and schema
+// entries are pg_dump patterns, so wildcards like "audit_*" work. The zero
+// value is a full dump.
+type SnapshotScope struct {
+	SchemaOnly       bool     `json:"schema_only,omitempty"`
+	DataOnly         bool     `json:"data_only,omitempty"`
+	Tables           []string `json:"tables,omitempty"`
+	ExcludeTables    []string `json:"exclude_tables,omitempty"`
+	Schemas          []string `json:"schemas,omitempty"`
+	ExcludeSchemas   []string `json:"exclude_schemas,omitempty"`
+	ExcludeTableData []string `json:"exclude_table_data,omitempty"`
+}
+
+// Partial reports whether a snapshot taken with s lacks part of the database
+func (s *SnapshotScope) Partial() bool {
+	return s != nil && (s.SchemaOnly || s.DataOnly || len(s.Tables) > 0 || len(s.ExcludeTables) > 0 ||
+		len(s.Schemas) > 0 || len(s.ExcludeSchemas) > 0 || len(s.ExcludeTableData) > 0)
+}
+
+// String describes the scope for the dashboard and restore warnings
+func (s *SnapshotScope) String() string {
+	if !s.Partial() {
+		return "full"
+	}
+	var parts []string
+	if s.SchemaOnly {
+		parts = append(parts, "schema only")
+	}
+	if s.DataOnly {
+		parts = append(parts, "data only")
+	}
+	list := func(label string, items []string) {
+		if len(items) > 0 {
+			parts = append(parts, label+" "+strings.Join(items, ", "))
+		}
+	}
+	list("tables", s.Tables)
+	list("without tables", s.ExcludeTables)
+	list("schemas", s.Schemas)
+	list("without schemas", s.ExcludeSchemas)
+	list("without data of", s.ExcludeTableData)
+	return strings.Join(parts, "; ")
+}
+
+// args returns the pg_dump flags for s
+func (s *SnapshotScope) args() []string {
+	var args []string
+	if s.SchemaOnly {
+		args = append(args, "--schema-only")
+	}
+	if s.DataOnly {
+		args = append(args, "--data-only")
+	}
+	add := func(flag string, patterns []string) {
+		for _, p := range patterns {
+			args = append(args, flag+"="+p)
+		}
+	}
+	add("--table", s.Tables)
+	add("--exclude-table", s.ExcludeTables)
+	add("--schema", s.Schemas)
+	add("--exclude-schema", s.ExcludeSchemas)
+	add("--exclude-table-data", s.ExcludeTableData)
+	return args
+}
+
+// parseSnapshotScope reads the scope query parameters. List parameters may
+// be repeated or comma-separated.
+func parseSnapshotScope(q url.Values) (SnapshotScope, error) {
+	flag := func(name string) bool {
+		v := q.Get(name)
+		return v != "" && v != "0" && v != "false"
+	}
+	list := func(name string) []string {
+		var items []string
+		for _, v := range q[name] {
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+		}
+		return items
+	}
+
+	s := SnapshotScope{
+		SchemaOnly:       flag("schema_only"),
+		DataOnly:         flag("data_only"),
+		Tables:           list("table"),
+		ExcludeTables:    list("exclude_table"),
+		Schemas:          list("schema"),
+		ExcludeSchemas:   list("exclude_schema"),
+		ExcludeTableData: list("exclude_table_data"),
+	}
+	if s.SchemaOnly && s.DataOnly {
+		return s, fmt.Errorf("schema_only and data_only cannot be combined")
+	}
+	if s.SchemaOnly && len(s.ExcludeTableData) > 0 {
+		return s, fmt.Errorf("exclude_table_data has no effect on a schema-only snapshot")
+	}
+	return s, nil
+}
+
+// partialRestoreWarning explains what restoring the snapshot at path will
+// and will not bring back, or returns "" for a full snapshot
+func partialRestoreWarning(path string) string {
+	meta, _ := readSnapshotMeta(path)
+	if meta == nil || !meta.Scope.Partial() {
+		return ""
+	}
+	warning := "partial snapshot (" + meta.Scope.String() + "): objects and data it does not contain will be missing after the restore"
+	if meta.Scope.DataOnly {
+		warning = "data-only snapshot: its rows are loaded into the current schema of " + getEnv("POSTGRES_DB", "devdb")
+	}
+	return warning
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Side databases hold a snapshot restored next to POSTGRES_DB for
+// comparison. Like branches they are recognised by their database comment,
+// which names the snapshot they were restored from.
+const sideDBCommentPrefix = "devbox restore of: "
+
+// SideDatabase is a database a snapshot was restored into
+type SideDatabase struct {
+	Name      string
+	Snapshot  string
+	SizeBytes int64
+	Size      string
+}
+
+// sideDBNameRe keeps side database names to plain identifiers, so they can
+// be typed into psql and URLs without quoting
+var sideDBNameRe = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// validateSideDBName checks that name can be used for a new side database
+func validateSideDBName(name string) error {
+	if !sideDBNameRe.MatchString(name) {
+		return fmt.Errorf("invalid database name %q (use lowercase letters, digits and _)", name)
+	}
+	switch name {
+	case getEnv("POSTGRES_DB", "devdb"), "postgres", "template0", "template1":
+		return fmt.Errorf("database %s cannot be used as a restore target", name)
+	}
+	return nil
+}
+
+// startSideRestoreJob restores the snapshot at path into a new database
+// called target, leaving POSTGRES_DB alone
+func startSideRestoreJob(filename, path, target string) (*Job, error) {
+	if adminDB == nil {
+		return nil, fmt.Errorf("no connection to the maintenance database")
+	}
+	if err := validateSideDBName(target); err != nil {
+		return nil, err
+	}
+	var exists bool
+	adminDB.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)", target).Scan(&exists)
+	if exists {
+		return nil, fmt.Errorf("database %s already exists", target)
+	}
+
+	job := jobs.start("restore", filename, func(ctx context.Context, job *Job) error {
+		return runSideRestore(ctx, job, filename, path, target)
+	})
+	return job, nil
+}
+
+func runSideRestore(ctx context.Context, job *Job, filename, path, target string) error {
+	job.update(func(info *JobInfo) { info.TotalBytes = snapshotSize(path) })
+
+	job.logf("Creating database %s", target)
+	if err := createEmptyDatabase(ctx, target); err != nil {
+		return fmt.Errorf("could not create %s: %v", target, err)
+	}
+	loaded := false
+	defer func() {
+		if !loaded {
+			job.logf("Dropping %s", target)
+			dropDatabase(target)
+		}
+	}()
+
+	_, err := adminDB.ExecContext(ctx, fmt.Sprintf("COMMENT ON DATABASE %s IS %s",
+		pq.QuoteIdentifier(target), pq.QuoteLiteral(sideDBCommentPrefix+filename)))
+	if err != nil {
+		return fmt.Errorf("could not label %s: %v", target, err)
+	}
+
+	if err := loadSnapshot(ctx, job, path, target); err != nil {
+		return err
+	}
+	loaded = true
+
+	job.logf("Restored %s into %s", filename, target)
+	return nil
+}
+
+// listSideDatabases returns the side databases by name
+func listSideDatabases(ctx context.Context) ([]SideDatabase, error) {
+	if adminDB == nil {
+		return nil, fmt.Errorf("no connection to the maintenance database")
+	}
+	rows, err := adminDB.QueryContext(ctx, `
+		SELECT datname, pg_database_size(oid), shobj_description(oid, 'pg_database')
+		FROM pg_database
+		WHERE shobj_description(oid, 'pg_database') LIKE $1
+		ORDER BY datname
+	`, sideDBCommentPrefix+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dbs []SideDatabase
+	for rows.Next() {
+		var d SideDatabase
+		var comment string
+		if err := rows.Scan(&d.Name, &d.SizeBytes, &comment); err != nil {
+			return nil, err
+		}
+		d.Snapshot = strings.TrimPrefix(comment, sideDBCommentPrefix)
+		d.Size = formatSize(d.SizeBytes)
+		dbs = append(dbs, d)
+	}
+	return dbs, rows.Err()
+}
+
+func isSideDatabase(ctx context.Context, name string) bool {
+	dbs, _ := listSideDatabases(ctx)
+	for _, d := range dbs {
+		if d.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sidePgwebPort is where the side database pgweb listens; Caddy serves it
+// under sidedb/
+const sidePgwebPort = 8085
+
+// sidePgweb is a second pgweb instance for side databases. The main pgweb's
+// session is locked to POSTGRES_DB so it can't be pointed at other hosts or
+// credentials; this one is locked too, to the side database being viewed,
+// and is restarted to switch to another.
+var sidePgweb struct {
+	sync.Mutex
+	cmd    *exec.Cmd
+	dbName string
+	done   chan struct{} // closed when cmd exits
+}
+
+// openSidePgweb makes the side pgweb serve dbName, starting or restarting it
+// as needed
+func openSidePgweb(dbName string) error {
+	sidePgweb.Lock()
+	defer sidePgweb.Unlock()
+	if sidePgweb.cmd != nil && sidePgweb.dbName == dbName {
+		select {
+		case <-sidePgweb.done:
+		default:
+			return nil
+		}
+	}
+	stopSidePgwebLocked()
+
+	cmd := exec.Command("/usr/local/bin/pgweb",
+		"--bind=127.0.0.1", fmt.Sprintf("--listen=%d", sidePgwebPort),
+		"--host=localhost",
+		"--user="+getEnv("POSTGRES_USER", "postgres"),
+		"--pass="+getEnv("POSTGRES_PASSWORD", "postgres"),
+		"--db="+dbName,
+		"--lock-session")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("could not start pgweb: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+	sidePgweb.cmd, sidePgweb.dbName, sidePgweb.done = cmd, dbName, done
+
+	for i := 0; i < 50; i++ {
+		select {
+		case <-done:
+			sidePgweb.cmd, sidePgweb.dbName = nil, ""
+			return fmt.Errorf("pgweb exited while connecting to %s", dbName)
+		default:
+		}
+		if checkService(sidePgwebPort) == "running" {
+			return nil
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	stopSidePgwebLocked()
+	return fmt.Errorf("pgweb did not start for %s", dbName)
+}
+
+// stopSidePgweb stops the side pgweb if it is serving dbName
+func stopSidePgweb(dbName string) {
+	sidePgweb.Lock()
+	defer sidePgweb.Unlock()
+	if sidePgweb.dbName == dbName {
+		stopSidePgwebLocked()
+	}
+}
+
+func stopSidePgwebLocked() {
+	if sidePgweb.cmd == nil {
+		return
+	}
+	sidePgweb.cmd.Process.Kill()
+	<-sidePgweb.done
+	sidePgweb.cmd, sidePgweb.dbName = nil, ""
+}
+
+func handleSideDatabases(w http.ResponseWriter, r *http.Request) {
+	dbs, err := listSideDatabases(r.Context())
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"databases": dbs,
+	})
+}
+
+func handleDropSideDatabase(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "Missing name", http.StatusBadRequest)
+		return
+	}
+	// Only databases created by a side restore may be dropped here
+	if !isSideDatabase(r.Context(), name) {
+		http.Error(w, "Not a side database", http.StatusBadRequest)
+		return
+	}
+
+	stopSidePgweb(name)
+	if err := dropDatabase(name); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	invalidateCache()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+	})
+}
+
+// handleOpenInPgweb returns the pgweb URL for POSTGRES_DB or a side
+// database, starting the side database pgweb for the latter
+func handleOpenInPgweb(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("db")
+	if name == getEnv("POSTGRES_DB", "devdb") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"url":     getServiceRoot() + "db/",
+		})
+		return
+	}
+	if !isSideDatabase(r.Context(), name) {
+		http.Error(w, "Unknown database", http.StatusBadRequest)
+		return
+	}
+
+	if err := openSidePgweb(name); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"url":     getServiceRoot() + "sidedb/",
+	})
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateSideDBName(t *testing.T) {
+	t.Setenv("POSTGRES_DB", "devdb")
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"devdb_copy", false},
+		{"_scratch", false},
+		{"restore2", false},
+		{strings.Repeat("a", 63), false},
+		{strings.Repeat("a", 64), true},
+		{"", true},
+		{"2fast", true},
+		{"Upper", true},
+		{"with-dash", true},
+		{"with space", true},
+		{`quote"d`, true},
+		{"devdb", true},
+		{"postgres", true},
+		{"template0", true},
+		{"template1", true},
+	}
+	for _, tt := range tests {
+		if err := validateSideDBName(tt.name); (err != nil) != tt.wantErr {
+			t.Errorf("validateSideDBName(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
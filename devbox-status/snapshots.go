@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshot formats understood by pg_dump / pg_restore
+const (
+	formatPlain     = "plain"
+	formatCustom    = "custom"
+	formatDirectory = "directory"
+)
+
+// File extensions used for each snapshot format. Plain dumps written with
+// compression enabled are gzip files and get a .sql.gz extension.
+const (
+	extPlain           = ".sql"
+	extPlainCompressed = ".sql.gz"
+	extCustom          = ".dump"
+	extDirectory       = ".dir"
+)
+
+type SnapshotOptions struct {
+	Format      string
+	Compression int // -1 leaves pg_dump's default in place
+	Scope       SnapshotScope
+	Encrypt     bool
+}
+
+// defaultSnapshotOptions reads SNAPSHOT_FORMAT and SNAPSHOT_COMPRESSION.
+// Snapshots are encrypted whenever a key is configured, except for
+// directory-format ones which cannot be.
+func defaultSnapshotOptions() SnapshotOptions {
+	opts := SnapshotOptions{
+		Format:      getEnv("SNAPSHOT_FORMAT", formatPlain),
+		Compression: -1,
+	}
+	if c := getEnv("SNAPSHOT_COMPRESSION", ""); c != "" {
+		opts.Compression = parseInt(c)
+	}
+	// Directory-format snapshots cannot be encrypted; with a key configured
+	// the default falls back to custom rather than writing plaintext
+	opts.Encrypt = encryptionConfigured()
+	if opts.Encrypt && opts.Format == formatDirectory {
+		opts.Format = formatCustom
+	}
+	return opts
+}
+
+// parseSnapshotOptions applies "format", "compress" and "encrypt" query
+// parameters on top of the configured defaults.
+func parseSnapshotOptions(format, compress, encrypt string) (SnapshotOptions, error) {
+	opts := defaultSnapshotOptions()
+	if format != "" {
+		opts.Format = format
+	} else if encrypt == "0" || encrypt == "false" {
+		// Unencrypted, the configured format needs no fallback
+		opts.Format = getEnv("SNAPSHOT_FORMAT", formatPlain)
+	}
+	switch opts.Format {
+	case formatPlain, formatCustom, formatDirectory:
+	default:
+		return opts, fmt.Errorf("unknown snapshot format %q", opts.Format)
+	}
+	if compress != "" {
+		level, err := strconv.Atoi(compress)
+		if err != nil {
+			return opts, fmt.Errorf("invalid compression level %q", compress)
+		}
+		if level < 0 {
+			return opts, fmt.Errorf("compression level must be between 0 and 9")
+		}
+		opts.Compression = level
+	}
+	if opts.Compression > 9 {
+		return opts, fmt.Errorf("compression level must be between 0 and 9")
+	}
+	switch encrypt {
+	case "":
+		opts.Encrypt = encryptionConfigured()
+	case "0", "false":
+		opts.Encrypt = false
+	default:
+		opts.Encrypt = true
+	}
+	if opts.Encrypt && !encryptionConfigured() {
+		return opts, errNoEncryption
+	}
+	if opts.Encrypt && opts.Format == formatDirectory {
+		return opts, fmt.Errorf("directory-format snapshots cannot be encrypted; pass encrypt=0 to write one unencrypted")
+	}
+	return opts, nil
+}
+
+// snapshotExtension returns the file extension for a snapshot written with
+// opts. Encrypted snapshots get .enc after the format's extension.
+func snapshotExtension(opts SnapshotOptions) string {
+	ext := extPlain
+	switch {
+	case opts.Format == formatCustom:
+		ext = extCustom
+	case opts.Format == formatDirectory:
+		return extDirectory
+	case opts.Compression > 0:
+		ext = extPlainCompressed
+	}
+	if opts.Encrypt {
+		ext += extEncrypted
+	}
+	return ext
+}
+
+// snapshotFormat infers the format of a snapshot from its name
+func snapshotFormat(filename string) string {
+	filename = strings.TrimSuffix(filename, extEncrypted)
+	switch {
+	case strings.HasSuffix(filename, extCustom):
+		return formatCustom
+	case strings.HasSuffix(filename, extDirectory):
+		return formatDirectory
+	}
+	return formatPlain
+}
+
+// isSnapshotFile reports whether a name in the snapshots directory is a snapshot
+func isSnapshotFile(filename string) bool {
+	filename = strings.TrimSuffix(filename, extEncrypted)
+	for _, ext := range []string{extPlain, extPlainCompressed, extCustom, extDirectory} {
+		if strings.HasSuffix(filename, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSnapshotPath resolves a snapshot filename inside snapshotsDir, rejecting
+// anything that would escape it.
+func resolveSnapshotPath(filename string) (string, error) {
+	if filename == "" || filename != filepath.Base(filename) || strings.HasPrefix(filename, ".") {
+		return "", fmt.Errorf("invalid snapshot filename %q", filename)
+	}
+	if !isSnapshotFile(filename) {
+		return "", fmt.Errorf("unsupported snapshot file %q", filename)
+	}
+	return filepath.Join(snapshotsDir, filename), nil
+}
+
+// listSnapshotFiles returns the paths of all snapshots regardless of format
+func listSnapshotFiles() ([]string, error) {
+	snapshots, err := localSnapshots.List(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, len(snapshots))
+	for i, s := range snapshots {
+		files[i] = localSnapshots.path(s.Name)
+	}
+	return files, nil
+}
+
+// snapshotSize returns the size of a snapshot file, or the total size of the
+// files in a directory-format snapshot.
+func snapshotSize(path string) int64 {
+	var total int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// parallelJobs is the number of workers used by pg_restore and by pg_dump
+// for directory-format snapshots.
+func parallelJobs() int {
+	if jobs := parseInt(getEnv("SNAPSHOT_JOBS", "")); jobs > 0 {
+		return jobs
+	}
+	return runtime.NumCPU()
+}
+
+// pgCommand builds a PostgreSQL client command that connects as POSTGRES_USER.
+// The command is killed if ctx is cancelled.
+func pgCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	args = append([]string{"-h", "localhost", "-U", getEnv("POSTGRES_USER", "postgres")}, args...)
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("PGPASSWORD=%s", getEnv("POSTGRES_PASSWORD", "postgres")))
+	return cmd
+}
+
+// dumpCommand builds the pg_dump invocation that writes a snapshot of dbName
+// to path, from the exported snapshot snapshotID if set. Encrypted snapshots
+// are written to standard output instead, see runEncryptedJobCommand.
+func dumpCommand(ctx context.Context, dbName, path, snapshotID string, opts SnapshotOptions) *exec.Cmd {
+	args := []string{"-d", dbName, "-v"}
+	if snapshotID != "" {
+		args = append(args, "--snapshot="+snapshotID)
+	}
+	if !opts.Encrypt {
+		args = append(args, "-f", path)
+	}
+
+	switch opts.Format {
+	case formatCustom:
+		args = append(args, "-F", "c")
+	case formatDirectory:
+		args = append(args, "-F", "d", "-j", strconv.Itoa(parallelJobs()))
+	default:
+		args = append(args, "-F", "p")
+	}
+	if opts.Compression >= 0 {
+		args = append(args, "-Z", strconv.Itoa(opts.Compression))
+	}
+	args = append(args, opts.Scope.args()...)
+
+	return pgCommand(ctx, "pg_dump", args...)
+}
+
+// restoreCommand builds the command that loads the snapshot at path into
+// dbName. Custom and directory dumps use pg_restore with parallel jobs. Plain
+// dumps are streamed into psql (decrypting and decompressing on the fly when
+// needed) so that the bytes read and the table being copied can be reported
+// on job. The returned closer must be called once the command has finished.
+func restoreCommand(ctx context.Context, path, dbName string, job *Job) (*exec.Cmd, io.Closer, error) {
+	if snapshotFormat(path) != formatPlain {
+		args := []string{"-d", dbName, "-v"}
+		// Parallel restores need to seek, which a decrypted stream can't
+		if !isEncryptedSnapshot(path) {
+			args = append(args, "-j", strconv.Itoa(parallelJobs()))
+		}
+		return pgRestoreCommand(ctx, path, args...)
+	}
+
+	f, err := openSnapshotFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	counter := &countingReader{r: f, job: job}
+	var r io.Reader = counter
+	if isCompressedPlain(path) {
+		gz, err := gzip.NewReader(counter)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		r = gz
+	}
+
+	// Stop at the first failing statement and echo it to stderr so it can be
+	// reported back to the caller
+	cmd := pgCommand(ctx, "psql", "-X", "-d", dbName, "-v", "ON_ERROR_STOP=1", "--echo-errors")
+	cmd.Stdin = &copyScanner{r: r, job: job}
+	return cmd, f, nil
+}
+
+// Snapshot kinds recorded in the metadata sidecar
+const (
+	kindManual     = ""
+	kindPreRestore = "pre-restore"
+)
+
+// CreateSnapshotRequest describes a snapshot to be taken
+type CreateSnapshotRequest struct {
+	Label     string
+	Notes     string
+	CreatedBy string
+	Kind      string
+	RestoreOf string // for pre-restore snapshots, the snapshot being restored
+	Options   SnapshotOptions
+	Anonymize *AnonymizeProfile // dump an anonymized copy instead of the live data
+}
+
+// validateLabel rejects labels that cannot be part of a snapshot filename:
+// path separators, a leading dot (hidden files and "..") and control
+// characters
+func validateLabel(label string) error {
+	if strings.HasPrefix(label, ".") || strings.ContainsAny(label, "/\\") {
+		return fmt.Errorf("invalid label %q: no slashes or leading dot", label)
+	}
+	for _, r := range label {
+		if r < ' ' || r == 0x7f {
+			return fmt.Errorf("invalid label %q: no control characters", label)
+		}
+	}
+	if len(label) > 100 {
+		return fmt.Errorf("label is longer than 100 characters")
+	}
+	return nil
+}
+
+// snapshotFilename names a new snapshot: <timestamp>[_<label>].<ext>. A
+// numeric suffix is added if a snapshot with that name already exists.
+func snapshotFilename(label string, opts SnapshotOptions) string {
+	base := time.Now().Format("2006-01-02T1504")
+	if label != "" {
+		base = fmt.Sprintf("%s_%s", base, label)
+	}
+	return uniqueSnapshotFilename(base, snapshotExtension(opts))
+}
+
+// uniqueSnapshotFilename returns base+ext, or base-N+ext if that is taken
+func uniqueSnapshotFilename(base, ext string) string {
+	filename := base + ext
+	for i := 2; ; i++ {
+		if !storeHas(context.Background(), localSnapshots, filename) {
+			return filename
+		}
+		filename = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+}
+
+// deleteSnapshot removes a snapshot and its metadata sidecar
+func deleteSnapshot(path string) error {
+	return localSnapshots.Delete(context.Background(), filepath.Base(path))
+}
+
+// startSnapshotJob dumps the database in the background and returns the job
+// along with the filename the snapshot will be written to.
+func startSnapshotJob(req CreateSnapshotRequest) (*Job, string) {
+	filename := snapshotFilename(req.Label, req.Options)
+	path := filepath.Join(snapshotsDir, filename)
+
+	job := jobs.start("snapshot", filename, func(ctx context.Context, job *Job) error {
+		return runSnapshot(ctx, job, path, req)
+	})
+	return job, filename
+}
+
+func runSnapshot(ctx context.Context, job *Job, path string, req CreateSnapshotRequest) error {
+	// Gather metadata before dumping so it describes the data in the snapshot
+	meta := collectSnapshotMeta(req.Label, req.Notes, req.CreatedBy, req.Options)
+	meta.Kind = req.Kind
+	meta.RestoreOf = req.RestoreOf
+
+	source := getEnv("POSTGRES_DB", "devdb")
+	if req.Anonymize != nil {
+		scratch, err := anonymizedCopy(ctx, job, req.Anonymize)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			job.logf("Dropping %s", scratch)
+			dropDatabase(scratch)
+		}()
+		source = scratch
+		meta.Anonymization = req.Anonymize.record()
+	}
+	if req.Options.Scope.Partial() {
+		scope := req.Options.Scope
+		meta.Scope = &scope
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				job.setBytes(snapshotSize(path))
+			}
+		}
+	}()
+
+	// Row counts for verification, taken in the transaction pg_dump reads
+	var snapshotID string
+	if !req.Options.Scope.SchemaOnly {
+		job.logf("Counting rows in %s", source)
+		id, counts, release, err := exportRowCounts(ctx, source)
+		if err != nil {
+			job.logf("Warning: could not count rows, verification will have nothing to compare with: %v", err)
+		} else {
+			defer release()
+			snapshotID = id
+			meta.TableRows = counts
+		}
+	}
+
+	cmd := dumpCommand(ctx, source, path, snapshotID, req.Options)
+	var err error
+	if req.Options.Encrypt {
+		err = runEncryptedJobCommand(job, cmd, path)
+	} else {
+		err = runJobCommand(job, cmd, nil)
+	}
+	if err != nil {
+		os.RemoveAll(path)
+		return err
+	}
+	job.setBytes(snapshotSize(path))
+
+	if err := writeSnapshotMeta(path, meta); err != nil {
+		log.Printf("Warning: Could not write snapshot metadata: %v", err)
+	}
+
+	if req.Kind == kindPreRestore {
+		prunePreRestoreSnapshots(job)
+	}
+	return nil
+}
+
+// runJobCommand runs cmd, streaming its output into the job log. If observe
+// is not nil it is also called with every line of output. A standard output
+// already set on cmd is left in place.
+func runJobCommand(job *Job, cmd *exec.Cmd, observe func(line string)) error {
+	out := &lineWriter{fn: func(line string) {
+		job.appendLog(line)
+		if observe != nil {
+			observe(line)
+		}
+	}}
+	if cmd.Stdout == nil {
+		cmd.Stdout = out
+	}
+	cmd.Stderr = out
+
+	err := cmd.Run()
+	out.Flush()
+	if err != nil {
+		log.Printf("%s failed: %v, last output: %s", filepath.Base(cmd.Path), err, out.last)
+		if out.last != "" {
+			return fmt.Errorf("%s: %v: %s", filepath.Base(cmd.Path), err, out.last)
+		}
+		return fmt.Errorf("%s: %v", filepath.Base(cmd.Path), err)
+	}
+	return nil
+}
+
+// lineWriter splits written output into lines and passes each to fn
+type lineWriter struct {
+	mu   sync.Mutex
+	buf  []byte
+	last string
+	fn   func(string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.emitLocked(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.emitLocked(string(w.buf))
+		w.buf = nil
+	}
+}
+
+func (w *lineWriter) emitLocked(line string) {
+	line = strings.TrimRight(line, "\r")
+	if line == "" {
+		return
+	}
+	w.last = line
+	w.fn(line)
+}
+
+// countingReader reports the number of bytes read from a snapshot file
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	job *Job
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	before := c.n >> 20
+	c.n += int64(n)
+	// Publish at most once per MiB read
+	if c.n>>20 != before || err == io.EOF {
+		c.job.setBytes(c.n)
+	}
+	return n, err
+}
+
+// copyScanner watches a plain SQL stream for COPY statements so the table
+// currently being loaded can be reported.
+type copyScanner struct {
+	r    io.Reader
+	line []byte
+	job  *Job
+}
+
+func (s *copyScanner) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	chunk := p[:n]
+	for len(chunk) > 0 {
+		i := bytes.IndexByte(chunk, '\n')
+		if i < 0 {
+			s.appendLine(chunk)
+			break
+		}
+		s.appendLine(chunk[:i])
+		s.endLine()
+		chunk = chunk[i+1:]
+	}
+	return n, err
+}
+
+// maxCopyLine is the longest COPY statement copyScanner recognises
+const maxCopyLine = 64 << 10
+
+// appendLine keeps lines that may be COPY statements; others are dropped
+// after their first bytes
+func (s *copyScanner) appendLine(b []byte) {
+	if len(s.line) >= len("COPY ") && !bytes.HasPrefix(s.line, []byte("COPY ")) {
+		return
+	}
+	if room := maxCopyLine - len(s.line); room > 0 {
+		if len(b) > room {
+			b = b[:room]
+		}
+		s.line = append(s.line, b...)
+	}
+}
+
+func (s *copyScanner) endLine() {
+	if !isCopyFromStdin(s.line) {
+		s.line = s.line[:0]
+		return
+	}
+	table := strings.TrimPrefix(string(s.line), "COPY ")
+	s.line = s.line[:0]
+	if i := strings.IndexAny(table, " ("); i >= 0 {
+		table = table[:i]
+	}
+	s.job.update(func(info *JobInfo) { info.CurrentTable = table })
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var errStatementsNotLoaded = errors.New("pg_stat_statements is not in shared_preload_libraries; restart the container so PostgreSQL loads it")
+
+// StatementStats is one normalized statement from pg_stat_statements,
+// summed over the users that ran it. Times are in milliseconds.
+type StatementStats struct {
+	QueryID    int64
+	Query      string
+	Calls      int64
+	TotalMs    float64
+	MeanMs     float64
+	Rows       int64
+	BlocksHit  int64
+	BlocksRead int64
+}
+
+// StatementBaseline is a capture of pg_stat_statements to compare against
+type StatementBaseline struct {
+	Label      string
+	CapturedAt time.Time
+	Statements []StatementStats
+}
+
+// StatementComparison sets a statement's cost against the baseline. Either
+// side is nil when the statement only ran on the other.
+type StatementComparison struct {
+	QueryID    int64
+	Query      string
+	Baseline   *StatementStats
+	Current    *StatementStats
+	MeanChange float64 // current mean / baseline mean - 1, 0 if either is missing
+	TotalDelta float64 // current total - baseline total, in ms
+}
+
+// statementOrders maps the order parameter to a column of the query below
+var statementOrders = map[string]string{
+	"total": "total_ms",
+	"mean":  "mean_ms",
+	"calls": "calls",
+}
+
+// baselinePath is where the baseline is kept, next to the snapshots so it
+// survives restarts. Hidden files are ignored by the snapshot listing.
+func baselinePath() string {
+	return filepath.Join(snapshotsDir, ".query-baseline.json")
+}
+
+// ensureStatStatements creates the extension in POSTGRES_DB if needed. It
+// is re-checked on every use since a restore or branch switch replaces the
+// database, and the extension may not be in the snapshot.
+func ensureStatStatements(ctx context.Context) error {
+	if db == nil {
+		return fmt.Errorf("no connection to the database")
+	}
+	var libraries string
+	if err := db.QueryRowContext(ctx, "SHOW shared_preload_libraries").Scan(&libraries); err != nil {
+		return err
+	}
+	if !strings.Contains(libraries, "pg_stat_statements") {
+		return errStatementsNotLoaded
+	}
+	var installed bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_stat_statements')").Scan(&installed); err != nil {
+		return err
+	}
+	if installed {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, "CREATE EXTENSION IF NOT EXISTS pg_stat_statements")
+	return err
+}
+
+// topStatements returns the statements run against POSTGRES_DB ranked by
+// order (total, mean or calls); limit 0 returns all of them
+func topStatements(ctx context.Context, order string, limit int) ([]StatementStats, error) {
+	column, ok := statementOrders[order]
+	if !ok {
+		return nil, fmt.Errorf("unknown order %q (use total, mean or calls)", order)
+	}
+	if err := ensureStatStatements(ctx); err != nil {
+		return nil, err
+	}
+	query := `
+		SELECT queryid, min(query), sum(calls)::bigint AS calls,
+			sum(total_exec_time) AS total_ms,
+			sum(total_exec_time) / nullif(sum(calls), 0) AS mean_ms,
+			sum(rows)::bigint, sum(shared_blks_hit)::bigint, sum(shared_blks_read)::bigint
+		FROM pg_stat_statements
+		WHERE dbid = (SELECT oid FROM pg_database WHERE datname = current_database())
+			AND queryid IS NOT NULL
+		GROUP BY queryid
+		ORDER BY ` + column + ` DESC NULLS LAST`
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var statements []StatementStats
+	for rows.Next() {
+		var s StatementStats
+		var mean sql.NullFloat64
+		if err := rows.Scan(&s.QueryID, &s.Query, &s.Calls, &s.TotalMs, &mean, &s.Rows, &s.BlocksHit, &s.BlocksRead); err != nil {
+			return nil, err
+		}
+		s.MeanMs = mean.Float64
+		s.Query = strings.Join(strings.Fields(s.Query), " ")
+		statements = append(statements, s)
+	}
+	return statements, rows.Err()
+}
+
+// resetStatements clears the statistics of every database. A full reset is
+// recorded in pg_stat_statements_info, which compareStatements relies on.
+func resetStatements(ctx context.Context) error {
+	if err := ensureStatStatements(ctx); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, "SELECT pg_stat_statements_reset()")
+	return err
+}
+
+// statementsResetAt returns when the statistics were last reset
+func statementsResetAt(ctx context.Context) time.Time {
+	var reset time.Time
+	db.QueryRowContext(ctx, "SELECT stats_reset FROM pg_stat_statements_info").Scan(&reset)
+	return reset
+}
+
+func captureBaseline(ctx context.Context, label string) (*StatementBaseline, error) {
+	statements, err := topStatements(ctx, "total", 0)
+	if err != nil {
+		return nil, err
+	}
+	baseline := &StatementBaseline{Label: label, CapturedAt: time.Now(), Statements: statements}
+	data, err := json.MarshalIndent(baseline, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	tmp := baselinePath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return nil, err
+	}
+	return baseline, os.Rename(tmp, baselinePath())
+}
+
+// readBaseline returns the captured baseline, or nil if there is none
+func readBaseline() (*StatementBaseline, error) {
+	data, err := os.ReadFile(baselinePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var baseline StatementBaseline
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		return nil, err
+	}
+	return &baseline, nil
+}
+
+// compareStatements sets the current statistics against the baseline. When
+// they have not been reset since the baseline was captured, the baseline's
+// calls are subtracted so only what ran afterwards is compared; resetting
+// right after capturing gives the same result.
+func compareStatements(ctx context.Context, baseline *StatementBaseline) ([]StatementComparison, error) {
+	current, err := topStatements(ctx, "total", 0)
+	if err != nil {
+		return nil, err
+	}
+	before := make(map[int64]StatementStats)
+	for _, s := range baseline.Statements {
+		before[s.QueryID] = s
+	}
+	cumulative := statementsResetAt(ctx).Before(baseline.CapturedAt)
+
+	var comparisons []StatementComparison
+	seen := make(map[int64]bool)
+	for _, s := range current {
+		seen[s.QueryID] = true
+		base, inBaseline := before[s.QueryID]
+		// Fewer calls than in the baseline means the entry was evicted and
+		// started over
+		if cumulative && inBaseline && s.Calls >= base.Calls {
+			s = subtractStats(s, base)
+		}
+		if s.Calls == 0 && !inBaseline {
+			continue
+		}
+		c := StatementComparison{QueryID: s.QueryID, Query: s.Query, TotalDelta: s.TotalMs}
+		if s.Calls > 0 {
+			cur := s
+			c.Current = &cur
+		}
+		if inBaseline {
+			b := base
+			c.Baseline = &b
+			c.TotalDelta -= base.TotalMs
+			if c.Current != nil && base.MeanMs > 0 {
+				c.MeanChange = c.Current.MeanMs/base.MeanMs - 1
+			}
+		}
+		comparisons = append(comparisons, c)
+	}
+	for _, base := range baseline.Statements {
+		if !seen[base.QueryID] {
+			b := base
+			comparisons = append(comparisons, StatementComparison{QueryID: base.QueryID, Query: base.Query, Baseline: &b, TotalDelta: -base.TotalMs})
+		}
+	}
+	sort.Slice(comparisons, func(i, j int) bool {
+		return math.Abs(comparisons[i].TotalDelta) > math.Abs(comparisons[j].TotalDelta)
+	})
+	return comparisons, nil
+}
+
+// subtractStats returns what s accumulated since base was captured
+func subtractStats(s, base StatementStats) StatementStats {
+	s.Calls -= base.Calls
+	s.TotalMs -= base.TotalMs
+	s.Rows -= base.Rows
+	s.BlocksHit -= base.BlocksHit
+	s.BlocksRead -= base.BlocksRead
+	s.MeanMs = 0
+	if s.Calls > 0 {
+		s.MeanMs = s.TotalMs / float64(s.Calls)
+	}
+	return s
+}
+
+// handleStatements lists the top statements; order is total (default), mean
+// or calls and limit defaults to 20
+func handleStatements(w http.ResponseWriter, r *http.Request) {
+	order := r.URL.Query().Get("order")
+	if order == "" {
+		order = "total"
+	}
+	limit := parseInt(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = 20
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	statements, err := topStatements(r.Context(), order, limit)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	if statements == nil {
+		statements = []StatementStats{}
+	}
+	response := map[string]interface{}{
+		"success":    true,
+		"statements": statements,
+	}
+	if baseline, _ := readBaseline(); baseline != nil {
+		response["baseline"] = map[string]interface{}{
+			"label":       baseline.Label,
+			"captured_at": baseline.CapturedAt,
+			"statements":  len(baseline.Statements),
+		}
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleResetStatements clears the statistics of every database, not just
+// POSTGRES_DB
+func handleResetStatements(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := resetStatements(r.Context()); err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+	})
+}
+
+// handleStatementBaseline captures a new baseline, replacing the previous
+// one, or removes it with clear=1
+func handleStatementBaseline(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.URL.Query().Get("clear") != "" {
+		if err := os.Remove(baselinePath()); err != nil && !os.IsNotExist(err) {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+		})
+		return
+	}
+
+	baseline, err := captureBaseline(r.Context(), r.URL.Query().Get("label"))
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"captured_at": baseline.CapturedAt,
+		"statements":  len(baseline.Statements),
+	})
+}
+
+// handleCompareStatements compares the current statistics with the
+// baseline, biggest change in total time first; limit defaults to 20
+func handleCompareStatements(w http.ResponseWriter, r *http.Request) {
+	limit := parseInt(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = 20
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(err error) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+	}
+
+	baseline, err := readBaseline()
+	if err == nil && baseline == nil {
+		err = fmt.Errorf("no baseline captured yet")
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+	comparisons, err := compareStatements(r.Context(), baseline)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if len(comparisons) > limit {
+		comparisons = comparisons[:limit]
+	}
+	if comparisons == nil {
+		comparisons = []StatementComparison{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"label":       baseline.Label,
+		"captured_at": baseline.CapturedAt,
+		"comparisons": comparisons,
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SnapshotStore is a place snapshots are kept, addressed by filename.
+// Metadata sidecars are stored next to their snapshot as <filename>.json.
+type SnapshotStore interface {
+	// List returns the snapshots in the store, without their sidecars
+	List(ctx context.Context) ([]StoredSnapshot, error)
+	// Stat describes one object; missing objects give an fs.ErrNotExist error
+	Stat(ctx context.Context, name string) (StoredSnapshot, error)
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	// Put stores size bytes from r under name, replacing any existing object
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	// Delete removes a snapshot and its sidecar
+	Delete(ctx context.Context, name string) error
+	String() string
+}
+
+// StoredSnapshot describes an object in a SnapshotStore
+type StoredSnapshot struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// localSnapshots is the snapshots directory every other operation works on
+var localSnapshots = &localStore{dir: snapshotsDir}
+
+// localStore keeps snapshots in a directory. Directory-format snapshots are
+// listed but cannot be opened as a stream.
+type localStore struct {
+	dir string
+}
+
+func (s *localStore) String() string {
+	return s.dir
+}
+
+func (s *localStore) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+func (s *localStore) List(ctx context.Context) ([]StoredSnapshot, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []StoredSnapshot
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || !isSnapshotFile(name) {
+			continue
+		}
+		// Directory snapshots are only complete once pg_dump has written toc.dat
+		if entry.IsDir() {
+			if _, err := os.Stat(filepath.Join(s.dir, name, "toc.dat")); err != nil {
+				continue
+			}
+		} else if strings.HasSuffix(name, extDirectory) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, StoredSnapshot{
+			Name:    name,
+			Size:    snapshotSize(s.path(name)),
+			ModTime: info.ModTime(),
+		})
+	}
+	return snapshots, nil
+}
+
+func (s *localStore) Stat(ctx context.Context, name string) (StoredSnapshot, error) {
+	info, err := os.Stat(s.path(name))
+	if err != nil {
+		return StoredSnapshot{}, err
+	}
+	return StoredSnapshot{Name: name, Size: snapshotSize(s.path(name)), ModTime: info.ModTime()}, nil
+}
+
+func (s *localStore) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	if strings.HasSuffix(name, extDirectory) {
+		return nil, fmt.Errorf("%s: directory-format snapshots cannot be transferred", name)
+	}
+	return os.Open(s.path(name))
+}
+
+// Put writes to a hidden temp file first so a partial transfer never shows
+// up as a snapshot
+func (s *localStore) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	tmp, err := os.CreateTemp(s.dir, ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && size >= 0 && n != size {
+		err = fmt.Errorf("%s: received %d of %d bytes", name, n, size)
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path(name)); err != nil {
+		return err
+	}
+	return os.Chmod(s.path(name), 0644)
+}
+
+func (s *localStore) Delete(ctx context.Context, name string) error {
+	if err := os.RemoveAll(s.path(name)); err != nil {
+		return err
+	}
+	if err := os.Remove(s.path(name) + ".json"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// storeHas reports whether name exists in store
+func storeHas(ctx context.Context, store SnapshotStore, name string) bool {
+	_, err := store.Stat(ctx, name)
+	return err == nil
+}
+
+// errNotStored wraps fs.ErrNotExist for objects missing from a remote store
+func errNotStored(name string) error {
+	return fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// kindSubset marks snapshots holding a referentially complete subset of
+// the database
+const kindSubset = "subset"
+
+// SubsetRoot selects the rows a subset starts from: the rows of Table that
+// match Where, or a random Percent of them
+type SubsetRoot struct {
+	Table   SnapshotTable
+	Where   string
+	Percent float64
+}
+
+// SnapshotSubset records how a subset snapshot was selected
+type SnapshotSubset struct {
+	Roots    []string `json:"roots"`
+	Children bool     `json:"children,omitempty"`
+}
+
+var subsetPercentRe = regexp.MustCompile(`^(\S+)\s+([0-9]*\.?[0-9]+)\s*%$`)
+
+// parseSubsetRoot parses "users WHERE id IN (1, 2)", "orders 1%" or a bare
+// table name
+func parseSubsetRoot(s string) (SubsetRoot, error) {
+	s = strings.TrimSpace(s)
+	var root SubsetRoot
+	table := s
+
+	if m := subsetPercentRe.FindStringSubmatch(s); m != nil {
+		table = m[1]
+		root.Percent, _ = strconv.ParseFloat(m[2], 64)
+		if root.Percent <= 0 || root.Percent > 100 {
+			return root, fmt.Errorf("%s: percentage must be between 0 and 100", s)
+		}
+	} else if i := strings.Index(strings.ToUpper(s), " WHERE "); i >= 0 {
+		table = s[:i]
+		root.Where = strings.TrimSpace(s[i+len(" WHERE "):])
+		// The condition must stay a single expression
+		if strings.ContainsAny(root.Where, ";\\\r\n") {
+			return root, fmt.Errorf("%s: the condition cannot contain ';', '\\' or line breaks", s)
+		}
+	}
+
+	table = strings.TrimSpace(table)
+	if table == "" || (strings.ContainsAny(table, " \t") && !strings.HasPrefix(table, `"`)) {
+		return root, fmt.Errorf("%q: expected \"table\", \"table WHERE condition\" or \"table N%%\"", s)
+	}
+	root.Table.Schema, root.Table.Name = splitQualifiedName(table)
+	return root, nil
+}
+
+func (r SubsetRoot) String() string {
+	switch {
+	case r.Where != "":
+		return r.Table.qualified() + " WHERE " + r.Where
+	case r.Percent > 0:
+		return r.Table.qualified() + " " + strconv.FormatFloat(r.Percent, 'f', -1, 64) + "%"
+	}
+	return r.Table.qualified()
+}
+
+// foreignKey is a foreign key from Child (Columns) to Parent (RefColumns).
+// Tables are named "schema.table" as in the subsetTable map.
+type foreignKey struct {
+	Child      string
+	Parent     string
+	Columns    []string
+	RefColumns []string
+}
+
+// subsetTable is a table that can be part of a subset, with the columns
+// COPY has to write (generated columns are left out)
+type subsetTable struct {
+	Name    string // quoted, for use in SQL
+	Columns []string
+}
+
+// loadSubsetCatalog reads the tables of POSTGRES_DB, keyed by "schema.table",
+// and the foreign keys between them
+func loadSubsetCatalog(ctx context.Context) (map[string]*subsetTable, []foreignKey, error) {
+	if db == nil {
+		return nil, nil, fmt.Errorf("no connection to %s", getEnv("POSTGRES_DB", "devdb"))
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT n.nspname, c.relname, array_agg(quote_ident(a.attname) ORDER BY a.attnum)
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_attribute a ON a.attrelid = c.oid AND a.attnum > 0 AND NOT a.attisdropped AND a.attgenerated = ''
+		WHERE c.relkind = 'r' AND`+userRelationFilter+`
+		GROUP BY n.nspname, c.relname
+	`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	tables := make(map[string]*subsetTable)
+	for rows.Next() {
+		var schema, name string
+		t := &subsetTable{}
+		if err := rows.Scan(&schema, &name, pq.Array(&t.Columns)); err != nil {
+			return nil, nil, err
+		}
+		t.Name = pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(name)
+		tables[schema+"."+name] = t
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	fkRows, err := db.QueryContext(ctx, `
+		SELECT cn.nspname || '.' || c.relname, pn.nspname || '.' || p.relname,
+		       ARRAY(SELECT quote_ident(attname) FROM unnest(con.conkey) WITH ORDINALITY k(num, ord)
+		             JOIN pg_attribute ON attrelid = con.conrelid AND attnum = k.num ORDER BY k.ord),
+		       ARRAY(SELECT quote_ident(attname) FROM unnest(con.confkey) WITH ORDINALITY k(num, ord)
+		             JOIN pg_attribute ON attrelid = con.confrelid AND attnum = k.num ORDER BY k.ord)
+		FROM pg_constraint con
+		JOIN pg_class c ON c.oid = con.conrelid
+		JOIN pg_namespace cn ON cn.oid = c.relnamespace
+		JOIN pg_class p ON p.oid = con.confrelid
+		JOIN pg_namespace pn ON pn.oid = p.relnamespace
+		WHERE con.contype = 'f'
+	`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fkRows.Close()
+	var fks []foreignKey
+	for fkRows.Next() {
+		var fk foreignKey
+		if err := fkRows.Scan(&fk.Child, &fk.Parent, pq.Array(&fk.Columns), pq.Array(&fk.RefColumns)); err != nil {
+			return nil, nil, err
+		}
+		// Keys on partitioned tables or extension tables are not followed
+		if tables[fk.Child] != nil && tables[fk.Parent] != nil {
+			fks = append(fks, fk)
+		}
+	}
+	return tables, fks, fkRows.Err()
+}
+
+// subsetIDBatch is how many ctids are passed to one query
+const subsetIDBatch = 10000
+
+// ctidSet is a set of row ctids ("(0,1)") in one table
+type ctidSet map[string]bool
+
+// selectSubset selects the subset's rows, by ctid per table. Roots are
+// selected first; with children, rows referencing them (transitively) are
+// added, and finally every row the selection references, so that the
+// subset satisfies its foreign keys. Children come first so that only rows
+// below the roots are pulled in, not everything referencing a parent added
+// for completeness.
+func selectSubset(ctx context.Context, tx *sql.Tx, tables map[string]*subsetTable, fks []foreignKey, roots []SubsetRoot, children bool) (map[string]ctidSet, error) {
+	selected := make(map[string]ctidSet)
+	added := make(map[string][]string)
+	add := func(table string, ids []string) {
+		if selected[table] == nil {
+			selected[table] = make(ctidSet)
+		}
+		for _, id := range ids {
+			if !selected[table][id] {
+				selected[table][id] = true
+				added[table] = append(added[table], id)
+			}
+		}
+	}
+
+	for _, root := range roots {
+		key := root.Table.qualified()
+		t := tables[key]
+		if t == nil {
+			return nil, fmt.Errorf("table %s not found", key)
+		}
+		query := "SELECT ctid::text FROM " + t.Name
+		if root.Percent > 0 {
+			query += " TABLESAMPLE BERNOULLI (" + strconv.FormatFloat(root.Percent, 'f', -1, 64) + ")"
+		}
+		if root.Where != "" {
+			query += " WHERE (" + root.Where + ")"
+		}
+		ids, err := queryCtids(ctx, tx, query)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", root, err)
+		}
+		add(key, ids)
+	}
+
+	// follow adds the rows of to that join rows of from newly added in the
+	// previous round, until a round adds nothing
+	follow := func(pending map[string][]string, edges func(fk foreignKey) (from, to, join string)) error {
+		for len(pending) > 0 {
+			added = make(map[string][]string)
+			for _, fk := range fks {
+				from, to, join := edges(fk)
+				for start := 0; start < len(pending[from]); start += subsetIDBatch {
+					batch := pending[from][start:min(start+subsetIDBatch, len(pending[from]))]
+					ids, err := queryCtids(ctx, tx, fmt.Sprintf(
+						"SELECT DISTINCT t.ctid::text FROM %s t JOIN %s f ON %s WHERE f.ctid = ANY($1::tid[])",
+						tables[to].Name, tables[from].Name, join), pq.Array(batch))
+					if err != nil {
+						return err
+					}
+					add(to, ids)
+				}
+			}
+			pending = added
+		}
+		return nil
+	}
+
+	if children {
+		err := follow(added, func(fk foreignKey) (string, string, string) {
+			return fk.Parent, fk.Child, fkJoin(fk, "f", "t")
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	all := make(map[string][]string)
+	for table, ids := range selected {
+		for id := range ids {
+			all[table] = append(all[table], id)
+		}
+	}
+	err := follow(all, func(fk foreignKey) (string, string, string) {
+		return fk.Child, fk.Parent, fkJoin(fk, "t", "f")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return selected, nil
+}
+
+// fkJoin is the join condition of fk, with parent and child as the aliases
+// of its tables
+func fkJoin(fk foreignKey, parent, child string) string {
+	conds := make([]string, len(fk.Columns))
+	for i := range fk.Columns {
+		conds[i] = fmt.Sprintf("%s.%s = %s.%s", parent, fk.RefColumns[i], child, fk.Columns[i])
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// queryCtids runs a query returning ctids as a prepared statement, which
+// PostgreSQL only accepts for a single statement
+func queryCtids(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) ([]string, error) {
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// copyEscaper escapes a value for COPY's text format
+var copyEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+// writeSubsetRows writes the selected rows of every table as COPY blocks.
+// Values are read with their text output, which COPY accepts as input.
+func writeSubsetRows(ctx context.Context, tx *sql.Tx, w io.Writer, tables map[string]*subsetTable, selected map[string]ctidSet) error {
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		t := tables[name]
+		if _, err := fmt.Fprintf(w, "COPY %s (%s) FROM stdin;\n", t.Name, strings.Join(t.Columns, ", ")); err != nil {
+			return err
+		}
+		ids := make([]string, 0, len(selected[name]))
+		for id := range selected[name] {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		exprs := make([]string, len(t.Columns))
+		for i, col := range t.Columns {
+			exprs[i] = col + "::text"
+		}
+		query := fmt.Sprintf("SELECT %s FROM %s WHERE ctid = ANY($1::tid[])", strings.Join(exprs, ", "), t.Name)
+		for start := 0; start < len(ids); start += subsetIDBatch {
+			batch := ids[start:min(start+subsetIDBatch, len(ids))]
+			if err := copyRows(ctx, tx, w, query, len(t.Columns), pq.Array(batch)); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+		if _, err := io.WriteString(w, "\\.\n\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyRows(ctx context.Context, tx *sql.Tx, w io.Writer, query string, columns int, args ...interface{}) error {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	values := make([]sql.NullString, columns)
+	dest := make([]interface{}, columns)
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	var line strings.Builder
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		line.Reset()
+		for i, v := range values {
+			if i > 0 {
+				line.WriteByte('\t')
+			}
+			if v.Valid {
+				line.WriteString(copyEscaper.Replace(v.String))
+			} else {
+				line.WriteString(`\N`)
+			}
+		}
+		line.WriteByte('\n')
+		if _, err := io.WriteString(w, line.String()); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// sequenceValues returns setval calls that give every sequence in the subset
+// the value it has in POSTGRES_DB, so new rows do not collide with copied ones
+func sequenceValues(ctx context.Context) (string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT format('SELECT pg_catalog.setval(%L, %s, true);', format('%I.%I', schemaname, sequencename), last_value)
+		FROM pg_sequences
+		WHERE last_value IS NOT NULL
+		ORDER BY schemaname, sequencename
+	`)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	var b strings.Builder
+	for rows.Next() {
+		var stmt string
+		if err := rows.Scan(&stmt); err != nil {
+			return "", err
+		}
+		b.WriteString(stmt + "\n")
+	}
+	return b.String(), rows.Err()
+}
+
+// subsetRows selects the subset and writes its rows, in a read-only
+// transaction so that a root's condition cannot change POSTGRES_DB. It
+// returns the number of rows selected from each table.
+func subsetRows(ctx context.Context, w io.Writer, tables map[string]*subsetTable, fks []foreignKey, roots []SubsetRoot, children bool) (map[string]int64, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	selected, err := selectSubset(ctx, tx, tables, fks, roots, children)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeSubsetRows(ctx, tx, w, tables, selected); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(tables))
+	for name := range tables {
+		counts[name] = int64(len(selected[name]))
+	}
+	return counts, nil
+}
+
+func startSubsetJob(req CreateSnapshotRequest, roots []SubsetRoot, children bool) (*Job, string) {
+	req.Kind = kindSubset
+	req.Options = SnapshotOptions{Format: formatPlain, Compression: -1, Encrypt: encryptionConfigured()}
+	filename := snapshotFilename(req.Label, req.Options)
+	path := filepath.Join(snapshotsDir, filename)
+
+	job := jobs.start("snapshot", filename, func(ctx context.Context, job *Job) error {
+		return runSubset(ctx, job, path, req, roots, children)
+	})
+	return job, filename
+}
+
+// runSubset writes a plain SQL snapshot made of pg_dump's pre-data section,
+// the subset's rows, the sequence values and pg_dump's post-data section.
+// Constraints are in post-data, so the rows load in any order.
+func runSubset(ctx context.Context, job *Job, path string, req CreateSnapshotRequest, roots []SubsetRoot, children bool) error {
+	meta := collectSnapshotMeta(req.Label, req.Notes, req.CreatedBy, req.Options)
+	meta.Kind = kindSubset
+	meta.Subset = &SnapshotSubset{Children: children}
+	for _, root := range roots {
+		meta.Subset.Roots = append(meta.Subset.Roots, root.String())
+	}
+
+	job.logf("Reading tables and foreign keys")
+	tables, fks, err := loadSubsetCatalog(ctx)
+	if err != nil {
+		return err
+	}
+	sequences, err := sequenceValues(ctx)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(snapshotsDir, ".subset-*"+snapshotExtension(req.Options))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var out io.Writer = tmp
+	var enc *encryptWriter
+	if req.Options.Encrypt {
+		if enc, err = newEncryptWriter(tmp); err != nil {
+			return err
+		}
+		out = enc
+	}
+
+	live := getEnv("POSTGRES_DB", "devdb")
+	section := func(name string) error {
+		job.logf("Dumping %s section", name)
+		cmd := pgCommand(ctx, "pg_dump", "-d", live, "--section="+name)
+		cmd.Stdout = out
+		cmd.Stderr = &lineWriter{fn: job.appendLog}
+		return cmd.Run()
+	}
+
+	if err := section("pre-data"); err != nil {
+		return fmt.Errorf("pg_dump failed: %v", err)
+	}
+	job.logf("Selecting %d root(s) and following %d foreign key(s)", len(roots), len(fks))
+	counts, err := subsetRows(ctx, out, tables, fks, roots, children)
+	if err != nil {
+		return fmt.Errorf("selecting the subset failed: %v", err)
+	}
+	if _, err := io.WriteString(out, "\n"+sequences+"\n"); err != nil {
+		return err
+	}
+	if err := section("post-data"); err != nil {
+		return fmt.Errorf("pg_dump failed: %v", err)
+	}
+	if enc != nil {
+		if err := enc.Close(); err != nil {
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// The selected counts are what verification expects to restore
+	meta.TableRows = counts
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var total int64
+	for _, name := range names {
+		total += counts[name]
+		if counts[name] > 0 {
+			job.logf("%s: %d rows", name, counts[name])
+		}
+	}
+	job.logf("Subset holds %d rows", total)
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	os.Chmod(path, 0644)
+	job.setBytes(snapshotSize(path))
+	if err := writeSnapshotMeta(path, meta); err != nil {
+		log.Printf("Warning: Could not write snapshot metadata: %v", err)
+	}
+	return nil
+}
+
+// handleCreateSubset takes a subset snapshot. Each root parameter is a
+// table with an optional filter: root=users WHERE id IN (1,2) or
+// root=orders 1%. children=1 also includes rows referencing the roots.
+func handleCreateSubset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var roots []SubsetRoot
+	for _, s := range r.URL.Query()["root"] {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		root, err := parseSubsetRoot(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		roots = append(roots, root)
+	}
+	if len(roots) == 0 {
+		http.Error(w, "Missing root", http.StatusBadRequest)
+		return
+	}
+	if err := validateLabel(r.URL.Query().Get("label")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, filename := startSubsetJob(CreateSnapshotRequest{
+		Label:     r.URL.Query().Get("label"),
+		Notes:     r.URL.Query().Get("notes"),
+		CreatedBy: r.URL.Query().Get("created_by"),
+	}, roots, r.URL.Query().Get("children") != "")
+
+	// Scripts can pass wait=1 to block until the snapshot has been written
+	if r.URL.Query().Get("wait") != "" {
+		info := job.Wait()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  info.Status == jobSucceeded,
+			"error":    info.Error,
+			"job_id":   info.ID,
+			"filename": filename,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"job_id":   job.Info().ID,
+		"filename": filename,
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestParseSubsetRoot(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string // String() of the parsed root
+		wantErr bool
+	}{
+		{"users", "public.users", false},
+		{"app.events", "app.events", false},
+		{"users WHERE id IN (1, 2, 3)", "public.users WHERE id IN (1, 2, 3)", false},
+		{"users where email LIKE '%@example.com'", "public.users WHERE email LIKE '%@example.com'", false},
+		{"orders 1%", "public.orders 1%", false},
+		{"orders 0.5%", "public.orders 0.5%", false},
+		{`"Order Items" 10%`, "public.Order Items 10%", false},
+		{"orders 0%", "", true},
+		{"orders 101%", "", true},
+		{"", "", true},
+		{"users id = 1", "", true},
+		{"users WHERE true; DELETE FROM users", "", true},
+		{`users WHERE true \! rm -rf /`, "", true},
+		{"users WHERE true\nCOMMIT", "", true},
+		{"users WHERE true\r\nCOMMIT", "", true},
+	}
+	for _, tt := range tests {
+		root, err := parseSubsetRoot(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSubsetRoot(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && root.String() != tt.want {
+			t.Errorf("parseSubsetRoot(%q) = %q, want %q", tt.in, root.String(), tt.want)
+		}
+	}
+}
+
+func TestCopyEscaper(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{"tab\there", `tab\there`},
+		{"two\nlines\r\n", `two\nlines\r\n`},
+		{`back\slash`, `back\\slash`},
+		{`\N`, `\\N`},
+	}
+	for _, tt := range tests {
+		if got := copyEscaper.Replace(tt.in); got != tt.want {
+			t.Errorf("copyEscaper.Replace(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFKJoin(t *testing.T) {
+	fk := foreignKey{
+		Child: "public.order_items", Parent: "public.orders",
+		Columns: []string{"order_id", "shop_id"}, RefColumns: []string{"id", "shop_id"},
+	}
+	want := "p.id = c.order_id AND p.shop_id = c.shop_id"
+	if got := fkJoin(fk, "p", "c"); got != want {
+		t.Errorf("fkJoin() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// kindUploaded marks snapshots uploaded through the dashboard or API
+const kindUploaded = "uploaded"
+
+const (
+	plainDumpHeader  = "-- PostgreSQL database dump"
+	plainDumpTrailer = "-- PostgreSQL database dump complete"
+	customDumpMagic  = "PGDMP"
+)
+
+// maxUploadSize is the largest snapshot that may be uploaded
+// (SNAPSHOT_UPLOAD_MAX_MB, default 2048)
+func maxUploadSize() int64 {
+	mb := parseInt(getEnv("SNAPSHOT_UPLOAD_MAX_MB", "2048"))
+	if mb <= 0 {
+		mb = 2048
+	}
+	return int64(mb) << 20
+}
+
+// detectDumpFormat identifies a pg_dump file from its first bytes and
+// returns the extension it should be stored under
+func detectDumpFormat(head []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(head, []byte(customDumpMagic)):
+		return extCustom, nil
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		// Only the start of the stream is available, so a truncated read
+		// is expected here
+		gz, err := gzip.NewReader(bytes.NewReader(head))
+		if err != nil {
+			return "", fmt.Errorf("not a valid gzip file: %v", err)
+		}
+		plain, _ := io.ReadAll(io.LimitReader(gz, 8<<10))
+		if !bytes.Contains(plain, []byte(plainDumpHeader)) {
+			return "", fmt.Errorf("gzip file does not contain a pg_dump SQL script")
+		}
+		return extPlainCompressed, nil
+	case bytes.Contains(head[:min(len(head), 8<<10)], []byte(plainDumpHeader)):
+		return extPlain, nil
+	}
+	return "", fmt.Errorf("not a pg_dump file (expected a custom-format archive or a plain SQL dump)")
+}
+
+// verifyDump checks that an uploaded dump is complete: custom archives must
+// have a table of contents pg_restore can read, and SQL dumps must end with
+// pg_dump's trailer. The format is taken from the extension of path.
+func verifyDump(path string) error {
+	if snapshotFormat(path) == formatCustom {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		cmd, closer, err := pgRestoreCommand(ctx, path, "-l")
+		if err != nil {
+			return err
+		}
+		defer closer.Close()
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("pg_restore cannot read the archive: %s", strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+
+	r, err := openPlainDump(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Keep only the tail; reading to the end also checks the gzip checksum
+	tail := make([]byte, 0, 512)
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := r.Read(buf)
+		tail = append(tail, buf[:n]...)
+		if len(tail) > 256 {
+			tail = append(tail[:0], tail[len(tail)-256:]...)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("could not read dump: %v", err)
+		}
+	}
+	if !bytes.Contains(tail, []byte(plainDumpTrailer)) {
+		return fmt.Errorf("SQL dump is incomplete (missing %q)", plainDumpTrailer)
+	}
+	return nil
+}
+
+// uploadBaseName turns an uploaded filename into a safe snapshot name
+// without extension
+func uploadBaseName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	for _, ext := range []string{extPlainCompressed, extPlain, extCustom, ".gz"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+	name = strings.TrimLeft(name, "_-")
+	if len(name) > 100 {
+		name = name[:100]
+	}
+	if name == "" {
+		name = time.Now().Format("2006-01-02T1504") + "_upload"
+	}
+	return name
+}
+
+// receiveUpload streams the file part of an upload into a hidden temp file
+// in the snapshots directory and returns its path and extension. When a
+// snapshot key is configured the upload is encrypted as it is written.
+func receiveUpload(part io.Reader, limit int64) (string, string, error) {
+	br := bufio.NewReaderSize(part, 64<<10)
+	head, err := br.Peek(64 << 10)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", "", err
+	}
+	ext, err := detectDumpFormat(head)
+	if err != nil {
+		return "", "", err
+	}
+
+	encrypt := encryptionConfigured()
+	if encrypt {
+		ext += extEncrypted
+	}
+
+	tmp, err := os.CreateTemp(snapshotsDir, ".upload-*"+ext)
+	if err != nil {
+		return "", "", err
+	}
+	var out io.Writer = tmp
+	var enc *encryptWriter
+	if encrypt {
+		if enc, err = newEncryptWriter(tmp); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return "", "", err
+		}
+		out = enc
+	}
+	n, err := io.Copy(out, io.LimitReader(br, limit+1))
+	if enc != nil {
+		if cerr := enc.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n > limit {
+		err = fmt.Errorf("snapshot is larger than the %s upload limit", formatSize(limit))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", "", err
+	}
+	return tmp.Name(), ext, nil
+}
+
+func handleUploadSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fail := func(err error) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+	}
+
+	limit := maxUploadSize()
+	if r.ContentLength > limit+1<<20 {
+		http.Error(w, fmt.Sprintf("Snapshot is larger than the %s upload limit", formatSize(limit)), http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit+1<<20)
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected a multipart/form-data upload", http.StatusBadRequest)
+		return
+	}
+
+	var tmpPath, ext, base, notes string
+	defer func() {
+		if tmpPath != "" {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+		switch part.FormName() {
+		case "notes":
+			data, _ := io.ReadAll(io.LimitReader(part, 4<<10))
+			notes = strings.TrimSpace(string(data))
+		case "file":
+			if tmpPath != "" {
+				fail(fmt.Errorf("only one file can be uploaded at a time"))
+				return
+			}
+			base = uploadBaseName(part.FileName())
+			if tmpPath, ext, err = receiveUpload(part, limit); err != nil {
+				fail(err)
+				return
+			}
+		}
+		part.Close()
+	}
+	if tmpPath == "" {
+		http.Error(w, "Missing file", http.StatusBadRequest)
+		return
+	}
+
+	if err := verifyDump(tmpPath); err != nil {
+		fail(err)
+		return
+	}
+
+	filename := uniqueSnapshotFilename(base, ext)
+	path := filepath.Join(snapshotsDir, filename)
+	if err := os.Rename(tmpPath, path); err != nil {
+		fail(err)
+		return
+	}
+	tmpPath = ""
+	os.Chmod(path, 0644)
+
+	meta := &SnapshotMeta{
+		Label:       snapshotLabel(filename, nil),
+		Kind:        kindUploaded,
+		Notes:       notes,
+		CreatedBy:   r.URL.Query().Get("created_by"),
+		CreatedAt:   time.Now(),
+		Format:      snapshotFormat(filename),
+		Compression: -1,
+	}
+	if meta.CreatedBy == "" {
+		meta.CreatedBy = "upload"
+	}
+	if err := writeSnapshotMeta(path, meta); err != nil {
+		fail(err)
+		return
+	}
+
+	invalidateCache()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"filename": filename,
+	})
+}
+
+// handleDownloadSnapshot streams a snapshot to the client. Directory-format
+// snapshots are sent as a tar archive of the directory. Encrypted snapshots
+// are sent as stored unless decrypt=1 is given.
+func handleDownloadSnapshot(w http.ResponseWriter, r *http.Request) {
+	path, err := resolveSnapshotPath(r.URL.Query().Get("filename"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return
+	}
+	filename := filepath.Base(path)
+
+	if info.IsDir() {
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".tar"))
+		if err := writeDirectoryTar(w, path, filename); err != nil {
+			// Headers are gone, all that can be done is to cut the stream short
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+
+	if isEncryptedSnapshot(path) && r.URL.Query().Get("decrypt") == "1" {
+		plain, err := openSnapshotFile(path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer plain.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", strings.TrimSuffix(filename, extEncrypted)))
+		if _, err := io.Copy(w, plain); err != nil {
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	http.ServeContent(w, r, filename, info.ModTime(), f)
+}
+
+// writeDirectoryTar writes the files of a directory-format snapshot as a tar
+// stream with entries under prefix/
+func writeDirectoryTar(w io.Writer, dir, prefix string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(filepath.Join(prefix, rel))
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
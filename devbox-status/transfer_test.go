@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func gzipForTest(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(data))
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDetectDumpFormat(t *testing.T) {
+	plain := "--\n" + plainDumpHeader + "\n--\n\nSET statement_timeout = 0;\n"
+	// Upload sniffing only sees the start of a compressed stream
+	big := gzipForTest(t, plain+strings.Repeat("INSERT INTO t VALUES (1);\n", 100000))
+
+	tests := []struct {
+		name    string
+		head    []byte
+		want    string
+		wantErr bool
+	}{
+		{"custom archive", []byte("PGDMP\x01\x0f\x00"), extCustom, false},
+		{"plain SQL", []byte(plain), extPlain, false},
+		{"compressed SQL", gzipForTest(t, plain), extPlainCompressed, false},
+		{"start of compressed SQL", big[:512], extPlainCompressed, false},
+		{"gzip of something else", gzipForTest(t, "hello"), "", true},
+		{"broken gzip", []byte{0x1f, 0x8b, 0x00}, "", true},
+		{"header too late", []byte(strings.Repeat(" ", 8<<10) + plainDumpHeader), "", true},
+		{"CSV", []byte("id,email\n1,a@example.com\n"), "", true},
+		{"empty", nil, "", true},
+	}
+	for _, tt := range tests {
+		got, err := detectDumpFormat(tt.head)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: detectDumpFormat() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUploadBaseName(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"backup.sql", "backup"},
+		{"backup.sql.gz", "backup"},
+		{"backup.dump", "backup"},
+		{"2024-01-15T1030_before migration.sql", "2024-01-15T1030_before_migration"},
+		{"../../etc/passwd", "passwd"},
+		{`C:\Users\me\prod.dump`, "prod"},
+		{"..sql", ""},
+		{"_-hidden.sql", "hidden"},
+		{"über.sql", "ber"},
+		{strings.Repeat("a", 150) + ".sql", strings.Repeat("a", 100)},
+	}
+	for _, tt := range tests {
+		got := uploadBaseName(tt.in)
+		if tt.want == "" {
+			if !strings.HasSuffix(got, "_upload") {
+				t.Errorf("uploadBaseName(%q) = %q, want a generated name", tt.in, got)
+			}
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("uploadBaseName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyDumpTrailer(t *testing.T) {
+	t.Setenv("SNAPSHOT_KEY_FILE", filepath.Join(t.TempDir(), "missing"))
+	body := "--\n" + plainDumpHeader + "\n--\n\n" + strings.Repeat("INSERT INTO t VALUES (1);\n", 5000)
+	complete := body + "\n--\n" + plainDumpTrailer + "\n--\n\n"
+
+	tests := []struct {
+		name    string
+		file    string
+		data    []byte
+		wantErr bool
+	}{
+		{"complete", "a.sql", []byte(complete), false},
+		{"complete, compressed", "a.sql.gz", gzipForTest(t, complete), false},
+		{"no trailer", "a.sql", []byte(body), true},
+		{"trailer not at the end", "a.sql", []byte(complete + strings.Repeat("SELECT 1;\n", 100)), true},
+		{"truncated gzip", "a.sql.gz", gzipForTest(t, complete)[:200], true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := verifyDump(path); (err != nil) != tt.wantErr {
+				t.Errorf("verifyDump() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
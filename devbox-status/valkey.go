@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// valkeyConn is a minimal RESP client, enough to dump and restore keys
+type valkeyConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// dialValkey connects to VALKEY_ADDR (default localhost:6379),
+// authenticating with VALKEY_PASSWORD if set
+func dialValkey() (*valkeyConn, error) {
+	conn, err := net.DialTimeout("tcp", getEnv("VALKEY_ADDR", "localhost:6379"), 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &valkeyConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if password := getEnv("VALKEY_PASSWORD", ""); password != "" {
+		if _, err := c.do("AUTH", password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *valkeyConn) Close() error {
+	return c.conn.Close()
+}
+
+// send queues a command without waiting for its reply
+func (c *valkeyConn) send(args ...string) {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// do sends a command and reads its reply
+func (c *valkeyConn) do(args ...string) (interface{}, error) {
+	c.send(args...)
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// read parses one reply: a string, int64, []byte (nil for a null bulk
+// string) or []interface{}. Error replies are returned as errors.
+func (c *valkeyConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("valkey: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New("valkey: " + line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return []byte(nil), err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("valkey: unexpected reply %q", line)
+}
+
+// databases lists the logical databases that hold keys, from
+// INFO keyspace ("db0:keys=3,expires=0,avg_ttl=0")
+func (c *valkeyConn) databases() ([]int, error) {
+	reply, err := c.do("INFO", "keyspace")
+	if err != nil {
+		return nil, err
+	}
+	info, _ := reply.([]byte)
+	var dbs []int
+	for _, line := range strings.Split(string(info), "\n") {
+		name, _, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if n, err := strconv.Atoi(strings.TrimPrefix(name, "db")); ok && strings.HasPrefix(name, "db") && err == nil {
+			dbs = append(dbs, n)
+		}
+	}
+	return dbs, nil
+}
+
+// The key dump is a header followed by one record per key:
+// db (uint32) | ttl in ms, 0 for none (int64) | key length (uint32) | key |
+// payload length (uint32) | DUMP payload
+const valkeyDumpMagic = "DBXVK01\n"
+
+// dumpValkey writes every key of every database to w using DUMP, which
+// preserves types and encodings. It returns the number of keys written and
+// the databases they came from.
+func dumpValkey(w io.Writer, job *Job) (int, []int, error) {
+	c, err := dialValkey()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer c.Close()
+
+	dbs, err := c.databases()
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err := io.WriteString(w, valkeyDumpMagic); err != nil {
+		return 0, nil, err
+	}
+
+	total := 0
+	for _, db := range dbs {
+		if _, err := c.do("SELECT", strconv.Itoa(db)); err != nil {
+			return total, dbs, err
+		}
+		cursor := "0"
+		count := 0
+		for {
+			reply, err := c.do("SCAN", cursor, "COUNT", "1000")
+			if err != nil {
+				return total, dbs, err
+			}
+			page, ok := reply.([]interface{})
+			if !ok || len(page) != 2 {
+				return total, dbs, fmt.Errorf("valkey: unexpected SCAN reply")
+			}
+			next, _ := page[0].([]byte)
+			keys, _ := page[1].([]interface{})
+
+			// Pipeline DUMP and PTTL for the whole page
+			for _, k := range keys {
+				key, _ := k.([]byte)
+				c.send("DUMP", string(key))
+				c.send("PTTL", string(key))
+			}
+			if err := c.w.Flush(); err != nil {
+				return total, dbs, err
+			}
+			for _, k := range keys {
+				key, _ := k.([]byte)
+				dump, err := c.read()
+				if err != nil {
+					return total, dbs, err
+				}
+				ttlReply, err := c.read()
+				if err != nil {
+					return total, dbs, err
+				}
+				payload, _ := dump.([]byte)
+				ttl, _ := ttlReply.(int64)
+				if payload == nil || ttl == -2 {
+					continue // expired or deleted since SCAN
+				}
+				if ttl < 0 {
+					ttl = 0
+				}
+				if err := writeValkeyRecord(w, uint32(db), ttl, key, payload); err != nil {
+					return total, dbs, err
+				}
+				count++
+			}
+
+			cursor = string(next)
+			if cursor == "0" {
+				break
+			}
+		}
+		job.logf("Valkey db%d: %d keys", db, count)
+		total += count
+	}
+	return total, dbs, nil
+}
+
+func writeValkeyRecord(w io.Writer, db uint32, ttl int64, key, payload []byte) error {
+	var header [16]byte
+	binary.BigEndian.PutUint32(header[0:], db)
+	binary.BigEndian.PutUint64(header[4:], uint64(ttl))
+	binary.BigEndian.PutUint32(header[12:], uint32(len(key)))
+	for _, b := range [][]byte{header[:], key, binary.BigEndian.AppendUint32(nil, uint32(len(payload))), payload} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// valkeyMaxBulk caps the keys and payloads read from a dump: Valkey
+// rejects larger arguments (proto-max-bulk-len), so a larger length means a
+// corrupt file rather than a reason to allocate gigabytes
+const valkeyMaxBulk = 512 << 20
+
+// valkeyRecord is one key of a dump written by dumpValkey
+type valkeyRecord struct {
+	db      uint32
+	ttl     int64
+	key     []byte
+	payload []byte
+}
+
+// valkeyDumpReader reads the records of a dump written by dumpValkey
+type valkeyDumpReader struct {
+	r *bufio.Reader
+}
+
+func newValkeyDumpReader(r io.Reader) (*valkeyDumpReader, error) {
+	br := bufio.NewReaderSize(r, 64<<10)
+	magic := make([]byte, len(valkeyDumpMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || !bytes.Equal(magic, []byte(valkeyDumpMagic)) {
+		return nil, fmt.Errorf("not a valkey key dump")
+	}
+	return &valkeyDumpReader{r: br}, nil
+}
+
+// next returns the next record, or io.EOF after the last one
+func (d *valkeyDumpReader) next() (*valkeyRecord, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(d.r, header[:]); err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, fmt.Errorf("valkey key dump is truncated: %v", err)
+	}
+	rec := &valkeyRecord{
+		db:  binary.BigEndian.Uint32(header[0:]),
+		ttl: int64(binary.BigEndian.Uint64(header[4:])),
+	}
+	var err error
+	if rec.key, err = readValkeyBytes(d.r, binary.BigEndian.Uint32(header[12:])); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(d.r, size[:]); err != nil {
+		return nil, fmt.Errorf("valkey key dump is truncated: %v", err)
+	}
+	if rec.payload, err = readValkeyBytes(d.r, binary.BigEndian.Uint32(size[:])); err != nil {
+		return nil, err
+	}
+	if rec.ttl < 0 {
+		return nil, fmt.Errorf("valkey key dump is corrupt: negative TTL for %q", rec.key)
+	}
+	return rec, nil
+}
+
+// checkValkeyDump reads a whole dump without touching Valkey, so that a
+// corrupt or truncated file is rejected before anything is flushed. It
+// returns the number of keys.
+func checkValkeyDump(r io.Reader) (int, error) {
+	d, err := newValkeyDumpReader(r)
+	if err != nil {
+		return 0, err
+	}
+	keys := 0
+	for {
+		if _, err := d.next(); err == io.EOF {
+			return keys, nil
+		} else if err != nil {
+			return keys, err
+		}
+		keys++
+	}
+}
+
+// restoreValkey replaces the contents of Valkey with a dump written by
+// dumpValkey: every database is flushed, then each key is RESTOREd with its
+// remaining time to live. Callers check the dump with checkValkeyDump first.
+func restoreValkey(r io.Reader, job *Job) (int, error) {
+	d, err := newValkeyDumpReader(r)
+	if err != nil {
+		return 0, err
+	}
+
+	c, err := dialValkey()
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	if _, err := c.do("FLUSHALL"); err != nil {
+		return 0, err
+	}
+
+	current := uint32(0)
+	restored := 0
+	for {
+		rec, err := d.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return restored, err
+		}
+
+		if rec.db != current || restored == 0 {
+			if _, err := c.do("SELECT", strconv.Itoa(int(rec.db))); err != nil {
+				return restored, err
+			}
+			current = rec.db
+		}
+		if _, err := c.do("RESTORE", string(rec.key), strconv.FormatInt(rec.ttl, 10), string(rec.payload), "REPLACE"); err != nil {
+			return restored, fmt.Errorf("db%d %q: %v", rec.db, rec.key, err)
+		}
+		restored++
+	}
+	job.logf("Restored %d Valkey keys", restored)
+	return restored, nil
+}
+
+func readValkeyBytes(r io.Reader, n uint32) ([]byte, error) {
+	if n > valkeyMaxBulk {
+		return nil, fmt.Errorf("valkey key dump is corrupt: %d byte record exceeds %d bytes", n, valkeyMaxBulk)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("valkey key dump is truncated: %v", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckValkeyDump(t *testing.T) {
+	var dump bytes.Buffer
+	dump.WriteString(valkeyDumpMagic)
+	writeValkeyRecord(&dump, 0, 0, []byte("session:1"), []byte("payload one"))
+	writeValkeyRecord(&dump, 0, 60000, []byte("session:2"), []byte("payload two"))
+	writeValkeyRecord(&dump, 3, 0, []byte("queue"), []byte{})
+	valid := dump.Bytes()
+
+	// A record header claiming a 4 GiB key
+	huge := append([]byte(valkeyDumpMagic), make([]byte, 16)...)
+	binary.BigEndian.PutUint32(huge[len(valkeyDumpMagic)+12:], 0xFFFFFFFF)
+
+	negative := append([]byte(valkeyDumpMagic), make([]byte, 16)...)
+	binary.BigEndian.PutUint64(negative[len(valkeyDumpMagic)+4:], 1<<63)
+	negative = append(negative, 0, 0, 0, 0)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		wantKeys int
+		err      string
+	}{
+		{"valid", valid, 3, ""},
+		{"empty", []byte(valkeyDumpMagic), 0, ""},
+		{"not a dump", []byte("-- PostgreSQL database dump\n"), 0, "not a valkey key dump"},
+		{"truncated header", valid[:len(valkeyDumpMagic)+10], 0, "truncated"},
+		{"truncated payload", valid[:len(valid)-1], 2, "truncated"},
+		{"oversized record", huge, 0, "exceeds"},
+		{"negative ttl", negative, 0, "negative TTL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := checkValkeyDump(bytes.NewReader(tt.data))
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("error = %v, want %q", err, tt.err)
+			}
+			if keys != tt.wantKeys {
+				t.Errorf("keys = %d, want %d", keys, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestValkeyDumpReader(t *testing.T) {
+	var dump bytes.Buffer
+	dump.WriteString(valkeyDumpMagic)
+	writeValkeyRecord(&dump, 2, 1500, []byte("k"), []byte("v"))
+
+	d, err := newValkeyDumpReader(&dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := d.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.db != 2 || rec.ttl != 1500 || string(rec.key) != "k" || string(rec.payload) != "v" {
+		t.Errorf("next() = %+v", rec)
+	}
+	if _, err := d.next(); err != io.EOF {
+		t.Errorf("next() after the last record = %v, want io.EOF", err)
+	}
+}
+
+func TestPrunePreRestoreEnvironments(t *testing.T) {
+	dir := useSnapshotsDir(t)
+	t.Setenv("PRE_RESTORE_KEEP", "2")
+	now := time.Now()
+	write := func(name, kind string, age time.Duration) {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := json.Marshal(&EnvironmentManifest{Version: 1, Kind: kind, CreatedAt: now.Add(-age)})
+		if err := os.WriteFile(metaPath(path), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, now.Add(-age), now.Add(-age))
+	}
+	write("a_pre-restore.environment.tar", kindPreRestore, 4*time.Hour)
+	write("b_pre-restore.environment.tar", kindPreRestore, 3*time.Hour)
+	write("c_pre-restore.environment.tar", kindPreRestore, 2*time.Hour)
+	write("d_pre-restore.environment.tar", kindPreRestore, time.Hour)
+	write("old_release.environment.tar", "", 10*time.Hour)
+
+	prunePreRestoreEnvironments(nil)
+
+	var got []string
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+	want := []string{
+		"c_pre-restore.environment.tar", "c_pre-restore.environment.tar.json",
+		"d_pre-restore.environment.tar", "d_pre-restore.environment.tar.json",
+		"old_release.environment.tar", "old_release.environment.tar.json",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("left %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	verifyVerified   = "verified"
+	verifyFailed     = "failed"
+	verifyUnverified = "unverified"
+	// verifyRestorable means the snapshot restored but there were no
+	// recorded row counts to check the data against
+	verifyRestorable = "restorable"
+)
+
+var errNoRowCounts = errors.New("the snapshot restores, but has no recorded row counts to compare with")
+
+// SnapshotVerification records the outcome of test-restoring a snapshot
+type SnapshotVerification struct {
+	Status     string    `json:"status"`
+	CheckedAt  time.Time `json:"checked_at"`
+	SHA256     string    `json:"sha256"`
+	Error      string    `json:"error,omitempty"`
+	Mismatches []string  `json:"mismatches,omitempty"`
+}
+
+// verificationStatus is the badge shown for a snapshot
+func verificationStatus(meta *SnapshotMeta) string {
+	if meta == nil || meta.Verification == nil {
+		return verifyUnverified
+	}
+	return meta.Verification.Status
+}
+
+// rowQuerier is a *sql.DB or *sql.Tx
+type rowQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// tableRowCounts counts the rows of every user table in q, keyed by
+// "schema.table". Partitions are counted, their parents aren't.
+func tableRowCounts(ctx context.Context, q rowQuerier) (map[string]int64, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT n.nspname || '.' || c.relname,
+		       (xpath('/row/c/text()', query_to_xml(
+		           format('SELECT count(*) AS c FROM %I.%I', n.nspname, c.relname), false, true, '')))[1]::text::bigint
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind = 'r'
+		  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+		  AND n.nspname NOT LIKE 'pg_toast%'
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var table string
+		var count int64
+		if err := rows.Scan(&table, &count); err != nil {
+			return nil, err
+		}
+		counts[table] = count
+	}
+	return counts, rows.Err()
+}
+
+// exportRowCounts exports a snapshot of dbName for pg_dump --snapshot and
+// counts the rows of every table in it, so the counts describe exactly the
+// data that is dumped. release ends the transaction and must only be called
+// once pg_dump has finished.
+func exportRowCounts(ctx context.Context, dbName string) (snapshotID string, counts map[string]int64, release func(), err error) {
+	conn, err := sql.Open("postgres", connString(dbName))
+	if err != nil {
+		return "", nil, nil, err
+	}
+	tx, err := conn.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		conn.Close()
+		return "", nil, nil, err
+	}
+	release = func() {
+		tx.Rollback()
+		conn.Close()
+	}
+
+	if err := tx.QueryRowContext(ctx, "SELECT pg_export_snapshot()").Scan(&snapshotID); err != nil {
+		release()
+		return "", nil, nil, err
+	}
+	counts, err = tableRowCounts(ctx, tx)
+	if err != nil {
+		release()
+		return "", nil, nil, err
+	}
+	return snapshotID, counts, release, nil
+}
+
+// dumpDataTables lists the tables ("schema.table") whose data is in the
+// snapshot at path
+func dumpDataTables(ctx context.Context, path string) (map[string]bool, error) {
+	contents, err := inspectSnapshot(ctx, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	tables := make(map[string]bool)
+	for _, t := range contents.Tables {
+		if t.HasData {
+			tables[t.qualified()] = true
+		}
+	}
+	return tables, nil
+}
+
+// snapshotChecksum returns the SHA-256 of a snapshot file. Directory
+// snapshots hash each file's name and contents in name order.
+func snapshotChecksum(path string) (string, error) {
+	h := sha256.New()
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return "", err
+		}
+		files = files[:0]
+		for _, entry := range entries {
+			if entry.Type().IsRegular() {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+		sort.Strings(files)
+	}
+
+	for _, file := range files {
+		if info.IsDir() {
+			io.WriteString(h, filepath.Base(file)+"\x00")
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// compareRowCounts lists the tables whose restored row count differs from
+// the count recorded when the snapshot was taken
+func compareRowCounts(expected, restored map[string]int64) []string {
+	var mismatches []string
+	for table, want := range expected {
+		got, ok := restored[table]
+		switch {
+		case !ok:
+			mismatches = append(mismatches, fmt.Sprintf("%s: missing after restore (expected %d rows)", table, want))
+		case got != want:
+			mismatches = append(mismatches, fmt.Sprintf("%s: expected %d rows, restored %d", table, want, got))
+		}
+	}
+	sort.Strings(mismatches)
+	return mismatches
+}
+
+func startVerifyJob(filename, path string) (*Job, error) {
+	if adminDB == nil {
+		return nil, fmt.Errorf("no connection to the maintenance database")
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	job := jobs.start("verify", filename, func(ctx context.Context, job *Job) error {
+		return runVerify(ctx, job, path)
+	})
+	return job, nil
+}
+
+// runVerify checksums the snapshot, restores it into a throwaway database and
+// compares the restored row counts with those recorded when it was taken.
+// The outcome is written to the sidecar whether or not verification passes.
+func runVerify(ctx context.Context, job *Job, path string) error {
+	meta, err := readOrInitSnapshotMeta(path)
+	if err != nil {
+		return fmt.Errorf("could not read metadata: %v", err)
+	}
+
+	result := &SnapshotVerification{Status: verifyFailed}
+	verifyErr := verifySnapshot(ctx, job, path, meta, result)
+	if verifyErr != nil && ctx.Err() != nil {
+		// A cancelled verification says nothing about the snapshot
+		return verifyErr
+	}
+
+	result.CheckedAt = time.Now()
+	switch {
+	case verifyErr == nil:
+		result.Status = verifyVerified
+	case errors.Is(verifyErr, errNoRowCounts):
+		result.Status = verifyRestorable
+		result.Error = verifyErr.Error()
+	default:
+		result.Error = verifyErr.Error()
+	}
+	// Re-read in case the sidecar changed (e.g. pinned) while restoring
+	if fresh, err := readOrInitSnapshotMeta(path); err == nil {
+		meta = fresh
+	}
+	meta.Verification = result
+	if err := writeSnapshotMeta(path, meta); err != nil {
+		return fmt.Errorf("could not record verification: %v", err)
+	}
+	return verifyErr
+}
+
+func verifySnapshot(ctx context.Context, job *Job, path string, meta *SnapshotMeta, result *SnapshotVerification) error {
+	job.logf("Computing SHA-256 checksum")
+	sum, err := snapshotChecksum(path)
+	if err != nil {
+		return fmt.Errorf("could not read snapshot: %v", err)
+	}
+	result.SHA256 = sum
+	if prev := meta.Verification; prev != nil && prev.SHA256 != "" && prev.SHA256 != sum {
+		job.logf("Warning: checksum changed since the last verification (%s)", prev.CheckedAt.Format("2006-01-02 15:04"))
+	}
+	job.logf("SHA-256 %s", sum)
+
+	scratch := scratchDBName(getEnv("POSTGRES_DB", "devdb"), "verify_"+time.Now().Format("20060102150405"))
+	job.update(func(info *JobInfo) { info.TotalBytes = snapshotSize(path) })
+	job.logf("Restoring into throwaway database %s", scratch)
+	if err := createEmptyDatabase(ctx, scratch); err != nil {
+		return fmt.Errorf("could not create scratch database: %v", err)
+	}
+	defer func() {
+		job.logf("Dropping %s", scratch)
+		dropDatabase(scratch)
+	}()
+
+	if err := loadSnapshot(ctx, job, path, scratch); err != nil {
+		return err
+	}
+
+	// Only tables whose data was dumped are compared; scope filters leave
+	// the others out or empty
+	dumped, err := dumpDataTables(ctx, path)
+	if err != nil {
+		return fmt.Errorf("could not list the tables in the snapshot: %v", err)
+	}
+	if len(dumped) == 0 {
+		job.logf("The snapshot holds no table data; checked that it restores cleanly")
+		return nil
+	}
+	if meta.TableRows == nil {
+		return errNoRowCounts
+	}
+	expected := make(map[string]int64)
+	var unrecorded []string
+	for table := range dumped {
+		if n, ok := meta.TableRows[table]; ok {
+			expected[table] = n
+		} else {
+			unrecorded = append(unrecorded, fmt.Sprintf("%s: no row count recorded", table))
+		}
+	}
+
+	conn, err := sql.Open("postgres", connString(scratch))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	restored, err := tableRowCounts(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("could not count restored rows: %v", err)
+	}
+	result.Mismatches = append(compareRowCounts(expected, restored), unrecorded...)
+	sort.Strings(result.Mismatches)
+	if len(result.Mismatches) > 0 {
+		for _, m := range result.Mismatches {
+			job.logf("Mismatch: %s", m)
+		}
+		return fmt.Errorf("row counts differ for %d table(s)", len(result.Mismatches))
+	}
+	job.logf("Row counts match for %d table(s)", len(expected))
+	return nil
+}
+
+var verifyScheduler = &scheduler{name: "verify", action: verifyUnverifiedSnapshots}
+
+// verifyUnverifiedSnapshots verifies every snapshot that has not been
+// verified yet, one at a time, newest first
+func verifyUnverifiedSnapshots(string) string {
+	files, _ := listSnapshotFiles()
+	sort.Slice(files, func(i, j int) bool {
+		mi, _ := readSnapshotMeta(files[i])
+		mj, _ := readSnapshotMeta(files[j])
+		return snapshotTime(files[i], mi).After(snapshotTime(files[j], mj))
+	})
+
+	busy := jobs.activeTargets()
+	var verified, failed int
+	for _, file := range files {
+		meta, _ := readSnapshotMeta(file)
+		name := filepath.Base(file)
+		if verificationStatus(meta) != verifyUnverified || busy[name] {
+			continue
+		}
+		job, err := startVerifyJob(name, file)
+		if err != nil {
+			log.Printf("Scheduled verification of %s failed: %v", name, err)
+			failed++
+			continue
+		}
+		if info := job.Wait(); info.Status == jobSucceeded {
+			verified++
+		} else {
+			failed++
+		}
+	}
+
+	if verified+failed == 0 {
+		return "nothing to verify"
+	}
+	var parts []string
+	if verified > 0 {
+		parts = append(parts, fmt.Sprintf("%d verified", verified))
+	}
+	if failed > 0 {
+		parts = append(parts, fmt.Sprintf("%d failed", failed))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func handleVerifySnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filename := r.URL.Query().Get("filename")
+	path, err := resolveSnapshotPath(filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, err := startVerifyJob(filename, path)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	// Scripts can pass wait=1 to block until verification has finished
+	if r.URL.Query().Get("wait") != "" {
+		info := job.Wait()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": info.Status == jobSucceeded,
+			"error":   info.Error,
+			"job_id":  info.ID,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"job_id":  job.Info().ID,
+	})
+}
@@ -161,6 +161,24 @@ if [ -n "$CF_TUNNEL_TOKEN" ]; then
     unset CF_TUNNEL_TOKEN
 fi
 
+# The snapshot key stays in /etc/secrets; the marker only tells the snapshot
+# script that devbox-status will encrypt
+rm -f /var/run/devbox/snapshot_encryption
+if [ -n "$SNAPSHOT_ENCRYPTION_KEY" ]; then
+    echo "[entrypoint] Creating snapshot encryption key file"
+    echo "$SNAPSHOT_ENCRYPTION_KEY" > /etc/secrets/snapshot_key
+    chmod 600 /etc/secrets/snapshot_key
+    touch /var/run/devbox/snapshot_encryption
+    unset SNAPSHOT_ENCRYPTION_KEY
+fi
+
+if [ -n "$SNAPSHOT_S3_SECRET_KEY" ]; then
+    echo "[entrypoint] Creating snapshot storage secret key file"
+    echo "$SNAPSHOT_S3_SECRET_KEY" > /etc/secrets/s3_secret_key
+    chmod 600 /etc/secrets/s3_secret_key
+    unset SNAPSHOT_S3_SECRET_KEY
+fi
+
 
 # Ensure sudo permissions (always update)
 echo "${TARGET_USERNAME} ALL=(ALL) NOPASSWD:ALL" > /etc/sudoers.d/${TARGET_USERNAME}
@@ -68,6 +68,18 @@ EOF
         sed -i "/^listen_addresses/d" /etc/postgresql/$PGVERSION/$PGCLUSTER/postgresql.conf
         echo "listen_addresses = 'localhost'" >> /etc/postgresql/$PGVERSION/$PGCLUSTER/postgresql.conf
 
+        # Load pg_stat_statements for the Top queries view (devbox-status creates the extension),
+        # keeping any libraries that are already preloaded
+        PGCONF=/etc/postgresql/$PGVERSION/$PGCLUSTER/postgresql.conf
+        PRELOAD=$(sed -n "s/^shared_preload_libraries *= *'\([^']*\)'.*/\1/p" "$PGCONF" | tail -n 1 | tr -d ' ')
+        case ",$PRELOAD," in
+            *,pg_stat_statements,*) ;;
+            *)
+                sed -i "/^shared_preload_libraries/d" "$PGCONF"
+                echo "shared_preload_libraries = '${PRELOAD:+$PRELOAD,}pg_stat_statements'" >> "$PGCONF"
+                ;;
+        esac
+
         # Start PostgreSQL temporarily if we need to create database
         if [ ! -f "/etc/postgres-db-created" ]; then
             echo "[postgres] First run - creating database..."
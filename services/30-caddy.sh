@@ -68,6 +68,11 @@ EOF
         reverse_proxy localhost:8081
     }
 
+    # pgweb for side databases, started on demand by devbox-status
+    handle_path ${SERVICE_ROOT}sidedb/* {
+        reverse_proxy localhost:8085
+    }
+
     handle_path ${SERVICE_ROOT}valkey/* {
         reverse_proxy localhost:8084
     }